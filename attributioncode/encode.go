@@ -0,0 +1,99 @@
+package attributioncode
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// EncodeOptions controls how a Code is written to an installer.
+type EncodeOptions struct {
+	// MaxLength is the number of bytes available for the code in the
+	// installer. Zero means there is no limit.
+	MaxLength int
+
+	// DropOrder lists the optional fields which are dropped, in order, until
+	// the code fits in MaxLength. It defaults to the DropOrder of the schema
+	// used to validate the code.
+	DropOrder []string
+}
+
+// Payload is an attribution code ready to be written to an installer.
+type Payload struct {
+	Code string
+
+	// Dropped lists the fields which were dropped to fit in the installer.
+	Dropped []string
+}
+
+// Encode returns the query escaped attribution code written to installers.
+// When the code is longer than opts.MaxLength, fields are dropped following
+// opts.DropOrder until it fits. An error is returned when the code still does
+// not fit.
+func (c *Code) Encode(opts EncodeOptions) (*Payload, error) {
+	vals := url.Values{}
+	for k, v := range c.rawURLVals {
+		vals[k] = v
+	}
+	vals.Set(downloadTokenField, c.DownloadToken())
+
+	dropOrder := opts.DropOrder
+	if dropOrder == nil {
+		dropOrder = c.dropOrder
+	}
+
+	payload := &Payload{Code: url.QueryEscape(vals.Encode())}
+	for _, field := range dropOrder {
+		if opts.MaxLength <= 0 || len(payload.Code) <= opts.MaxLength {
+			break
+		}
+		if _, ok := vals[field]; !ok || field == downloadTokenField {
+			continue
+		}
+		vals.Del(field)
+		payload.Code = url.QueryEscape(vals.Encode())
+		payload.Dropped = append(payload.Dropped, field)
+	}
+
+	if opts.MaxLength > 0 && len(payload.Code) > opts.MaxLength {
+		return nil, errors.Errorf("code is %d bytes, expected at most %d", len(payload.Code), opts.MaxLength)
+	}
+
+	return payload, nil
+}
+
+// Decode parses an attribution code written by Encode, as Firefox reads it
+// back out of an installer. Stripped fields are not written to installers, so
+// they are empty in the returned Code. The default schema and partner profiles
+// are used.
+func Decode(payload string) (*Code, error) {
+	return (&Validator{}).Decode(payload)
+}
+
+// Decode is like the package level Decode, but the partner is matched against
+// the partner profiles of the validator, and the code is re-encoded with the
+// drop order of its schema.
+func (v *Validator) Decode(payload string) (*Code, error) {
+	unescaped, err := url.QueryUnescape(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "QueryUnescape")
+	}
+
+	vals, err := url.ParseQuery(unescaped)
+	if err != nil {
+		return nil, errors.Wrap(err, "ParseQuery")
+	}
+
+	downloadToken := vals.Get(downloadTokenField)
+	vals.Del(downloadTokenField)
+
+	fields := make(map[string]string)
+	for k := range vals {
+		fields[k] = vals.Get(k)
+	}
+
+	code := newCode(fields, vals, downloadToken)
+	code.partner = matchPartner(v.partnerProfiles(), code.Content)
+	code.dropOrder = v.schema().DropOrder
+	return code, nil
+}
@@ -0,0 +1,187 @@
+package attributioncode
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestEncode(t *testing.T) {
+	v := &Validator{}
+	code, err := v.Validate(base64Decoder.EncodeToString([]byte("source=a&experiment=exp&variation=var&ua=chrome")), "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	full, err := code.Encode(EncodeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if full.Code != code.URLEncode() || len(full.Dropped) != 0 {
+		t.Errorf("unexpected payload without a budget: %+v", full)
+	}
+
+	for _, c := range []struct {
+		MaxLength int
+		DropOrder []string
+		Dropped   []string
+		Err       bool
+	}{
+		{MaxLength: len(full.Code)},
+		{MaxLength: len(full.Code) - 1, Dropped: []string{"ua"}},
+		{MaxLength: len(full.Code) - 30, Dropped: []string{"ua", "variation"}},
+		{MaxLength: len(full.Code) - 30, DropOrder: []string{"experiment", "variation"}, Dropped: []string{"experiment", "variation"}},
+		{MaxLength: len(full.Code) - 50, Dropped: []string{"ua", "variation", "experiment"}},
+		{MaxLength: 10, Err: true},
+		{MaxLength: 10, DropOrder: []string{}, Err: true},
+	} {
+		payload, err := code.Encode(EncodeOptions{MaxLength: c.MaxLength, DropOrder: c.DropOrder})
+		if c.Err {
+			if err == nil {
+				t.Errorf("max length: %d, expected an error", c.MaxLength)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("max length: %d, unexpected error: %v", c.MaxLength, err)
+			continue
+		}
+		if len(payload.Code) > c.MaxLength {
+			t.Errorf("max length: %d, code is %d bytes", c.MaxLength, len(payload.Code))
+		}
+		if !reflect.DeepEqual(payload.Dropped, c.Dropped) {
+			t.Errorf("max length: %d, expected dropped: %v, got: %v", c.MaxLength, c.Dropped, payload.Dropped)
+		}
+		for _, field := range payload.Dropped {
+			if strings.Contains(payload.Code, field+"%3D") {
+				t.Errorf("max length: %d, %s was not dropped: %s", c.MaxLength, field, payload.Code)
+			}
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	v := &Validator{}
+	for _, in := range []string{
+		"source=a",
+		"source=google.com&medium=organic&campaign=(not set)&content=(not set)",
+		"source=a&experiment=exp&variation=var&ua=chrome&dlsource=mozorg",
+		"source=a&content=rta:abc%26def&client_id=cid&session_id=sid&client_id_ga4=ga4",
+	} {
+		code, err := v.Validate(base64Decoder.EncodeToString([]byte(in)), "", "", "https://www.mozilla.org/")
+		if err != nil {
+			t.Errorf("in: %s, unexpected error: %v", in, err)
+			continue
+		}
+		payload, err := code.Encode(EncodeOptions{})
+		if err != nil {
+			t.Errorf("in: %s, unexpected error: %v", in, err)
+			continue
+		}
+
+		decoded, err := Decode(payload.Code)
+		if err != nil {
+			t.Errorf("in: %s, unexpected error: %v", in, err)
+			continue
+		}
+
+		// Stripped fields are not written to the installer.
+		expected := *code
+		expected.ClientID, expected.SessionID, expected.ClientIDGA4 = "", "", ""
+		expected.keyID, expected.violations = "", nil
+		if !reflect.DeepEqual(decoded, &expected) {
+			t.Errorf("in: %s, decoded: %+v != expected: %+v", in, decoded, &expected)
+		}
+
+		reencoded, err := decoded.Encode(EncodeOptions{})
+		if err != nil || reencoded.Code != payload.Code {
+			t.Errorf("in: %s, re-encoded: %v != %s (err: %v)", in, reencoded, payload.Code, err)
+		}
+	}
+
+	for _, in := range []string{"%zz", "a%3D%25zz"} {
+		if _, err := Decode(in); err == nil {
+			t.Errorf("in: %s, expected an error", in)
+		}
+	}
+}
+
+func TestDecodeDropped(t *testing.T) {
+	code, err := (&Validator{}).Validate(base64Decoder.EncodeToString([]byte("source=a&experiment=exp&variation=var&ua=chrome")), "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	full, err := code.Encode(EncodeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// ua and variation are dropped first by the default schema.
+	payload, err := code.Encode(EncodeOptions{MaxLength: len(full.Code) - len(url.QueryEscape("&ua=chrome&variation=var"))})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(payload.Dropped, []string{"ua", "variation"}) {
+		t.Fatalf("unexpected dropped fields: %v", payload.Dropped)
+	}
+
+	decoded, err := Decode(payload.Code)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded.Source != "a" || decoded.Experiment != "exp" || decoded.Variation != "" || decoded.UA != "" || decoded.DownloadToken() != code.DownloadToken() {
+		t.Errorf("unexpected decoded code: %+v", decoded)
+	}
+
+	reencoded, err := decoded.Encode(EncodeOptions{})
+	if err != nil || reencoded.Code != payload.Code {
+		t.Errorf("re-encoded: %v != %s (err: %v)", reencoded, payload.Code, err)
+	}
+}
+
+func TestDecodeQuick(t *testing.T) {
+	f := func(source, content, ua, token string) bool {
+		code := newCode(map[string]string{"source": source, "content": content, "ua": ua}, url.Values{
+			"source":  []string{source},
+			"content": []string{content},
+			"ua":      []string{ua},
+		}, token)
+		payload, err := code.Encode(EncodeOptions{})
+		if err != nil {
+			return false
+		}
+		decoded, err := Decode(payload.Code)
+		if err != nil {
+			return false
+		}
+		return decoded.Source == source && decoded.Content == content && decoded.UA == ua && decoded.DownloadToken() == token
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeDoesNotModifyCode(t *testing.T) {
+	code, err := (&Validator{}).Validate(base64Decoder.EncodeToString([]byte("source=a&ua=chrome")), "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token := code.DownloadToken()
+	if token == "" {
+		t.Fatal("expected a download token")
+	}
+
+	before := code.rawURLVals.Encode()
+	if _, err := code.Encode(EncodeOptions{MaxLength: 160}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	code.URLEncode()
+	if after := code.rawURLVals.Encode(); after != before {
+		t.Errorf("Encode modified the code: %s != %s", after, before)
+	}
+	if code.DownloadToken() != token {
+		t.Errorf("download token changed: %s != %s", code.DownloadToken(), token)
+	}
+}
@@ -0,0 +1,139 @@
+package attributioncode
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultKeyID is the key ID given to the key passed to NewValidator.
+const DefaultKeyID = "default"
+
+// verificationKey is implemented by the key types accepted for attribution_sig.
+type verificationKey interface {
+	keyID() string
+	activeAt(t time.Time) bool
+	verify(msg, sig []byte) bool
+}
+
+func activeAt(notBefore, notAfter, t time.Time) bool {
+	if !notBefore.IsZero() && t.Before(notBefore) {
+		return false
+	}
+	if !notAfter.IsZero() && t.After(notAfter) {
+		return false
+	}
+	return true
+}
+
+// HMACKey is a shared secret used to sign attribution codes. Several keys can
+// be active at the same time so that secrets can be rotated without breaking
+// links which have already been handed out.
+type HMACKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+
+	// NotBefore and NotAfter bound the period during which the key is
+	// accepted. A zero value means there is no bound.
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+func (k *HMACKey) keyID() string {
+	return k.ID
+}
+
+func (k *HMACKey) activeAt(t time.Time) bool {
+	return activeAt(k.NotBefore, k.NotAfter, t)
+}
+
+func (k *HMACKey) verify(msg, sig []byte) bool {
+	mac := hmac.New(sha256.New, []byte(k.Secret))
+	mac.Write(msg)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// Ed25519Key is the public key of a signer of attribution codes. Unlike
+// HMACKey, it does not allow the holder to forge codes for other signers.
+type Ed25519Key struct {
+	ID string `json:"id"`
+
+	// PublicKey is base64 encoded in JSON.
+	PublicKey ed25519.PublicKey `json:"public_key"`
+
+	// NotBefore and NotAfter bound the period during which the key is
+	// accepted. A zero value means there is no bound.
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+func (k *Ed25519Key) keyID() string {
+	return k.ID
+}
+
+func (k *Ed25519Key) activeAt(t time.Time) bool {
+	return activeAt(k.NotBefore, k.NotAfter, t)
+}
+
+func (k *Ed25519Key) verify(msg, sig []byte) bool {
+	if len(k.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(k.PublicKey, msg, sig)
+}
+
+// ParseHMACKeys parses a JSON list of HMAC keys, e.g.:
+//
+//	[{"id": "2024-01", "secret": "...", "not_after": "2024-07-01T00:00:00Z"}]
+func ParseHMACKeys(data []byte) ([]*HMACKey, error) {
+	var keys []*HMACKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		if key.ID == "" {
+			return nil, errors.Errorf("key %d has no id", i)
+		}
+		if key.Secret == "" {
+			return nil, errors.Errorf("key %s has no secret", key.ID)
+		}
+		if seen[key.ID] {
+			return nil, errors.Errorf("key %s is defined more than once", key.ID)
+		}
+		seen[key.ID] = true
+	}
+
+	return keys, nil
+}
+
+// ParseEd25519Keys parses a JSON list of Ed25519 public keys, e.g.:
+//
+//	[{"id": "partner-1", "public_key": "<base64>", "not_before": "2024-01-01T00:00:00Z"}]
+func ParseEd25519Keys(data []byte) ([]*Ed25519Key, error) {
+	var keys []*Ed25519Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		if key.ID == "" {
+			return nil, errors.Errorf("key %d has no id", i)
+		}
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("key %s is %d bytes, expected %d", key.ID, len(key.PublicKey), ed25519.PublicKeySize)
+		}
+		if seen[key.ID] {
+			return nil, errors.Errorf("key %s is defined more than once", key.ID)
+		}
+		seen[key.ID] = true
+	}
+
+	return keys, nil
+}
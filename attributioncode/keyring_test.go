@@ -0,0 +1,109 @@
+package attributioncode
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHMACKeys(t *testing.T) {
+	keys, err := ParseHMACKeys([]byte(`[
+		{"id": "a", "secret": "secreta", "not_after": "2024-07-01T00:00:00Z"},
+		{"id": "b", "secret": "secretb", "not_before": "2024-06-01T00:00:00Z"}
+	]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "a" || keys[1].Secret != "secretb" {
+		t.Errorf("keys not parsed correctly: %+v", keys)
+	}
+	if !keys[0].NotAfter.Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)) || !keys[0].NotBefore.IsZero() {
+		t.Errorf("key dates not parsed correctly: %+v", keys[0])
+	}
+
+	for _, in := range []string{
+		`not json`,
+		`[{"secret": "noid"}]`,
+		`[{"id": "nosecret"}]`,
+		`[{"id": "a", "secret": "1"}, {"id": "a", "secret": "2"}]`,
+	} {
+		if _, err := ParseHMACKeys([]byte(in)); err == nil {
+			t.Errorf("expected an error parsing: %s", in)
+		}
+	}
+}
+
+func TestParseEd25519Keys(t *testing.T) {
+	keys, err := ParseEd25519Keys([]byte(`[
+		{"id": "partner", "public_key": "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=", "not_before": "2024-06-01T00:00:00Z"}
+	]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].ID != "partner" || len(keys[0].PublicKey) != 32 {
+		t.Errorf("keys not parsed correctly: %+v", keys)
+	}
+	if !keys[0].NotBefore.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("key dates not parsed correctly: %+v", keys[0])
+	}
+
+	for _, in := range []string{
+		`not json`,
+		`[{"public_key": "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}]`,
+		`[{"id": "short", "public_key": "AAAA"}]`,
+		`[{"id": "a", "public_key": "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}, {"id": "a", "public_key": "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}]`,
+	} {
+		if _, err := ParseEd25519Keys([]byte(in)); err == nil {
+			t.Errorf("expected an error parsing: %s", in)
+		}
+	}
+}
+
+func TestActiveHMACKey(t *testing.T) {
+	v := &Validator{
+		HMACKeys: []*HMACKey{
+			{ID: "old", Secret: "secretold", NotAfter: time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+			{ID: "new", Secret: "secretnew", NotBefore: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	for _, c := range []struct {
+		Now   time.Time
+		KeyID string
+	}{
+		{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), "old"},
+		{time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC), "old"},
+		{time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC), "new"},
+	} {
+		key := v.ActiveHMACKey(c.Now)
+		if key == nil || key.ID != c.KeyID {
+			t.Errorf("now: %s, expected key %s, got: %+v", c.Now, c.KeyID, key)
+		}
+	}
+
+	if key := (&Validator{}).ActiveHMACKey(time.Now()); key != nil {
+		t.Errorf("expected no key, got: %+v", key)
+	}
+}
+
+func TestCheckKeyIDs(t *testing.T) {
+	v := NewValidator("secret", 0)
+	v.HMACKeys = append(v.HMACKeys, &HMACKey{ID: "a", Secret: "secreta"})
+	v.Ed25519Keys = []*Ed25519Key{{ID: "b"}}
+	if err := v.CheckKeyIDs(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, dup := range []string{DefaultKeyID, "a", "b"} {
+		hmacDup := *v
+		hmacDup.HMACKeys = append(append([]*HMACKey{}, v.HMACKeys...), &HMACKey{ID: dup, Secret: "other"})
+		if err := hmacDup.CheckKeyIDs(); err == nil {
+			t.Errorf("expected an error for duplicate HMAC key %s", dup)
+		}
+
+		ed25519Dup := *v
+		ed25519Dup.Ed25519Keys = append(append([]*Ed25519Key{}, v.Ed25519Keys...), &Ed25519Key{ID: dup})
+		if err := ed25519Dup.CheckKeyIDs(); err == nil {
+			t.Errorf("expected an error for duplicate Ed25519 key %s", dup)
+		}
+	}
+}
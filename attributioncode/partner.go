@@ -0,0 +1,106 @@
+package attributioncode
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PartnerProfile describes a partner download flow, such as RTAMO (Return to
+// AMO), which is selected by a prefix in the content field.
+type PartnerProfile struct {
+	Name string `json:"name"`
+
+	// ContentPrefix selects the codes for this partner.
+	ContentPrefix string `json:"content_prefix"`
+
+	// AllowedReferers are the origins, e.g. "https://www.mozilla.org", of the
+	// pages allowed to link to downloads for this partner. Codes for this
+	// partner are rejected when the referer is not one of them.
+	AllowedReferers []string `json:"allowed_referers"`
+
+	// StorageKeyPrefix is prepended to the product in storage keys so that
+	// these downloads are stored separately.
+	StorageKeyPrefix string `json:"storage_key_prefix"`
+
+	// Product replaces the product requested from bouncer when it is set.
+	Product string `json:"product"`
+}
+
+// rtamoProfileName is the name of the partner profile reported by
+// Code.FromRTAMO.
+const rtamoProfileName = "RTAMO"
+
+// defaultPartnerProfiles are used when Validator.PartnerProfiles is nil.
+var defaultPartnerProfiles = []*PartnerProfile{
+	{
+		Name:             rtamoProfileName,
+		ContentPrefix:    "rta:",
+		AllowedReferers:  []string{"https://www.mozilla.org", "https://www.firefox.com"},
+		StorageKeyPrefix: "rtamo-",
+	},
+}
+
+// DefaultPartnerProfiles returns the profiles used when
+// Validator.PartnerProfiles is nil.
+func DefaultPartnerProfiles() []*PartnerProfile {
+	return defaultPartnerProfiles
+}
+
+// ParsePartnerProfiles parses a JSON list of partner profiles, e.g.:
+//
+//	[{"name": "RTAMO", "content_prefix": "rta:", "allowed_referers": ["https://www.mozilla.org"], "storage_key_prefix": "rtamo-"}]
+func ParsePartnerProfiles(data []byte) ([]*PartnerProfile, error) {
+	var profiles []*PartnerProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+
+	seen := make(map[string]bool)
+	for i, profile := range profiles {
+		if profile.Name == "" {
+			return nil, errors.Errorf("profile %d has no name", i)
+		}
+		if profile.ContentPrefix == "" {
+			return nil, errors.Errorf("profile %s has no content prefix", profile.Name)
+		}
+		if seen[profile.Name] {
+			return nil, errors.Errorf("profile %s is defined more than once", profile.Name)
+		}
+		seen[profile.Name] = true
+	}
+
+	return profiles, nil
+}
+
+// LoadPartnerProfiles reads and parses a JSON partner profiles file.
+func LoadPartnerProfiles(path string) ([]*PartnerProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadFile")
+	}
+	return ParsePartnerProfiles(data)
+}
+
+// matchPartner returns the first profile whose prefix matches content, or nil.
+func matchPartner(profiles []*PartnerProfile, content string) *PartnerProfile {
+	for _, profile := range profiles {
+		if strings.HasPrefix(content, profile.ContentPrefix) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// allowsReferer returns true when referer is a page of one of the allowed
+// origins.
+func (p *PartnerProfile) allowsReferer(referer string) bool {
+	for _, origin := range p.AllowedReferers {
+		if strings.HasPrefix(referer, origin+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package attributioncode
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePartnerProfiles(t *testing.T) {
+	for _, in := range []string{
+		`not json`,
+		`[{"content_prefix": "a:"}]`,
+		`[{"name": "a"}]`,
+		`[{"name": "a", "content_prefix": "a:"}, {"name": "a", "content_prefix": "b:"}]`,
+	} {
+		if _, err := ParsePartnerProfiles([]byte(in)); err == nil {
+			t.Errorf("expected an error parsing: %s", in)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "partners.json")
+	if err := os.WriteFile(path, []byte(`[{"name": "a", "content_prefix": "a:", "product": "p"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := LoadPartnerProfiles(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(profiles) != 1 || profiles[0].Name != "a" || profiles[0].Product != "p" {
+		t.Errorf("unexpected profiles: %+v", profiles)
+	}
+}
+
+func TestValidatePartner(t *testing.T) {
+	partner := &PartnerProfile{
+		Name:            "partner",
+		ContentPrefix:   "ptr:",
+		AllowedReferers: []string{"https://partner.example"},
+	}
+	custom := &Validator{PartnerProfiles: append([]*PartnerProfile{partner}, DefaultPartnerProfiles()...)}
+
+	for _, c := range []struct {
+		Validator *Validator
+		Content   string
+		Referer   string
+		Partner   string
+		Err       bool
+	}{
+		{&Validator{}, "rta:abc", "https://www.mozilla.org/", "RTAMO", false},
+		{&Validator{}, "rta:abc", "https://www.firefox.com/en-US/", "RTAMO", false},
+		{&Validator{}, "rta:abc", "https://www.mozilla.org", "", true},
+		{&Validator{}, "ptr:abc", "", "", false},
+		{custom, "ptr:abc", "https://partner.example/page", "partner", false},
+		{custom, "ptr:abc", "https://partner.example.com/", "", true},
+		{custom, "ptr:abc", "https://www.mozilla.org/", "", true},
+		{custom, "rta:abc", "https://www.mozilla.org/", "RTAMO", false},
+		{custom, "other", "", "", false},
+	} {
+		code, err := c.Validator.Validate(base64Decoder.EncodeToString([]byte("source=a&content="+c.Content)), "", "", c.Referer)
+		if c.Err {
+			if err == nil {
+				t.Errorf("content: %s, referer: %s, expected an error", c.Content, c.Referer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("content: %s, referer: %s, unexpected error: %v", c.Content, c.Referer, err)
+			continue
+		}
+
+		name := ""
+		if code.Partner() != nil {
+			name = code.Partner().Name
+		}
+		if name != c.Partner {
+			t.Errorf("content: %s, referer: %s, expected partner: %q, got: %q", c.Content, c.Referer, c.Partner, name)
+		}
+	}
+}
+
+func TestMatchPartner(t *testing.T) {
+	for _, content := range []string{" rta:123", "wrongcode", "rta"} {
+		if partner := matchPartner(DefaultPartnerProfiles(), content); partner != nil {
+			t.Errorf("content: %s, unexpected partner: %s", content, partner.Name)
+		}
+	}
+
+	for _, content := range []string{"rta:123", "rta:abc"} {
+		if partner := matchPartner(DefaultPartnerProfiles(), content); partner == nil || partner.Name != "RTAMO" {
+			t.Errorf("content: %s, expected partner RTAMO, got: %+v", content, partner)
+		}
+	}
+}
+
+func TestDecodePartner(t *testing.T) {
+	renamed := &PartnerProfile{Name: "renamed", ContentPrefix: "rta:"}
+	for _, c := range []struct {
+		Validator *Validator
+		Partner   string
+	}{
+		{&Validator{}, "RTAMO"},
+		{&Validator{PartnerProfiles: []*PartnerProfile{renamed}}, "renamed"},
+		{&Validator{PartnerProfiles: []*PartnerProfile{}}, ""},
+	} {
+		code, err := c.Validator.Decode("content%3Drta%3Aabc%26source%3Da")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		name := ""
+		if code.Partner() != nil {
+			name = code.Partner().Name
+		}
+		if name != c.Partner {
+			t.Errorf("expected partner: %q, got: %q", c.Partner, name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package attributioncode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	cache "github.com/mozilla-services/sizedlrucache"
+)
+
+// ReplayStore counts how many times signed attribution codes have been used.
+// Implementations backed by a shared store allow several instances of the
+// service to enforce a single limit.
+type ReplayStore interface {
+	// Increment increments the use count of key and returns the new count.
+	// The count is forgotten ttl after key was first seen.
+	Increment(key string, ttl time.Duration) (int, error)
+}
+
+type replayEntry struct {
+	count   int
+	expires time.Time
+}
+
+// MemoryReplayStore is a ReplayStore local to this process. It remembers at
+// most MaxKeys keys, evicting the least recently used ones first.
+type MemoryReplayStore struct {
+	lru *cache.SizedLRU
+	lck sync.Mutex
+}
+
+// NewMemoryReplayStore returns a MemoryReplayStore remembering at most
+// maxKeys keys.
+func NewMemoryReplayStore(maxKeys int) *MemoryReplayStore {
+	return &MemoryReplayStore{
+		lru: cache.NewSizedLRU(int64(maxKeys)),
+	}
+}
+
+// Increment implements ReplayStore.
+func (s *MemoryReplayStore) Increment(key string, ttl time.Duration) (int, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	ent := &replayEntry{expires: time.Now().Add(ttl)}
+	if val, ok := s.lru.Get(key); ok {
+		ent = val.(*replayEntry)
+	}
+	ent.count++
+	s.lru.Add(key, ent, 1, ent.expires)
+	return ent.count, nil
+}
+
+// ReplayAction is what happens when a signed code is used more often than
+// allowed.
+type ReplayAction string
+
+const (
+	// ReplayReject rejects the attribution code, like an invalid one.
+	ReplayReject ReplayAction = "reject"
+	// ReplayUnattributed serves the download without attribution.
+	ReplayUnattributed ReplayAction = "unattributed"
+)
+
+// ReplayGuard limits how many times a signed attribution code can be used.
+type ReplayGuard struct {
+	Store ReplayStore
+
+	// TTL is how long uses of a code are remembered. It should be at least
+	// Validator.Timeout, after which the code expires anyway.
+	TTL time.Duration
+
+	// MaxUses is how many times a code can be used. SourceMaxUses overrides
+	// it for codes with a given source.
+	MaxUses       int
+	SourceMaxUses map[string]int
+
+	Action ReplayAction
+}
+
+func (g *ReplayGuard) maxUses(source string) int {
+	if n, ok := g.SourceMaxUses[source]; ok {
+		return n
+	}
+	return g.MaxUses
+}
+
+// check records a use of code, signed by the key keyID, and returns an error
+// when it has been used too many times. Uses are not keyed on the signature,
+// so that different encodings of the same signature count as the same code.
+func (g *ReplayGuard) check(code, keyID, source string) error {
+	sum := sha256.Sum256([]byte(code + "|" + keyID))
+	uses, err := g.Store.Increment(hex.EncodeToString(sum[:]), g.TTL)
+	if err != nil {
+		return err
+	}
+
+	if maxUses := g.maxUses(source); uses > maxUses {
+		return &ReplayError{
+			Source:  source,
+			Uses:    uses,
+			MaxUses: maxUses,
+			Action:  g.Action,
+		}
+	}
+	return nil
+}
+
+// ReplayError is returned when a signed attribution code has been used more
+// times than allowed by the ReplayGuard.
+type ReplayError struct {
+	Source  string
+	Uses    int
+	MaxUses int
+	Action  ReplayAction
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("code has been used %d times, expected at most %d", e.Uses, e.MaxUses)
+}
@@ -0,0 +1,136 @@
+package attributioncode
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryReplayStore(t *testing.T) {
+	s := NewMemoryReplayStore(2)
+
+	for i, c := range []struct {
+		Key   string
+		Count int
+	}{
+		{"a", 1},
+		{"a", 2},
+		{"b", 1},
+		{"a", 3},
+		// c evicts b, the least recently used key.
+		{"c", 1},
+		{"b", 1},
+	} {
+		count, err := s.Increment(c.Key, time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if count != c.Count {
+			t.Errorf("step %d, key: %s, expected count: %d, got: %d", i, c.Key, c.Count, count)
+		}
+	}
+
+	t.Run("expiry", func(t *testing.T) {
+		s := NewMemoryReplayStore(10)
+		s.Increment("a", 10*time.Millisecond)
+		s.Increment("a", 10*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		if count, _ := s.Increment("a", 10*time.Millisecond); count != 1 {
+			t.Errorf("expected count to be reset after the ttl, got: %d", count)
+		}
+	})
+}
+
+type failingReplayStore struct{}
+
+func (failingReplayStore) Increment(string, time.Duration) (int, error) {
+	return 0, errors.New("store is down")
+}
+
+func TestValidateReplay(t *testing.T) {
+	v := NewValidator("testkey", 0)
+	v.ReplayGuard = &ReplayGuard{
+		Store:         NewMemoryReplayStore(100),
+		TTL:           time.Minute,
+		MaxUses:       2,
+		SourceMaxUses: map[string]int{"partner": 1},
+		Action:        ReplayReject,
+	}
+
+	signed := func(source string) *SignedCode {
+		vals := url.Values{}
+		vals.Set("source", source)
+		return Sign(vals, &HMACSigner{ID: DefaultKeyID, Secret: "testkey"}, time.Now())
+	}
+
+	for _, c := range []struct {
+		Source  string
+		MaxUses int
+	}{
+		{"mozilla.com", 2},
+		{"partner", 1},
+	} {
+		code := signed(c.Source)
+		for i := 1; i <= c.MaxUses+1; i++ {
+			_, err := v.Validate(code.Code, code.Sig, "", "")
+			if i <= c.MaxUses {
+				if err != nil {
+					t.Errorf("source: %s, use %d, unexpected error: %v", c.Source, i, err)
+				}
+				continue
+			}
+
+			var replayErr *ReplayError
+			if !errors.As(err, &replayErr) {
+				t.Errorf("source: %s, use %d, expected a ReplayError, got: %v", c.Source, i, err)
+				continue
+			}
+			expected := ReplayError{Source: c.Source, Uses: i, MaxUses: c.MaxUses, Action: ReplayReject}
+			if *replayErr != expected {
+				t.Errorf("source: %s, expected: %+v, got: %+v", c.Source, expected, *replayErr)
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || validationErr.Reason != ReasonReplay {
+				t.Errorf("source: %s, expected reason %s, got: %v", c.Source, ReasonReplay, err)
+			}
+		}
+	}
+
+	t.Run("signature case", func(t *testing.T) {
+		code := signed("case")
+		if _, err := v.Validate(code.Code, strings.ToLower(code.Sig), "", ""); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := v.Validate(code.Code, strings.ToUpper(code.Sig), "", ""); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err := v.Validate(code.Code, strings.ToUpper(code.Sig[:1])+code.Sig[1:], "", "")
+		var replayErr *ReplayError
+		if !errors.As(err, &replayErr) {
+			t.Errorf("expected a ReplayError when changing the case of the signature, got: %v", err)
+		}
+	})
+
+	t.Run("unsigned codes are not checked", func(t *testing.T) {
+		v := &Validator{ReplayGuard: &ReplayGuard{Store: NewMemoryReplayStore(100), TTL: time.Minute}}
+		b64Code := base64Decoder.EncodeToString([]byte("source=a"))
+		for i := 0; i < 3; i++ {
+			if _, err := v.Validate(b64Code, "", "", ""); err != nil {
+				t.Errorf("use %d, unexpected error: %v", i, err)
+			}
+		}
+	})
+
+	t.Run("store errors", func(t *testing.T) {
+		v := NewValidator("testkey", 0)
+		v.ReplayGuard = &ReplayGuard{Store: failingReplayStore{}, TTL: time.Minute, MaxUses: 1}
+		code := signed("a")
+		_, err := v.Validate(code.Code, code.Sig, "", "")
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) || validationErr.Reason != ReasonReplayStore {
+			t.Errorf("expected reason %s, got: %v", ReasonReplayStore, err)
+		}
+	})
+}
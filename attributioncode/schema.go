@@ -0,0 +1,302 @@
+package attributioncode
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed default_schema.json
+var defaultSchemaJSON []byte
+
+// defaultSchema matches the fields Bedrock sends today.
+var defaultSchema = mustParseSchema(defaultSchemaJSON)
+
+// notSetValue replaces invalid values when a field uses ActionReplace.
+const notSetValue = "(not set)"
+
+// Action is what happens when a value breaks one of the rules of its field.
+type Action string
+
+const (
+	// ActionReject rejects the whole attribution code.
+	ActionReject Action = "reject"
+	// ActionTruncate truncates values longer than MaxLength. Values which
+	// still break a rule after being truncated are replaced.
+	ActionTruncate Action = "truncate"
+	// ActionReplace replaces the value with "(not set)".
+	ActionReplace Action = "replace"
+)
+
+// Violation records a value which broke one of the rules of its field.
+type Violation struct {
+	Field  string
+	Rule   string
+	Action Action
+}
+
+// InvalidValueError is returned when a value breaks one of the rules of a
+// field using ActionReject.
+type InvalidValueError struct {
+	Field string
+	Rule  string
+}
+
+func (e *InvalidValueError) Error() string {
+	return fmt.Sprintf("%s does not match %s", e.Field, e.Rule)
+}
+
+// Field describes a key which may appear in an attribution code.
+type Field struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Allowed fields are accepted in attribution codes. Codes containing a
+	// field which is not allowed are rejected.
+	Allowed bool `json:"allowed"`
+
+	// Required fields are set to Default when they are missing or empty.
+	Required bool   `json:"required"`
+	Default  string `json:"default"`
+
+	// Stripped fields are accepted but are not written to the installer.
+	Stripped bool `json:"stripped"`
+
+	// Aliases are accepted in place of Name. When several of them are set,
+	// the first non-empty value of Name then Aliases is used.
+	Aliases []string `json:"aliases"`
+
+	// MaxLength is the maximum length of the value in bytes. Zero means there
+	// is no limit.
+	MaxLength int `json:"max_length"`
+
+	// Pattern is a regular expression, such as a character class, which the
+	// whole value must match.
+	Pattern string `json:"pattern"`
+
+	// Enum lists the accepted values. Any value is accepted when it is empty.
+	Enum []string `json:"enum"`
+
+	// OnInvalid is what happens when a value breaks one of the rules above.
+	// It defaults to ActionReject.
+	OnInvalid Action `json:"on_invalid"`
+
+	pattern *regexp.Regexp
+}
+
+// Schema describes the fields accepted in attribution codes.
+type Schema struct {
+	Fields []*Field `json:"fields"`
+
+	// DropOrder lists the optional fields which are dropped, in order, when
+	// an encoded code does not fit in the installer.
+	DropOrder []string `json:"drop_order"`
+
+	// fieldsByKey maps names and aliases to their field.
+	fieldsByKey map[string]*Field
+}
+
+// DefaultSchema returns the schema used when Validator.Schema is not set.
+func DefaultSchema() *Schema {
+	return defaultSchema
+}
+
+// ParseSchema parses a JSON schema. See default_schema.json for an example.
+func ParseSchema(data []byte) (*Schema, error) {
+	schema := new(Schema)
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+
+	schema.fieldsByKey = make(map[string]*Field)
+	for i, field := range schema.Fields {
+		if field.Name == "" {
+			return nil, errors.Errorf("field %d has no name", i)
+		}
+		switch field.OnInvalid {
+		case "":
+			field.OnInvalid = ActionReject
+		case ActionReject, ActionTruncate, ActionReplace:
+		default:
+			return nil, errors.Errorf("field %s has an unknown on_invalid action: %s", field.Name, field.OnInvalid)
+		}
+		if field.Pattern != "" {
+			pattern, err := regexp.Compile(`^(?:` + field.Pattern + `)$`)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s", field.Name)
+			}
+			field.pattern = pattern
+		}
+		for _, key := range append([]string{field.Name}, field.Aliases...) {
+			switch key {
+			case "", downloadTokenField, "timestamp":
+				return nil, errors.Errorf("field %s uses a reserved name: %q", field.Name, key)
+			}
+			if _, ok := schema.fieldsByKey[key]; ok {
+				return nil, errors.Errorf("%s is defined more than once", key)
+			}
+			schema.fieldsByKey[key] = field
+		}
+	}
+
+	for _, name := range schema.DropOrder {
+		field := schema.fieldsByKey[name]
+		switch {
+		case field == nil || field.Name != name:
+			return nil, errors.Errorf("drop_order contains unknown field: %s", name)
+		case field.Required:
+			return nil, errors.Errorf("drop_order contains required field: %s", name)
+		case field.Stripped:
+			return nil, errors.Errorf("drop_order contains stripped field: %s", name)
+		}
+	}
+
+	return schema, nil
+}
+
+// LoadSchema reads and parses a JSON schema file.
+func LoadSchema(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadFile")
+	}
+	return ParseSchema(data)
+}
+
+func mustParseSchema(data []byte) *Schema {
+	schema, err := ParseSchema(data)
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// fieldByKey returns the field for a name or alias, or nil when the key is
+// not in the schema.
+func (s *Schema) fieldByKey(key string) *Field {
+	return s.fieldsByKey[key]
+}
+
+// value returns the value of field in vals, taking aliases into account.
+func (f *Field) value(vals url.Values) string {
+	if v := vals.Get(f.Name); v != "" {
+		return v
+	}
+	for _, alias := range f.Aliases {
+		if v := vals.Get(alias); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// invalidKey returns the first key in vals which is not allowed by the
+// schema, or an empty string when all of them are allowed.
+func (s *Schema) invalidKey(vals url.Values) string {
+	for k := range vals {
+		if field := s.fieldByKey(k); field == nil || !field.Allowed {
+			return k
+		}
+	}
+	return ""
+}
+
+// brokenRule returns the first rule broken by value, or an empty string when
+// the value is valid.
+func (f *Field) brokenRule(value string) string {
+	switch {
+	case f.MaxLength > 0 && len(value) > f.MaxLength:
+		return "max_length"
+	case f.pattern != nil && !f.pattern.MatchString(value):
+		return "pattern"
+	case len(f.Enum) > 0 && !contains(f.Enum, value):
+		return "enum"
+	}
+	return ""
+}
+
+// check applies the rules of the field to value and returns the value to use
+// along with the violation, if any.
+func (f *Field) check(value string) (string, *Violation, error) {
+	rule := f.brokenRule(value)
+	if rule == "" {
+		return value, nil, nil
+	}
+
+	violation := &Violation{Field: f.Name, Rule: rule, Action: f.OnInvalid}
+	switch f.OnInvalid {
+	case ActionTruncate:
+		if rule == "max_length" {
+			value = truncate(value, f.MaxLength)
+			if f.brokenRule(value) == "" {
+				return value, violation, nil
+			}
+		}
+		violation.Action = ActionReplace
+		return notSetValue, violation, nil
+	case ActionReplace:
+		return notSetValue, violation, nil
+	default:
+		return "", violation, &InvalidValueError{Field: f.Name, Rule: rule}
+	}
+}
+
+// apply returns the resolved value of every field, keyed by field name, the
+// values which are written to the installer and the rules which were broken.
+func (s *Schema) apply(vals url.Values) (fields map[string]string, installerVals url.Values, violations []Violation, err error) {
+	fields = make(map[string]string)
+	installerVals = url.Values{}
+	for _, field := range s.Fields {
+		value := field.value(vals)
+		if value != "" {
+			var violation *Violation
+			value, violation, err = field.check(value)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if violation != nil {
+				violations = append(violations, *violation)
+			}
+		}
+		if value == "" && field.Required {
+			value = field.Default
+		}
+		if _, present := vals[field.Name]; value == "" && !present {
+			continue
+		}
+
+		fields[field.Name] = value
+		if !field.Stripped {
+			installerVals.Set(field.Name, value)
+		}
+	}
+
+	return fields, installerVals, violations, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate returns the longest prefix of s which is at most n bytes long and
+// does not split a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,217 @@
+package attributioncode
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSchema(t *testing.T) {
+	for _, in := range []string{
+		`not json`,
+		`{"fields": [{"allowed": true}]}`,
+		`{"fields": [{"name": "a"}, {"name": "a"}]}`,
+		`{"fields": [{"name": "a", "aliases": ["b"]}, {"name": "b"}]}`,
+		`{"fields": [{"name": "dltoken"}]}`,
+		`{"fields": [{"name": "a", "aliases": ["timestamp"]}]}`,
+		`{"fields": [{"name": "a", "on_invalid": "ignore"}]}`,
+		`{"fields": [{"name": "a", "pattern": "[a-z"}]}`,
+		`{"fields": [{"name": "a"}], "drop_order": ["b"]}`,
+		`{"fields": [{"name": "a", "aliases": ["b"]}], "drop_order": ["b"]}`,
+		`{"fields": [{"name": "a", "required": true}], "drop_order": ["a"]}`,
+		`{"fields": [{"name": "a", "stripped": true}], "drop_order": ["a"]}`,
+	} {
+		if _, err := ParseSchema([]byte(in)); err == nil {
+			t.Errorf("expected an error parsing: %s", in)
+		}
+	}
+}
+
+func TestLoadSchema(t *testing.T) {
+	if _, err := LoadSchema("/path/to/missing.json"); err == nil {
+		t.Error("expected an error loading a missing file")
+	}
+
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, defaultSchemaJSON, 0644); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := LoadSchema(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(schema.Fields) != len(DefaultSchema().Fields) {
+		t.Errorf("expected %d fields, got %d", len(DefaultSchema().Fields), len(schema.Fields))
+	}
+}
+
+func TestValidateWithSchema(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{
+		"fields": [
+			{"name": "source", "allowed": true, "required": true, "default": "unknown"},
+			{"name": "medium", "allowed": true},
+			{"name": "newfield", "allowed": true},
+			{"name": "client_id", "allowed": true, "stripped": true, "aliases": ["cid", "visit_id"]},
+			{"name": "ua", "allowed": false}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v := &Validator{Schema: schema}
+
+	for _, c := range []struct {
+		In               string
+		Out              string
+		ExpectedClientID string
+		Err              string
+	}{
+		{
+			In:  "medium=test&newfield=value",
+			Out: "dltoken%3D__DL_TOKEN__%26medium%3Dtest%26newfield%3Dvalue%26source%3Dunknown",
+		},
+		{
+			In:               "source=a&visit_id=vid",
+			Out:              "dltoken%3D__DL_TOKEN__%26source%3Da",
+			ExpectedClientID: "vid",
+		},
+		{
+			In:               "source=a&visit_id=vid&cid=cid",
+			Out:              "dltoken%3D__DL_TOKEN__%26source%3Da",
+			ExpectedClientID: "cid",
+		},
+		{
+			In:               "source=a&visit_id=vid&client_id=client",
+			Out:              "dltoken%3D__DL_TOKEN__%26source%3Da",
+			ExpectedClientID: "client",
+		},
+		{
+			In:  "source=a&ua=edge",
+			Err: "ua is not a valid attribution key",
+		},
+		{
+			In:  "source=a&campaign=test",
+			Err: "campaign is not a valid attribution key",
+		},
+	} {
+		code, err := v.Validate(base64Decoder.EncodeToString([]byte(c.In)), "", "", "")
+		if c.Err != "" {
+			if err == nil || err.Error() != c.Err {
+				t.Errorf("in: %s, expected error: %s, got: %v", c.In, c.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("in: %s, unexpected error: %v", c.In, err)
+			continue
+		}
+
+		expected := c.Out
+		if res := code.URLEncode(); res != strings.ReplaceAll(expected, "__DL_TOKEN__", code.DownloadToken()) {
+			t.Errorf("in: %s, res: %s != out: %s", c.In, res, expected)
+		}
+		if code.ClientID != c.ExpectedClientID {
+			t.Errorf("in: %s, expected client id: %s, got: %s", c.In, c.ExpectedClientID, code.ClientID)
+		}
+	}
+}
+
+func TestValidateFieldRules(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{
+		"fields": [
+			{"name": "source", "allowed": true, "required": true, "default": "(not set)", "pattern": "[a-z]*"},
+			{"name": "medium", "allowed": true, "pattern": "[a-z]*", "on_invalid": "replace"},
+			{"name": "ua", "allowed": true, "max_length": 6, "pattern": "[^\\x00-\\x1f]*", "on_invalid": "truncate"},
+			{"name": "dlsource", "allowed": true, "enum": ["mozorg", "fxdotcom"], "on_invalid": "replace"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v := &Validator{Schema: schema}
+
+	for _, c := range []struct {
+		In         string
+		Out        string
+		Violations []Violation
+		Err        *InvalidValueError
+	}{
+		{
+			In:  "source=abc&medium=def&ua=chrome&dlsource=mozorg",
+			Out: "dlsource%3Dmozorg%26dltoken%3D__DL_TOKEN__%26medium%3Ddef%26source%3Dabc%26ua%3Dchrome",
+		},
+		{
+			In:  "source=ABC",
+			Err: &InvalidValueError{Field: "source", Rule: "pattern"},
+		},
+		{
+			In:         "medium=a%0Ab",
+			Out:        "dltoken%3D__DL_TOKEN__%26medium%3D%2528not%2Bset%2529%26source%3D%2528not%2Bset%2529",
+			Violations: []Violation{{Field: "medium", Rule: "pattern", Action: ActionReplace}},
+		},
+		{
+			In:         "ua=firefox",
+			Out:        "dltoken%3D__DL_TOKEN__%26source%3D%2528not%2Bset%2529%26ua%3Dfirefo",
+			Violations: []Violation{{Field: "ua", Rule: "max_length", Action: ActionTruncate}},
+		},
+		{
+			In:         "ua=%E2%82%AC%E2%82%AC%E2%82%AC",
+			Out:        "dltoken%3D__DL_TOKEN__%26source%3D%2528not%2Bset%2529%26ua%3D%25E2%2582%25AC%25E2%2582%25AC",
+			Violations: []Violation{{Field: "ua", Rule: "max_length", Action: ActionTruncate}},
+		},
+		{
+			In:         "ua=ab%0Acdefgh",
+			Out:        "dltoken%3D__DL_TOKEN__%26source%3D%2528not%2Bset%2529%26ua%3D%2528not%2Bset%2529",
+			Violations: []Violation{{Field: "ua", Rule: "max_length", Action: ActionReplace}},
+		},
+		{
+			In:         "dlsource=other",
+			Out:        "dlsource%3D%2528not%2Bset%2529%26dltoken%3D__DL_TOKEN__%26source%3D%2528not%2Bset%2529",
+			Violations: []Violation{{Field: "dlsource", Rule: "enum", Action: ActionReplace}},
+		},
+	} {
+		code, err := v.Validate(base64Decoder.EncodeToString([]byte(c.In)), "", "", "")
+		if c.Err != nil {
+			var invalidErr *InvalidValueError
+			if !errors.As(err, &invalidErr) || !reflect.DeepEqual(invalidErr, c.Err) {
+				t.Errorf("in: %s, expected error: %v, got: %v", c.In, c.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("in: %s, unexpected error: %v", c.In, err)
+			continue
+		}
+
+		expected := strings.ReplaceAll(c.Out, "__DL_TOKEN__", code.DownloadToken())
+		if res := code.URLEncode(); res != expected {
+			t.Errorf("in: %s, res: %s != out: %s", c.In, res, expected)
+		}
+		if !reflect.DeepEqual(code.Violations(), c.Violations) {
+			t.Errorf("in: %s, expected violations: %v, got: %v", c.In, c.Violations, code.Violations())
+		}
+	}
+}
+
+func TestDefaultSchemaRules(t *testing.T) {
+	// The default schema has no value constraints, so values are passed
+	// through unchanged as they were before schemas existed.
+	v := &Validator{}
+	ua := strings.Repeat("a", 100)
+	code, err := v.Validate(base64Decoder.EncodeToString([]byte("source=a%00b&ua="+ua)), "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code.Source != "a\x00b" {
+		t.Errorf("expected source to be unchanged, got: %q", code.Source)
+	}
+	if code.UA != ua {
+		t.Errorf("expected ua to be unchanged, got: %d bytes", len(code.UA))
+	}
+	if len(code.Violations()) != 0 {
+		t.Errorf("unexpected violations: %+v", code.Violations())
+	}
+}
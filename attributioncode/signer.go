@@ -0,0 +1,94 @@
+package attributioncode
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Signer signs attribution codes.
+type Signer interface {
+	// KeyID returns the ID sent as attribution_kid, or an empty string to
+	// let the validator try each of its keys.
+	KeyID() string
+	Sign(msg []byte) []byte
+}
+
+// HMACSigner signs attribution codes with a shared secret.
+type HMACSigner struct {
+	ID     string
+	Secret string
+}
+
+// KeyID implements Signer.
+func (s *HMACSigner) KeyID() string {
+	return s.ID
+}
+
+// Sign implements Signer.
+func (s *HMACSigner) Sign(msg []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// Ed25519Signer signs attribution codes with an Ed25519 private key. The
+// matching public key must be configured in Validator.Ed25519Keys.
+type Ed25519Signer struct {
+	ID         string
+	PrivateKey ed25519.PrivateKey
+}
+
+// KeyID implements Signer.
+func (s *Ed25519Signer) KeyID() string {
+	return s.ID
+}
+
+// Sign implements Signer.
+func (s *Ed25519Signer) Sign(msg []byte) []byte {
+	return ed25519.Sign(s.PrivateKey, msg)
+}
+
+// SignedCode is an attribution code in the format expected by the stub
+// attribution service.
+type SignedCode struct {
+	Code  string
+	Sig   string
+	KeyID string
+}
+
+// Query returns the attribution_* query parameters for this code.
+func (s *SignedCode) Query() url.Values {
+	query := url.Values{}
+	query.Set("attribution_code", s.Code)
+	if s.Sig != "" {
+		query.Set("attribution_sig", s.Sig)
+	}
+	if s.KeyID != "" {
+		query.Set("attribution_kid", s.KeyID)
+	}
+	return query
+}
+
+// Sign encodes vals, along with a timestamp for now, and signs the result.
+// The code is left unsigned when signer is nil.
+func Sign(vals url.Values, signer Signer, now time.Time) *SignedCode {
+	query := url.Values{}
+	for k, v := range vals {
+		query[k] = v
+	}
+	query.Set("timestamp", strconv.FormatInt(now.Unix(), 10))
+
+	signed := &SignedCode{
+		Code: base64Decoder.EncodeToString([]byte(query.Encode())),
+	}
+	if signer != nil {
+		signed.Sig = hex.EncodeToString(signer.Sign([]byte(signed.Code)))
+		signed.KeyID = signer.KeyID()
+	}
+	return signed
+}
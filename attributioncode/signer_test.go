@@ -0,0 +1,85 @@
+package attributioncode
+
+import (
+	"crypto/ed25519"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	partnerPub, partnerPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Validator{
+		HMACKeys: []*HMACKey{{ID: "hmac", Secret: "testkey"}},
+		Ed25519Keys: []*Ed25519Key{
+			{ID: "partner", PublicKey: partnerPub},
+			{ID: "other", PublicKey: otherPub, NotAfter: now.Add(-time.Hour)},
+		},
+		Timeout: 10 * time.Minute,
+		Now:     func() time.Time { return now },
+	}
+
+	vals := url.Values{}
+	vals.Set("source", "partner.example.com")
+	vals.Set("medium", "referral")
+	vals.Set("campaign", "test")
+	vals.Set("content", "test")
+
+	for _, c := range []struct {
+		Name          string
+		Signer        Signer
+		ExpectedKeyID string
+		Valid         bool
+	}{
+		{"hmac with kid", &HMACSigner{ID: "hmac", Secret: "testkey"}, "hmac", true},
+		{"hmac without kid", &HMACSigner{Secret: "testkey"}, "hmac", true},
+		{"hmac with wrong secret", &HMACSigner{ID: "hmac", Secret: "wrong"}, "", false},
+		{"ed25519 with kid", &Ed25519Signer{ID: "partner", PrivateKey: partnerPriv}, "partner", true},
+		{"ed25519 without kid", &Ed25519Signer{PrivateKey: partnerPriv}, "partner", true},
+		{"ed25519 with another signer's kid", &Ed25519Signer{ID: "partner", PrivateKey: otherPriv}, "", false},
+		{"ed25519 with an expired key", &Ed25519Signer{ID: "other", PrivateKey: otherPriv}, "", false},
+		{"ed25519 signature as hmac", &Ed25519Signer{ID: "hmac", PrivateKey: partnerPriv}, "", false},
+		{"unsigned", nil, "", false},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			signed := Sign(vals, c.Signer, now)
+			query := signed.Query()
+
+			code, err := v.Validate(
+				query.Get("attribution_code"),
+				query.Get("attribution_sig"),
+				query.Get("attribution_kid"),
+				"",
+			)
+			if (err == nil) != c.Valid {
+				t.Fatalf("expected valid: %v, got err: %v", c.Valid, err)
+			}
+			if err != nil {
+				return
+			}
+			if code.KeyID() != c.ExpectedKeyID {
+				t.Errorf("expected key id: %s, got: %s", c.ExpectedKeyID, code.KeyID())
+			}
+			if code.Source != "partner.example.com" {
+				t.Errorf("unexpected source: %s", code.Source)
+			}
+		})
+	}
+
+	t.Run("does not modify vals", func(t *testing.T) {
+		Sign(vals, nil, now)
+		if vals.Get("timestamp") != "" {
+			t.Error("vals was modified by Sign")
+		}
+	})
+}
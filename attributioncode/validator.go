@@ -1,24 +1,15 @@
 package attributioncode
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"net/url"
-	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
-)
-
-// pre-compile regex
-var (
-	referrerAllowedforRTAMO = regexp.MustCompile(`^https://www\.(mozilla\.org|firefox\.com)/`)
-	rtamo                   = regexp.MustCompile(`^rta:`)
 )
 
 // Set to match https://searchfox.org/mozilla-central/rev/a92ed79b0bc746159fc31af1586adbfa9e45e264/browser/components/attribution/AttributionCode.jsm#24
@@ -26,36 +17,7 @@ const maxUnescapedCodeLen = 1010
 
 const downloadTokenField = "dltoken"
 
-var validAttributionKeys = map[string]bool{
-	"source":        true,
-	"medium":        true,
-	"campaign":      true,
-	"content":       true,
-	"experiment":    true,
-	"variation":     true,
-	"ua":            true,
-	"visit_id":      true, // https://bugzilla.mozilla.org/show_bug.cgi?id=1677497
-	"session_id":    true, // https://bugzilla.mozilla.org/show_bug.cgi?id=1809120
-	"client_id":     true, // Alias of `visit_id`.
-	"client_id_ga4": true, // https://github.com/mozilla-services/stubattribution/issues/209
-	"dlsource":      true,
-}
-
-// If any of these are not set in the incoming payload, they will be set to '(not set)'
-var requiredAttributionKeys = []string{
-	"source",
-	"medium",
-	"campaign",
-	"content",
-}
-
-// These are not written to the installer.
-var excludedAttributionKeys = []string{
-	"visit_id",
-	"session_id",
-	"client_id",
-	"client_id_ga4",
-}
+const defaultClockSkew = time.Minute
 
 var base64Decoder = base64.URLEncoding.WithPadding('.')
 
@@ -63,7 +25,9 @@ func generateDownloadToken() string {
 	return uuid.NewString()
 }
 
-// Code represents a valid attribution code
+// Code represents a valid attribution code. A Code is not modified once it
+// has been returned by Validate or Decode, so it can be shared between
+// goroutines.
 type Code struct {
 	Source         string
 	Medium         string
@@ -79,161 +43,369 @@ type Code struct {
 
 	downloadToken string
 
+	keyID string
+
+	violations []Violation
+
+	partner *PartnerProfile
+
+	// dropOrder is the default EncodeOptions.DropOrder.
+	dropOrder []string
+
+	// rawURLVals are the values written to the installer, without dltoken.
 	rawURLVals url.Values
 }
 
-// DownloadToken returns unique token for this download.
-func (c *Code) DownloadToken() string {
-	if c.downloadToken == "" {
-		c.downloadToken = generateDownloadToken()
+// newCode returns a Code. fields are keyed by field name and installerVals are
+// the values written to the installer.
+func newCode(fields map[string]string, installerVals url.Values, downloadToken string) *Code {
+	return &Code{
+		Source:         fields["source"],
+		Medium:         fields["medium"],
+		Campaign:       fields["campaign"],
+		Content:        fields["content"],
+		Experiment:     fields["experiment"],
+		Variation:      fields["variation"],
+		UA:             fields["ua"],
+		ClientID:       fields["client_id"],
+		ClientIDGA4:    fields["client_id_ga4"],
+		SessionID:      fields["session_id"],
+		DownloadSource: fields["dlsource"],
+
+		downloadToken: downloadToken,
+
+		rawURLVals: installerVals,
 	}
+}
 
+// Violations returns the values which were truncated or replaced because
+// they broke a rule of the schema.
+func (c *Code) Violations() []Violation {
+	return c.violations
+}
+
+// KeyID returns the ID of the key which validated the signature of this code,
+// or an empty string when the code was not signed.
+func (c *Code) KeyID() string {
+	return c.keyID
+}
+
+// DownloadToken returns unique token for this download.
+func (c *Code) DownloadToken() string {
 	return c.downloadToken
 }
 
-// URLEncode returns a query escaped stub attribution code
+// URLEncode returns a query escaped stub attribution code. It is equivalent to
+// Encode without a budget.
 func (c *Code) URLEncode() string {
-	for _, val := range excludedAttributionKeys {
-		c.rawURLVals.Del(val)
-	}
-	c.rawURLVals.Set(downloadTokenField, c.DownloadToken())
-	return url.QueryEscape(c.rawURLVals.Encode())
+	payload, _ := c.Encode(EncodeOptions{})
+	return payload.Code
+}
+
+// Partner returns the partner profile matching the content of this code, or
+// nil when the code is not for a partner.
+func (c *Code) Partner() *PartnerProfile {
+	return c.partner
 }
 
-// FromRTAMO returns true when the content parameter contains a prefix for
-// RTAMO, and false otherwise.
+// FromRTAMO returns true when the code matched the RTAMO partner profile, and
+// false otherwise.
 func (c *Code) FromRTAMO() bool {
-	return rtamo.MatchString(c.Content)
+	return c.partner != nil && c.partner.Name == rtamoProfileName
+}
+
+// ExpiredError is returned when the signed timestamp of an attribution code
+// is outside of the window accepted by the validator.
+type ExpiredError struct {
+	Timestamp time.Time
+	Now       time.Time
+}
+
+func (e *ExpiredError) Error() string {
+	if e.Timestamp.After(e.Now) {
+		return fmt.Sprintf("timestamp %d is in the future", e.Timestamp.Unix())
+	}
+	return fmt.Sprintf("timestamp %d has expired", e.Timestamp.Unix())
+}
+
+// Reason is a stable, machine-readable code describing why an attribution code
+// was rejected. It is safe to use in metric tags.
+type Reason string
+
+const (
+	ReasonEmpty          Reason = "empty"
+	ReasonTooLong        Reason = "too_long"
+	ReasonBadBase64      Reason = "bad_base64"
+	ReasonBadQuery       Reason = "bad_query"
+	ReasonBadSignature   Reason = "bad_signature"
+	ReasonBadTimestamp   Reason = "bad_timestamp"
+	ReasonExpired        Reason = "expired"
+	ReasonInvalidKey     Reason = "invalid_key"
+	ReasonInvalidValue   Reason = "invalid_value"
+	ReasonPartnerReferer Reason = "partner_referer"
+	ReasonReplay         Reason = "replay"
+	ReasonReplayStore    Reason = "replay_store"
+)
+
+// ValidationError is returned by Validate when an attribution code is
+// rejected.
+type ValidationError struct {
+	Reason Reason
+
+	// Field is the query parameter, attribution key or header which caused
+	// the error, e.g. "attribution_sig", "campaign" or "referer".
+	Field string
+
+	Err error
+}
+
+func validationError(reason Reason, field string, err error) *ValidationError {
+	return &ValidationError{Reason: reason, Field: field, Err: err}
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
 }
 
 // Validator validates and returns santized attribution codes
 type Validator struct {
-	HMACKey string
+	// HMACKeys and Ed25519Keys are the keys accepted for attribution_sig.
+	// Signatures are not checked when both are empty.
+	HMACKeys    []*HMACKey
+	Ed25519Keys []*Ed25519Key
+
+	// Timeout is the maximum age of the signed timestamp. The timestamp is
+	// not checked when Timeout is zero or when the code is not signed.
 	Timeout time.Duration
+
+	// ClockSkew is how far in the future a timestamp is allowed to be.
+	ClockSkew time.Duration
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	// Schema describes the fields accepted in attribution codes. It defaults
+	// to DefaultSchema().
+	Schema *Schema
+
+	// PartnerProfiles are matched against the content of codes. They
+	// default to DefaultPartnerProfiles().
+	PartnerProfiles []*PartnerProfile
+
+	// ReplayGuard limits how many times a signed code can be used. Replays
+	// are not checked when it is nil or when the code is not signed.
+	ReplayGuard *ReplayGuard
 }
 
 // NewValidator returns a new attribution code validator
 func NewValidator(hmacKey string, timeout time.Duration) *Validator {
-	return &Validator{
-		HMACKey: hmacKey,
-		Timeout: timeout,
+	v := &Validator{
+		Timeout:   timeout,
+		ClockSkew: defaultClockSkew,
 	}
+	if hmacKey != "" {
+		v.HMACKeys = []*HMACKey{{ID: DefaultKeyID, Secret: hmacKey}}
+	}
+	return v
+}
+
+func (v *Validator) schema() *Schema {
+	if v.Schema != nil {
+		return v.Schema
+	}
+	return defaultSchema
 }
 
-// Validate validates and sanitizes attribution code and signature
-func (v *Validator) Validate(code, sig, refererHeader string) (*Code, error) {
-	logEntry := logrus.WithField("b64code", code)
+func (v *Validator) partnerProfiles() []*PartnerProfile {
+	if v.PartnerProfiles != nil {
+		return v.PartnerProfiles
+	}
+	return defaultPartnerProfiles
+}
 
+func (v *Validator) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// Validate validates and sanitizes attribution code and signature. When keyID
+// is empty, the signature is checked against every active key.
+func (v *Validator) Validate(code, sig, keyID, refererHeader string) (*Code, error) {
 	if code == "" {
-		logEntry.Error("code is empty")
-		return nil, errors.New("code is empty")
+		return nil, validationError(ReasonEmpty, "attribution_code", errors.New("code is empty"))
 	}
 
 	if len(code) > 5000 {
-		logEntry.WithField("code_len", len(code)).Error("code longer than 5000 characters")
-		return nil, errors.New("base64 code longer than 5000 characters")
+		return nil, validationError(ReasonTooLong, "attribution_code", errors.New("base64 code longer than 5000 characters"))
 	}
 
 	if len(sig) > 5000 {
-		logEntry.WithField("sig_len", len(sig)).Error("sig longer than 5000 characters")
-		return nil, errors.New("sig longer than 5000 characters")
+		return nil, validationError(ReasonTooLong, "attribution_sig", errors.New("sig longer than 5000 characters"))
 	}
 
 	unEscapedCode, err := base64Decoder.DecodeString(code)
 	if err != nil {
-		logEntry.WithError(err).Error("could not base64 decode code")
-		return nil, errors.Wrap(err, "DecodeString")
+		return nil, validationError(ReasonBadBase64, "attribution_code", errors.Wrap(err, "DecodeString"))
 	}
 
-	logEntry = logrus.WithField("code", unEscapedCode)
 	if len(unEscapedCode) > maxUnescapedCodeLen {
-		errMsg := fmt.Sprintf("code longer than %d characters", maxUnescapedCodeLen)
-		logEntry.WithField("code_len", len(code)).Error(errMsg)
-		return nil, errors.New(errMsg)
+		return nil, validationError(ReasonTooLong, "attribution_code", errors.Errorf("code longer than %d characters", maxUnescapedCodeLen))
 	}
 
 	vals, err := url.ParseQuery(string(unEscapedCode))
 	if err != nil {
-		logEntry.WithError(err).Error("could not parse code")
-		return nil, errors.Wrap(err, "ParseQuery")
+		return nil, validationError(ReasonBadQuery, "attribution_code", errors.Wrap(err, "ParseQuery"))
 	}
 
-	if v.HMACKey != "" {
-		if err := v.validateSignature(code, sig); err != nil {
-			logEntry.WithError(err).Error("could not validate signature")
-			return nil, err
+	var signingKeyID string
+	if len(v.HMACKeys) > 0 || len(v.Ed25519Keys) > 0 {
+		signingKeyID, err = v.validateSignature(code, sig, keyID)
+		if err != nil {
+			return nil, validationError(ReasonBadSignature, "attribution_sig", err)
+		}
+	}
+
+	if v.Timeout > 0 && signingKeyID != "" {
+		if err := v.validateTimestamp(vals.Get("timestamp")); err != nil {
+			reason := ReasonBadTimestamp
+			if _, ok := err.(*ExpiredError); ok {
+				reason = ReasonExpired
+			}
+			return nil, validationError(reason, "timestamp", err)
 		}
 	}
 
 	vals.Del("timestamp")
 
-	// all keys are valid
-	for k := range vals {
-		if !validAttributionKeys[k] {
-			logEntry.WithField("invalid_key", k).Error("code contains invalid key")
-			return nil, errors.Errorf("%s is not a valid attribution key", k)
+	schema := v.schema()
+	if k := schema.invalidKey(vals); k != "" {
+		return nil, validationError(ReasonInvalidKey, k, errors.Errorf("%s is not a valid attribution key", k))
+	}
+
+	fields, installerVals, violations, err := schema.apply(vals)
+	if err != nil {
+		field := ""
+		if err, ok := err.(*InvalidValueError); ok {
+			field = err.Field
 		}
+		return nil, validationError(ReasonInvalidValue, field, err)
 	}
 
-	for _, val := range requiredAttributionKeys {
-		if vals.Get(val) == "" {
-			vals.Set(val, "(not set)")
+	attributionCode := newCode(fields, installerVals, generateDownloadToken())
+	attributionCode.keyID = signingKeyID
+	attributionCode.violations = violations
+	attributionCode.dropOrder = schema.DropOrder
+
+	if partner := matchPartner(v.partnerProfiles(), attributionCode.Content); partner != nil {
+		if !partner.allowsReferer(refererHeader) {
+			return nil, validationError(ReasonPartnerReferer, "referer", errors.Errorf("Invalid referer header for %s attribution", partner.Name))
 		}
+		attributionCode.partner = partner
 	}
 
-	// The `visit_id` field is in fact the Google Analytics (GA3) "client" ID and
-	// "visit" ID seems confusing. Let's accept `client_id` as an alias of
-	// `visit_id` so that Bedrock can start to send the value using the
-	// `client_id` key instead of `visit_id`. We still allow the latter for
-	// backward compatibility purposes.
-	clientID := vals.Get("client_id")
-	if clientID == "" {
-		clientID = vals.Get("visit_id")
+	if v.ReplayGuard != nil && signingKeyID != "" {
+		if err := v.ReplayGuard.check(code, signingKeyID, attributionCode.Source); err != nil {
+			reason := ReasonReplayStore
+			if _, ok := err.(*ReplayError); ok {
+				reason = ReasonReplay
+			}
+			return nil, validationError(reason, "attribution_code", err)
+		}
 	}
 
-	attributionCode := &Code{
-		Source:         vals.Get("source"),
-		Medium:         vals.Get("medium"),
-		Campaign:       vals.Get("campaign"),
-		Content:        vals.Get("content"),
-		Experiment:     vals.Get("experiment"),
-		Variation:      vals.Get("variation"),
-		UA:             vals.Get("ua"),
-		ClientID:       clientID,
-		ClientIDGA4:    vals.Get("client_id_ga4"),
-		SessionID:      vals.Get("session_id"),
-		DownloadSource: vals.Get("dlsource"),
+	return attributionCode, nil
+}
 
-		rawURLVals: vals,
+func (v *Validator) validateTimestamp(timestamp string) error {
+	if timestamp == "" {
+		return errors.New("code is missing timestamp")
 	}
 
-	if attributionCode.FromRTAMO() {
-		refererMatch := referrerAllowedforRTAMO.MatchString(refererHeader)
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "ParseInt: %s", timestamp)
+	}
 
-		if !refererMatch {
-			logEntry.WithField("referer", refererHeader).Error("Invalid referer header for RTAMO attribution")
-			return nil, errors.New("Invalid referer header for RTAMO attribution")
+	ts := time.Unix(secs, 0)
+	now := v.now()
+	if ts.Before(now.Add(-v.Timeout)) || ts.After(now.Add(v.ClockSkew)) {
+		return &ExpiredError{Timestamp: ts, Now: now}
+	}
+
+	return nil
+}
+
+// ActiveHMACKey returns the first HMAC key which is active at t, or nil when
+// there is none.
+func (v *Validator) ActiveHMACKey(t time.Time) *HMACKey {
+	for _, key := range v.HMACKeys {
+		if key.activeAt(t) {
+			return key
 		}
 	}
+	return nil
+}
 
-	return attributionCode, nil
+// CheckKeyIDs returns an error when several HMAC or Ed25519 keys share an ID,
+// in which case only the first of them could ever be selected by
+// attribution_kid.
+func (v *Validator) CheckKeyIDs() error {
+	seen := make(map[string]bool)
+	for _, key := range v.verificationKeys() {
+		if seen[key.keyID()] {
+			return errors.Errorf("key %s is defined more than once", key.keyID())
+		}
+		seen[key.keyID()] = true
+	}
+	return nil
+}
+
+func (v *Validator) verificationKeys() []verificationKey {
+	keys := make([]verificationKey, 0, len(v.HMACKeys)+len(v.Ed25519Keys))
+	for _, key := range v.HMACKeys {
+		keys = append(keys, key)
+	}
+	for _, key := range v.Ed25519Keys {
+		keys = append(keys, key)
+	}
+	return keys
 }
 
-func (v *Validator) validateSignature(code, sig string) error {
+// validateSignature returns the ID of the key which validated sig.
+func (v *Validator) validateSignature(code, sig, keyID string) (string, error) {
 	sigBytes, err := hex.DecodeString(sig)
 	if err != nil {
-		return errors.Wrapf(err, "hex.DecodeString: %s", sig)
+		return "", errors.Wrapf(err, "hex.DecodeString: %s", sig)
 	}
 
-	return checkMAC([]byte(v.HMACKey), []byte(code), sigBytes)
-}
+	now := v.now()
+
+	if keyID != "" {
+		for _, key := range v.verificationKeys() {
+			if key.keyID() != keyID {
+				continue
+			}
+			if !key.activeAt(now) {
+				return "", errors.Errorf("key %s is not active", keyID)
+			}
+			if !key.verify([]byte(code), sigBytes) {
+				return "", errors.Errorf("signature would not validate with key %s. given: %x", keyID, sigBytes)
+			}
+			return keyID, nil
+		}
+		return "", errors.Errorf("unknown key id: %s", keyID)
+	}
 
-func checkMAC(key, msg, msgMAC []byte) error {
-	mac := hmac.New(sha256.New, key)
-	mac.Write(msg)
-	expectedMac := mac.Sum(nil)
-	if !hmac.Equal(msgMAC, expectedMac) {
-		return errors.Errorf("HMAC would not validate. given: %x expected: %x", msgMAC, expectedMac)
+	for _, key := range v.verificationKeys() {
+		if key.activeAt(now) && key.verify([]byte(code), sigBytes) {
+			return key.keyID(), nil
+		}
 	}
-	return nil
+	return "", errors.Errorf("signature would not validate with any active key. given: %x", sigBytes)
 }
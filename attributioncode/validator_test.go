@@ -3,7 +3,10 @@ package attributioncode
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"testing"
 	"testing/quick"
@@ -23,7 +26,7 @@ func TestValidateSignature(t *testing.T) {
 			{"testcode", "2608633175f9db16832c08342231423c2f9963396ca66f08350516a781ae8052", false},
 		}
 		for _, testCase := range cases {
-			if err := v.validateSignature(testCase.Code, testCase.Sig); (err == nil) != testCase.Valid {
+			if _, err := v.validateSignature(testCase.Code, testCase.Sig, ""); (err == nil) != testCase.Valid {
 				t.Errorf("checking %s should equal: %v", testCase.Code, testCase.Valid)
 			}
 		}
@@ -31,11 +34,11 @@ func TestValidateSignature(t *testing.T) {
 
 	t.Run("quick tests", func(t *testing.T) {
 		f := func(code, key string) bool {
-			v := NewValidator(key, 10*time.Minute)
+			v := &Validator{HMACKeys: []*HMACKey{{ID: DefaultKeyID, Secret: key}}}
 
 			mac := hmac.New(sha256.New, []byte(key))
 			mac.Write([]byte(code))
-			if err := v.validateSignature(code, fmt.Sprintf("%x", mac.Sum(nil))); err != nil {
+			if _, err := v.validateSignature(code, fmt.Sprintf("%x", mac.Sum(nil)), ""); err != nil {
 				t.Errorf("invalid signature: %v", err)
 				return false
 			}
@@ -47,6 +50,68 @@ func TestValidateSignature(t *testing.T) {
 	})
 }
 
+func TestValidateSignatureKeyring(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	v := &Validator{
+		HMACKeys: []*HMACKey{
+			{ID: "old", Secret: "oldkey", NotAfter: now.Add(-time.Hour)},
+			{ID: "current", Secret: "currentkey"},
+			{ID: "next", Secret: "nextkey", NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)},
+			{ID: "future", Secret: "futurekey", NotBefore: now.Add(time.Hour)},
+		},
+		Now: func() time.Time { return now },
+	}
+
+	sign := func(key, code string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(code))
+		return fmt.Sprintf("%x", mac.Sum(nil))
+	}
+
+	for _, c := range []struct {
+		Secret        string
+		KeyID         string
+		ExpectedKeyID string
+	}{
+		{"currentkey", "", "current"},
+		{"currentkey", "current", "current"},
+		{"nextkey", "", "next"},
+		{"nextkey", "next", "next"},
+		{"nextkey", "current", ""},
+		{"oldkey", "", ""},
+		{"oldkey", "old", ""},
+		{"futurekey", "future", ""},
+		{"currentkey", "unknown", ""},
+		{"notakey", "", ""},
+	} {
+		keyID, err := v.validateSignature("testcode", sign(c.Secret, "testcode"), c.KeyID)
+		if c.ExpectedKeyID == "" {
+			if err == nil {
+				t.Errorf("secret: %s, kid: %s, expected an error", c.Secret, c.KeyID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("secret: %s, kid: %s, unexpected error: %v", c.Secret, c.KeyID, err)
+			continue
+		}
+		if keyID != c.ExpectedKeyID {
+			t.Errorf("secret: %s, kid: %s, expected key: %s, got: %s", c.Secret, c.KeyID, c.ExpectedKeyID, keyID)
+		}
+	}
+
+	t.Run("Validate records key id", func(t *testing.T) {
+		b64Code := base64Decoder.EncodeToString([]byte("source=mozilla.com&medium=test&campaign=test&content=test"))
+		code, err := v.Validate(b64Code, sign("nextkey", b64Code), "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if code.KeyID() != "next" {
+			t.Errorf("expected key id: next, got: %s", code.KeyID())
+		}
+	})
+}
+
 func TestValidateAttributionCode(t *testing.T) {
 	v := &Validator{}
 
@@ -180,7 +245,7 @@ func TestValidateAttributionCode(t *testing.T) {
 		},
 	}
 	for _, c := range validCodes {
-		code, err := v.Validate(c.In, "", c.RefererHeader)
+		code, err := v.Validate(c.In, "", "", c.RefererHeader)
 		if err != nil {
 			t.Errorf("err: %v, code: %s", err, c.In)
 		}
@@ -259,7 +324,7 @@ func TestValidateAttributionCode(t *testing.T) {
 		},
 	}
 	for _, c := range invalidCodes {
-		_, err := v.Validate(c.In, c.Sig, c.RefererHeader)
+		_, err := v.Validate(c.In, c.Sig, "", c.RefererHeader)
 		if err == nil {
 			t.Errorf("err was nil, expected: %v", c.Err)
 			continue
@@ -270,23 +335,140 @@ func TestValidateAttributionCode(t *testing.T) {
 	}
 }
 
+func TestValidationErrorReasons(t *testing.T) {
+	v := NewValidator("testkey", 0)
+	encode := func(s string) string {
+		return base64Decoder.EncodeToString([]byte(s))
+	}
+	sign := func(code string) string {
+		mac := hmac.New(sha256.New, []byte("testkey"))
+		mac.Write([]byte(code))
+		return fmt.Sprintf("%x", mac.Sum(nil))
+	}
+
+	for _, c := range []struct {
+		Code    string
+		Sig     string
+		Referer string
+		Reason  Reason
+		Field   string
+	}{
+		{"", "", "", ReasonEmpty, "attribution_code"},
+		{strings.Repeat("a", 5001), "", "", ReasonTooLong, "attribution_code"},
+		{"test", strings.Repeat("s", 5001), "", ReasonTooLong, "attribution_sig"},
+		{"!!!", "", "", ReasonBadBase64, "attribution_code"},
+		{encode(strings.Repeat("a", 1011)), "", "", ReasonTooLong, "attribution_code"},
+		{encode("a=%zz"), "", "", ReasonBadQuery, "attribution_code"},
+		{encode("source=a"), "0000", "", ReasonBadSignature, "attribution_sig"},
+		{encode("campaign=a&notakey=b"), sign(encode("campaign=a&notakey=b")), "", ReasonInvalidKey, "notakey"},
+		{encode("content=rta:abc"), sign(encode("content=rta:abc")), "https://example.com/", ReasonPartnerReferer, "referer"},
+	} {
+		_, err := v.Validate(c.Code, c.Sig, "", c.Referer)
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("code: %.20s, expected a ValidationError, got: %v", c.Code, err)
+			continue
+		}
+		if validationErr.Reason != c.Reason || validationErr.Field != c.Field {
+			t.Errorf("code: %.20s, expected %s/%s, got: %s/%s", c.Code, c.Reason, c.Field, validationErr.Reason, validationErr.Field)
+		}
+	}
+}
+
 func TestFromRTAMO(t *testing.T) {
 	invalidCodes := []string{" rta:123", "wrongcode", "rta"}
 	validCodes := []string{"rta:123", "rta:abc"}
 
-	for _, v := range invalidCodes {
-		c := Code{Content: v}
+	v := &Validator{}
+	validate := func(content string) *Code {
+		code, err := v.Validate(base64Decoder.EncodeToString([]byte("source=a&content="+url.QueryEscape(content))), "", "", "https://www.mozilla.org/")
+		if err != nil {
+			t.Fatalf("content: %q, unexpected error: %v", content, err)
+		}
+		return code
+	}
 
-		if c.FromRTAMO() {
-			t.Errorf("Invalid code matched regex: %s", v)
+	for _, v := range invalidCodes {
+		if validate(v).FromRTAMO() {
+			t.Errorf("Invalid code matched RTAMO: %s", v)
 		}
 	}
 
 	for _, v := range validCodes {
-		c := Code{Content: v}
+		if !validate(v).FromRTAMO() {
+			t.Errorf("Valid code did not match RTAMO: %s", v)
+		}
+	}
+
+	// Only the RTAMO profile is reported.
+	v.PartnerProfiles = []*PartnerProfile{{Name: "renamed", ContentPrefix: "rta:", AllowedReferers: []string{"https://www.mozilla.org"}}}
+	if validate("rta:123").FromRTAMO() {
+		t.Error("code matched RTAMO through another profile")
+	}
+}
+
+func TestValidateTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := &HMACSigner{ID: DefaultKeyID, Secret: "testkey"}
+	v := &Validator{
+		HMACKeys:  []*HMACKey{{ID: DefaultKeyID, Secret: "testkey"}},
+		Timeout:   10 * time.Minute,
+		ClockSkew: time.Minute,
+		Now:       func() time.Time { return now },
+	}
 
-		if !c.FromRTAMO() {
-			t.Errorf("Valid code did not match regex: %s", v)
+	encode := func(timestamp string) string {
+		code := "source=mozilla.com&medium=test&campaign=test&content=test"
+		if timestamp != "" {
+			code += "&timestamp=" + timestamp
 		}
+		return base64Decoder.EncodeToString([]byte(code))
 	}
+
+	for _, c := range []struct {
+		Timestamp string
+		Valid     bool
+		Expired   bool
+	}{
+		{fmt.Sprintf("%d", now.Unix()), true, false},
+		{fmt.Sprintf("%d", now.Add(-9*time.Minute).Unix()), true, false},
+		{fmt.Sprintf("%d", now.Add(30*time.Second).Unix()), true, false},
+		{fmt.Sprintf("%d", now.Add(-11*time.Minute).Unix()), false, true},
+		{fmt.Sprintf("%d", now.Add(2*time.Minute).Unix()), false, true},
+		{"notanumber", false, false},
+		{"", false, false},
+	} {
+		encoded := encode(c.Timestamp)
+		sig := hex.EncodeToString(signer.Sign([]byte(encoded)))
+		code, err := v.Validate(encoded, sig, "", "")
+		if (err == nil) != c.Valid {
+			t.Errorf("timestamp: %s, expected valid: %v, got err: %v", c.Timestamp, c.Valid, err)
+		}
+		var expiredErr *ExpiredError
+		if ok := errors.As(err, &expiredErr); ok != c.Expired {
+			t.Errorf("timestamp: %s, expected expired: %v, got err: %v", c.Timestamp, c.Expired, err)
+		}
+		if err == nil && code.rawURLVals.Get("timestamp") != "" {
+			t.Errorf("timestamp: %s, timestamp was not removed from code", c.Timestamp)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		v := &Validator{Now: func() time.Time { return now }}
+		if _, err := v.Validate(encode("1"), "", "", ""); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		v := &Validator{
+			Timeout: 10 * time.Minute,
+			Now:     func() time.Time { return now },
+		}
+		for _, timestamp := range []string{"", "1"} {
+			if _, err := v.Validate(encode(timestamp), "", "", ""); err != nil {
+				t.Errorf("timestamp: %s, unexpected error: %v", timestamp, err)
+			}
+		}
+	})
 }
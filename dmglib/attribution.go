@@ -73,3 +73,13 @@ func ParseAttribution(raw string) (*AttributionResource, error) {
 
 	return attr, nil
 }
+
+// Encode returns the base64 encoded form of `a`, as stored in the plst
+// resource. It can be parsed with ParseAttribution.
+func (a *AttributionResource) Encode() (string, error) {
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, a); err != nil {
+		return "", fmt.Errorf("dmglib: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -87,3 +87,22 @@ func TestParseAttributionInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeAttribution(t *testing.T) {
+	encoded, err := expectedAttributionData.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "cnR0YQEAAAAtKrjTLgQAAAAAAABr57W5AAA0AAAAAAAuBAAAAAAAAAAACAAAAAAAl5IVp2O5R1smIeUIAAAAALU2DPUAAPQbAAAAAA=="
+	if encoded != expected {
+		t.Errorf("expected: %s, got: %s", expected, encoded)
+	}
+
+	res, err := ParseAttribution(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if *res != expectedAttributionData {
+		t.Errorf("expected: %+v, got: %+v", expectedAttributionData, *res)
+	}
+}
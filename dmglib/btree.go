@@ -0,0 +1,210 @@
+package dmglib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// HFS+ B-tree node kinds.
+const (
+	btreeLeafNode  int8 = -1
+	btreeIndexNode int8 = 0
+)
+
+const (
+	// btreeNodeDescriptorSize is the size of the descriptor at the start of
+	// every node.
+	btreeNodeDescriptorSize = 14
+
+	// btreeVariableIndexKeys is the attribute of B-trees whose index nodes
+	// have keys of variable length. Other B-trees have index keys of
+	// HeaderRecord.MaxKeyLength bytes.
+	btreeVariableIndexKeys = 0x00000004
+)
+
+var ErrBadBtree = errors.New("dmglib: invalid HFS+ B-tree")
+
+type btreeNodeDescriptor struct {
+	FLink      uint32
+	BLink      uint32
+	Kind       int8
+	Height     uint8
+	NumRecords uint16
+	Reserved   uint16
+}
+
+type btreeHeaderRecord struct {
+	TreeDepth      uint16
+	RootNode       uint32
+	LeafRecords    uint32
+	FirstLeafNode  uint32
+	LastLeafNode   uint32
+	NodeSize       uint16
+	MaxKeyLength   uint16
+	TotalNodes     uint32
+	FreeNodes      uint32
+	Reserved1      uint16
+	ClumpSize      uint32
+	BtreeType      uint8
+	KeyCompareType uint8
+	Attributes     uint32
+	Reserved3      [16]uint32
+}
+
+// btreeNode is a node of a B-tree, split in records.
+type btreeNode struct {
+	btreeNodeDescriptor
+	records [][]byte
+}
+
+// btree is an HFS+ B-tree, such as the catalog file, stored in a fork.
+type btree struct {
+	fork   io.ReaderAt
+	header btreeHeaderRecord
+}
+
+func newBtree(fork io.ReaderAt) (*btree, error) {
+	buf := make([]byte, btreeNodeDescriptorSize+binary.Size(btreeHeaderRecord{}))
+	if _, err := fork.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("dmglib: %w", err)
+	}
+
+	t := &btree{fork: fork}
+	if err := binary.Read(bytes.NewReader(buf[btreeNodeDescriptorSize:]), binary.BigEndian, &t.header); err != nil {
+		return nil, fmt.Errorf("dmglib: %w", err)
+	}
+	// Nodes are between 512 bytes and 32KiB, in powers of 2.
+	nodeSize := t.header.NodeSize
+	if nodeSize < 512 || nodeSize > 32768 || nodeSize&(nodeSize-1) != 0 {
+		return nil, fmt.Errorf("%w: nodes are %d bytes long", ErrBadBtree, nodeSize)
+	}
+	return t, nil
+}
+
+// node reads the node `n` of the B-tree.
+func (t *btree) node(n uint32) (*btreeNode, error) {
+	if n >= t.header.TotalNodes {
+		return nil, fmt.Errorf("%w: node %d does not exist", ErrBadBtree, n)
+	}
+	nodeSize := int(t.header.NodeSize)
+	buf := make([]byte, nodeSize)
+	if _, err := t.fork.ReadAt(buf, int64(n)*int64(nodeSize)); err != nil {
+		return nil, fmt.Errorf("dmglib: %w", err)
+	}
+
+	node := &btreeNode{}
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &node.btreeNodeDescriptor); err != nil {
+		return nil, fmt.Errorf("dmglib: %w", err)
+	}
+
+	// The offsets of the records are at the end of the node, in reverse
+	// order, followed by the offset of the free space.
+	numRecords := int(node.NumRecords)
+	offsetsStart := nodeSize - 2*(numRecords+1)
+	if offsetsStart < btreeNodeDescriptorSize {
+		return nil, fmt.Errorf("%w: node %d has too many records", ErrBadBtree, n)
+	}
+	offset := func(i int) int {
+		return int(binary.BigEndian.Uint16(buf[nodeSize-2*(i+1):]))
+	}
+	node.records = make([][]byte, numRecords)
+	for i := range node.records {
+		start, end := offset(i), offset(i+1)
+		if start < btreeNodeDescriptorSize || start > end || end > offsetsStart {
+			return nil, fmt.Errorf("%w: record %d of node %d is invalid", ErrBadBtree, i, n)
+		}
+		node.records[i] = buf[start:end]
+	}
+	return node, nil
+}
+
+// record splits `record`, a record of `node`, in its key and its data.
+func (t *btree) record(node *btreeNode, record []byte) ([]byte, []byte, error) {
+	if len(record) < 2 {
+		return nil, nil, fmt.Errorf("%w: record without a key", ErrBadBtree)
+	}
+	keyLength := int(binary.BigEndian.Uint16(record))
+	if node.Kind == btreeIndexNode && t.header.Attributes&btreeVariableIndexKeys == 0 {
+		keyLength = int(t.header.MaxKeyLength)
+	}
+	if 2+keyLength > len(record) {
+		return nil, nil, fmt.Errorf("%w: key longer than its record", ErrBadBtree)
+	}
+	return record[2 : 2+keyLength], record[2+keyLength:], nil
+}
+
+// scan calls `visit` with the records of the leaf nodes, in order, starting
+// from the leaf node which would hold the last key for which `before`
+// returns true. Keys for which `before` returns true may still be visited.
+// Scanning stops when `visit` returns false.
+func (t *btree) scan(before func(key []byte) bool, visit func(key, data []byte) (bool, error)) error {
+	if t.header.TreeDepth == 0 {
+		// The B-tree is empty.
+		return nil
+	}
+
+	n := t.header.RootNode
+	for depth := 0; ; depth++ {
+		if depth >= int(t.header.TreeDepth) {
+			return fmt.Errorf("%w: leaf node not found", ErrBadBtree)
+		}
+		node, err := t.node(n)
+		if err != nil {
+			return err
+		}
+		if node.Kind == btreeLeafNode {
+			break
+		}
+		if node.Kind != btreeIndexNode || len(node.records) == 0 {
+			return fmt.Errorf("%w: node %d is not an index node", ErrBadBtree, n)
+		}
+
+		// Follow the last record whose key is before the searched one, or
+		// the first one.
+		child := -1
+		for _, record := range node.records {
+			key, data, err := t.record(node, record)
+			if err != nil {
+				return err
+			}
+			if len(data) < 4 {
+				return fmt.Errorf("%w: index record without a child", ErrBadBtree)
+			}
+			if child == -1 || before(key) {
+				child = int(binary.BigEndian.Uint32(data))
+			} else {
+				break
+			}
+		}
+		n = uint32(child)
+	}
+
+	// Leaf nodes are linked, so following ones are reached through FLink.
+	for visited := uint32(0); n != 0; visited++ {
+		if visited > t.header.TotalNodes {
+			return fmt.Errorf("%w: leaf nodes form a loop", ErrBadBtree)
+		}
+		node, err := t.node(n)
+		if err != nil {
+			return err
+		}
+		if node.Kind != btreeLeafNode {
+			return fmt.Errorf("%w: node %d is not a leaf node", ErrBadBtree, n)
+		}
+		for _, record := range node.records {
+			key, data, err := t.record(node, record)
+			if err != nil {
+				return err
+			}
+			more, err := visit(key, data)
+			if err != nil || !more {
+				return err
+			}
+		}
+		n = node.FLink
+	}
+	return nil
+}
@@ -54,16 +54,31 @@ func (d *DMG) UpdateKolyBlock(newDataChecksum uint32) error {
 // Ported from libdmg-hfsplus
 // (https://github.com/mozilla/libdmg-hfsplus/blob/a0a959bd25370c1c0a00c9ec525e3e78285adbf9/dmg/dmglib.c#L50)
 func (d *DMG) UpdateOverallChecksum() error {
+	checksum, err := d.overallChecksum()
+	if err != nil {
+		return err
+	}
+
+	d.Koly.ChecksumType = blkxUDIFCRC32
+	d.Koly.ChecksumSize = blkxUDIFCRC32Size
+	d.Koly.Checksum[0] = checksum
+
+	return nil
+}
+
+// overallChecksum returns the overall checksum of `d`, which is computed from
+// the checksums of the blkx resources.
+func (d *DMG) overallChecksum() (uint32, error) {
 	blkx, err := d.Resources.GetResourceDataByName("blkx")
 	if err != nil {
-		return fmt.Errorf("CalculateOverallChecksum: %w", err)
+		return 0, fmt.Errorf("CalculateOverallChecksum: %w", err)
 	}
 
 	blkxData := make([]*BLKXContainer, len(blkx))
 	for i, b := range blkx {
 		blkxData[i], err = ParseBlkxData(b.Data)
 		if err != nil {
-			return fmt.Errorf("CalculateOverallChecksum: %w", err)
+			return 0, fmt.Errorf("CalculateOverallChecksum: %w", err)
 		}
 		if blkxData[i].Table.Checksum.Type_ == blkxUDIFCRC32 {
 			i += 1
@@ -80,20 +95,30 @@ func (d *DMG) UpdateOverallChecksum() error {
 		}
 	}
 
-	d.Koly.ChecksumType = blkxUDIFCRC32
-	d.Koly.ChecksumSize = blkxUDIFCRC32Size
-	d.Koly.Checksum[0] = crc32.Checksum(buf, crc32.MakeTable(0xedb88320))
-
-	return nil
+	return crc32.Checksum(buf, crc32.MakeTable(0xedb88320)), nil
 }
 
 // Update the encoded resources in the raw data block with whatever
 // is present in d.Resources.
 func (d *DMG) WriteResources() error {
+	buf, err := d.EncodeResources()
+	if err != nil {
+		return err
+	}
+
+	// Update the resources in the raw data block.
+	copy(d.Data[d.Koly.XMLOffset:d.Koly.XMLOffset+d.Koly.XMLLength], buf)
+
+	return nil
+}
+
+// EncodeResources returns the XML property list which WriteResources writes
+// for d.Resources, padded to the length of the original one.
+func (d *DMG) EncodeResources() ([]byte, error) {
 	var resourceMap map[string]interface{}
 	err := mapstructure.Decode(d.Resources.Entries, &resourceMap)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var resourceData = make(map[string]interface{})
 	resourceData["resource-fork"] = resourceMap
@@ -103,13 +128,13 @@ func (d *DMG) WriteResources() error {
 	enc.Indent("\n")
 	err = enc.Encode(resourceData)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	xml_len := int(d.Koly.XMLLength)
 	// This shouldn't be possible - but if the new encoded resources are larger
 	// than the original XML length, we cannot safely update them.
 	if buf.Len() > xml_len {
-		return ErrResourcesTooBig
+		return nil, ErrResourcesTooBig
 	}
 	// Pad the new resources with extra spaces to ensure they are exactly the
 	// same length as the original ones. Failure to do so may cause some of
@@ -124,10 +149,7 @@ func (d *DMG) WriteResources() error {
 		buf.Write(padding)
 	}
 
-	// Update the resources in the raw data block.
-	copy(d.Data[d.Koly.XMLOffset:d.Koly.XMLOffset+d.Koly.XMLLength], buf.Bytes())
-
-	return nil
+	return buf.Bytes(), nil
 }
 
 // Update the Koly block in d.Data with whatever is present in d.Koly
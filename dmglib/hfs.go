@@ -0,0 +1,681 @@
+package dmglib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	hfsVolumeHeaderOffset = 1024
+
+	hfsPlusSignature uint16 = 0x482b // "H+"
+	hfsxSignature    uint16 = 0x4858 // "HX"
+
+	// Catalog node IDs of the parent of the root folder, the root folder and
+	// the catalog file.
+	hfsRootParentID  uint32 = 1
+	hfsRootFolderID  uint32 = 2
+	hfsCatalogFileID uint32 = 4
+
+	// Types of catalog records. Thread records are not used.
+	hfsFolderRecord int16 = 1
+	hfsFileRecord   int16 = 2
+
+	// hfsDataFork is the fork type of data forks in the extents overflow file.
+	hfsDataFork uint8 = 0
+
+	// hfsCompressed is the BSD flag of files whose data is compressed in
+	// their resource fork.
+	hfsCompressed = 0x20
+
+	// File types of BSD modes.
+	hfsModeType    = 0170000
+	hfsModeSymlink = 0120000
+)
+
+var (
+	ErrNotHFS        = errors.New("dmglib: not an HFS+ volume")
+	ErrHFSCompressed = errors.New("dmglib: compressed HFS+ files are not supported")
+
+	// hfsPrivateFolders are the folders of the root folder which hold the
+	// files and folders with hard links. They are hidden, as macOS does.
+	hfsPrivateFolders = map[string]bool{
+		"\x00\x00\x00\x00HFS+ Private Data": true,
+		".HFS+ Private Directory Data\r":    true,
+	}
+
+	// hfsEpoch is the time HFS+ dates count the seconds from.
+	hfsEpoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+type hfsExtent struct {
+	StartBlock uint32
+	BlockCount uint32
+}
+
+type hfsForkData struct {
+	LogicalSize uint64
+	ClumpSize   uint32
+	TotalBlocks uint32
+	Extents     [8]hfsExtent
+}
+
+// hfsVolumeHeader is the volume header of an HFS+ volume.
+//
+// See: https://developer.apple.com/library/archive/technotes/tn/tn1150.html
+type hfsVolumeHeader struct {
+	Signature          uint16
+	Version            uint16
+	Attributes         uint32
+	LastMountedVersion uint32
+	JournalInfoBlock   uint32
+	CreateDate         uint32
+	ModifyDate         uint32
+	BackupDate         uint32
+	CheckedDate        uint32
+	FileCount          uint32
+	FolderCount        uint32
+	BlockSize          uint32
+	TotalBlocks        uint32
+	FreeBlocks         uint32
+	NextAllocation     uint32
+	RsrcClumpSize      uint32
+	DataClumpSize      uint32
+	NextCatalogID      uint32
+	WriteCount         uint32
+	EncodingsBitmap    uint64
+	FinderInfo         [8]uint32
+	AllocationFile     hfsForkData
+	ExtentsFile        hfsForkData
+	CatalogFile        hfsForkData
+	AttributesFile     hfsForkData
+	StartupFile        hfsForkData
+}
+
+type hfsExtentKey struct {
+	ForkType   uint8
+	Pad        uint8
+	FileID     uint32
+	StartBlock uint32
+}
+
+type hfsBSDInfo struct {
+	OwnerID    uint32
+	GroupID    uint32
+	AdminFlags uint8
+	OwnerFlags uint8
+	FileMode   uint16
+	Special    uint32
+}
+
+type hfsCatalogFolder struct {
+	RecordType       int16
+	Flags            uint16
+	Valence          uint32
+	FolderID         uint32
+	CreateDate       uint32
+	ContentModDate   uint32
+	AttributeModDate uint32
+	AccessDate       uint32
+	BackupDate       uint32
+	Permissions      hfsBSDInfo
+	UserInfo         [16]byte
+	FinderInfo       [16]byte
+	TextEncoding     uint32
+	Reserved         uint32
+}
+
+type hfsCatalogFile struct {
+	RecordType       int16
+	Flags            uint16
+	Reserved1        uint32
+	FileID           uint32
+	CreateDate       uint32
+	ContentModDate   uint32
+	AttributeModDate uint32
+	AccessDate       uint32
+	BackupDate       uint32
+	Permissions      hfsBSDInfo
+	UserInfo         [16]byte
+	FinderInfo       [16]byte
+	TextEncoding     uint32
+	Reserved2        uint32
+	DataFork         hfsForkData
+	ResourceFork     hfsForkData
+}
+
+// HFS is a read-only HFS+ or HFSX volume, such as the Apple_HFS partition of
+// a DMG. It implements fs.FS, fs.ReadDirFS and fs.StatFS. Symbolic links are
+// not followed: they are files whose data is the target of the link.
+type HFS struct {
+	r       io.ReaderAt
+	header  hfsVolumeHeader
+	extents *btree
+	catalog *btree
+	root    *hfsEntry
+}
+
+// HFS returns the HFS+ volume of the first Apple_HFS (or Apple_HFSX)
+// partition of `d`.
+func (d *DMG) HFS() (*HFS, error) {
+	p, err := d.Partition("Apple_HFS")
+	if err != nil {
+		return nil, err
+	}
+	return NewHFS(p)
+}
+
+// NewHFS returns the HFS+ volume read from `r`.
+func NewHFS(r io.ReaderAt) (*HFS, error) {
+	buf := make([]byte, binary.Size(hfsVolumeHeader{}))
+	if _, err := r.ReadAt(buf, hfsVolumeHeaderOffset); err == io.EOF {
+		return nil, fmt.Errorf("%w: volume is too small", ErrNotHFS)
+	} else if err != nil {
+		return nil, fmt.Errorf("dmglib: %w", err)
+	}
+
+	h := &HFS{r: r}
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &h.header); err != nil {
+		return nil, fmt.Errorf("dmglib: %w", err)
+	}
+	if h.header.Signature != hfsPlusSignature && h.header.Signature != hfsxSignature {
+		return nil, ErrNotHFS
+	}
+	blockSize := h.header.BlockSize
+	if blockSize < 512 || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("%w: blocks are %d bytes long", ErrNotHFS, blockSize)
+	}
+
+	// The extents overflow file cannot have extents in itself.
+	extents, err := h.fork(0, hfsDataFork, h.header.ExtentsFile)
+	if err != nil {
+		return nil, err
+	}
+	if h.extents, err = newBtree(extents); err != nil {
+		return nil, err
+	}
+	catalog, err := h.fork(hfsCatalogFileID, hfsDataFork, h.header.CatalogFile)
+	if err != nil {
+		return nil, err
+	}
+	if h.catalog, err = newBtree(catalog); err != nil {
+		return nil, err
+	}
+
+	// The root folder is the only child of its parent.
+	children, err := h.children(hfsRootParentID)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if child.id == hfsRootFolderID && child.IsDir() {
+			h.root = child
+		}
+	}
+	if h.root == nil {
+		return nil, fmt.Errorf("%w: root folder not found", ErrBadBtree)
+	}
+
+	return h, nil
+}
+
+// Open opens the file `name`.
+func (h *HFS) Open(name string) (fs.File, error) {
+	entry, err := h.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsDir() {
+		return &hfsDir{h: h, path: name, entry: entry}, nil
+	}
+
+	if entry.file.Permissions.OwnerFlags&hfsCompressed != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrHFSCompressed}
+	}
+	fork, err := h.fork(entry.id, hfsDataFork, entry.file.DataFork)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &hfsFile{SectionReader: io.NewSectionReader(fork, 0, fork.size), entry: entry}, nil
+}
+
+// ReadDir returns the entries of the directory `name`, sorted by name.
+func (h *HFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := h.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := h.readDir(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// Stat returns the fs.FileInfo of the file `name`.
+func (h *HFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := h.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// lookup returns the catalog entry of the file `name`. Errors are returned as
+// an *fs.PathError for `op`.
+func (h *HFS) lookup(op, name string) (*hfsEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	root := *h.root
+	root.name = "."
+	entry := &root
+	if name == "." {
+		return entry, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !entry.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		children, err := h.children(entry.id)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		entry = nil
+		for _, child := range children {
+			if child.name == elem {
+				entry = child
+				break
+			}
+		}
+		if entry == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return entry, nil
+}
+
+func (h *HFS) readDir(dir *hfsEntry) ([]fs.DirEntry, error) {
+	children, err := h.children(dir.id)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(children))
+	for i, child := range children {
+		entries[i] = child
+	}
+	return entries, nil
+}
+
+// children returns the files and folders in the folder `parentID`, sorted by
+// name.
+func (h *HFS) children(parentID uint32) ([]*hfsEntry, error) {
+	var children []*hfsEntry
+	// The keys of the catalog are sorted by parent, then by name. The thread
+	// record of a folder has its ID as parent and an empty name, so it comes
+	// before its children, whatever the order of names is.
+	before := func(key []byte) bool {
+		if len(key) < 6 {
+			return false
+		}
+		keyParentID := binary.BigEndian.Uint32(key)
+		return keyParentID < parentID || keyParentID == parentID && binary.BigEndian.Uint16(key[4:]) == 0
+	}
+	err := h.catalog.scan(before, func(key, data []byte) (bool, error) {
+		keyParentID, name, err := parseCatalogKey(key)
+		if err != nil {
+			return false, err
+		}
+		if keyParentID < parentID {
+			return true, nil
+		}
+		if keyParentID > parentID {
+			return false, nil
+		}
+		if parentID == hfsRootFolderID && hfsPrivateFolders[name] {
+			return true, nil
+		}
+		entry, err := parseCatalogRecord(name, data)
+		if err != nil {
+			return false, err
+		}
+		if entry != nil {
+			children = append(children, entry)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	return children, nil
+}
+
+// parseCatalogKey returns the parent ID and the name of a catalog key. Names
+// are returned as POSIX names, in which colons stand for slashes.
+func parseCatalogKey(key []byte) (uint32, string, error) {
+	if len(key) < 6 {
+		return 0, "", fmt.Errorf("%w: catalog key is too short", ErrBadBtree)
+	}
+	length := int(binary.BigEndian.Uint16(key[4:]))
+	if 6+2*length > len(key) {
+		return 0, "", fmt.Errorf("%w: catalog name is longer than its key", ErrBadBtree)
+	}
+	units := make([]uint16, length)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(key[6+2*i:])
+	}
+	name := strings.ReplaceAll(string(utf16.Decode(units)), "/", ":")
+	return binary.BigEndian.Uint32(key), name, nil
+}
+
+// parseCatalogRecord returns the entry of a folder or file record, or nil for
+// other records.
+func parseCatalogRecord(name string, data []byte) (*hfsEntry, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("%w: catalog record is too short", ErrBadBtree)
+	}
+	r := bytes.NewReader(data)
+
+	switch int16(binary.BigEndian.Uint16(data)) {
+	case hfsFolderRecord:
+		folder := hfsCatalogFolder{}
+		if err := binary.Read(r, binary.BigEndian, &folder); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadBtree, err)
+		}
+		return &hfsEntry{
+			name:    name,
+			id:      folder.FolderID,
+			mode:    fs.ModeDir | hfsPermissions(folder.Permissions.FileMode, 0755),
+			modTime: hfsTime(folder.ContentModDate),
+		}, nil
+
+	case hfsFileRecord:
+		file := &hfsCatalogFile{}
+		if err := binary.Read(r, binary.BigEndian, file); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadBtree, err)
+		}
+		mode := hfsPermissions(file.Permissions.FileMode, 0644)
+		if file.Permissions.FileMode&hfsModeType == hfsModeSymlink {
+			mode |= fs.ModeSymlink
+		}
+		return &hfsEntry{
+			name:    name,
+			id:      file.FileID,
+			mode:    mode,
+			modTime: hfsTime(file.ContentModDate),
+			file:    file,
+		}, nil
+	}
+	return nil, nil
+}
+
+// hfsPermissions returns the permissions of a BSD mode, or `defaultPerm` when
+// the mode was never set.
+func hfsPermissions(mode uint16, defaultPerm fs.FileMode) fs.FileMode {
+	if mode&hfsModeType == 0 {
+		return defaultPerm
+	}
+	return fs.FileMode(mode) & fs.ModePerm
+}
+
+func hfsTime(seconds uint32) time.Time {
+	return hfsEpoch.Add(time.Duration(seconds) * time.Second)
+}
+
+// fork returns the reader of the fork `data` of the file `fileID`. The
+// extents which do not fit in `data` are read from the extents overflow file.
+func (h *HFS) fork(fileID uint32, forkType uint8, data hfsForkData) (*hfsFork, error) {
+	f := &hfsFork{
+		r:         h.r,
+		blockSize: int64(h.header.BlockSize),
+		size:      int64(data.LogicalSize),
+	}
+	blocks := int64(0)
+	extents := data.Extents[:]
+	for {
+		found := false
+		for _, extent := range extents {
+			if extent.BlockCount == 0 {
+				break
+			}
+			f.extents = append(f.extents, extent)
+			blocks += int64(extent.BlockCount)
+			found = true
+		}
+		if blocks >= int64(data.TotalBlocks) || !found || h.extents == nil {
+			break
+		}
+		var err error
+		if extents, err = h.overflowExtents(fileID, forkType, uint32(blocks)); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.size < 0 || f.size > blocks*f.blockSize {
+		return nil, fmt.Errorf("%w: fork of file %d is longer than its extents", ErrBadBtree, fileID)
+	}
+	return f, nil
+}
+
+// overflowExtents returns the extents of the fork of the file `fileID` which
+// start at the block `startBlock` of the fork, from the extents overflow file.
+func (h *HFS) overflowExtents(fileID uint32, forkType uint8, startBlock uint32) ([]hfsExtent, error) {
+	target := hfsExtentKey{ForkType: forkType, FileID: fileID, StartBlock: startBlock}
+	compare := func(key []byte) (int, error) {
+		k := hfsExtentKey{}
+		if err := binary.Read(bytes.NewReader(key), binary.BigEndian, &k); err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrBadBtree, err)
+		}
+		switch {
+		case k.FileID != target.FileID:
+			return cmpUint32(k.FileID, target.FileID), nil
+		case k.ForkType != target.ForkType:
+			return cmpUint32(uint32(k.ForkType), uint32(target.ForkType)), nil
+		}
+		return cmpUint32(k.StartBlock, target.StartBlock), nil
+	}
+
+	var extents []hfsExtent
+	before := func(key []byte) bool {
+		c, err := compare(key)
+		return err == nil && c <= 0
+	}
+	err := h.extents.scan(before, func(key, data []byte) (bool, error) {
+		c, err := compare(key)
+		if err != nil || c > 0 {
+			return false, err
+		}
+		if c < 0 {
+			return true, nil
+		}
+		extents = make([]hfsExtent, 8)
+		if err := binary.Read(bytes.NewReader(data), binary.BigEndian, extents); err != nil {
+			return false, fmt.Errorf("%w: %s", ErrBadBtree, err)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if extents == nil {
+		return nil, fmt.Errorf("%w: extents of file %d not found", ErrBadBtree, fileID)
+	}
+	return extents, nil
+}
+
+func cmpUint32(a, b uint32) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// hfsFork is the data of a fork, read from its extents.
+type hfsFork struct {
+	r         io.ReaderAt
+	blockSize int64
+	size      int64
+	extents   []hfsExtent
+}
+
+func (f *hfsFork) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+
+	n := 0
+	for n < len(b) {
+		if off >= f.size {
+			return n, io.EOF
+		}
+
+		// Find the extent holding `off`, and where it is in the volume.
+		block := off / f.blockSize
+		pos, available := int64(0), int64(0)
+		for _, extent := range f.extents {
+			if block < int64(extent.BlockCount) {
+				pos = (int64(extent.StartBlock)+block)*f.blockSize + off%f.blockSize
+				available = (int64(extent.BlockCount)-block)*f.blockSize - off%f.blockSize
+				break
+			}
+			block -= int64(extent.BlockCount)
+		}
+		chunk := min(int64(len(b)-n), available, f.size-off)
+
+		m, err := f.r.ReadAt(b[n:n+int(chunk)], pos)
+		n += m
+		off += int64(m)
+		if err == io.EOF && int64(m) == chunk {
+			err = nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// hfsEntry is a file or folder of the catalog. It is both its fs.FileInfo
+// and fs.DirEntry.
+type hfsEntry struct {
+	name    string
+	id      uint32
+	mode    fs.FileMode
+	modTime time.Time
+	// file is the catalog record of files, and nil for folders.
+	file *hfsCatalogFile
+}
+
+func (e *hfsEntry) Name() string {
+	return e.name
+}
+
+func (e *hfsEntry) Size() int64 {
+	if e.file == nil {
+		return 0
+	}
+	return int64(e.file.DataFork.LogicalSize)
+}
+
+func (e *hfsEntry) Mode() fs.FileMode {
+	return e.mode
+}
+
+func (e *hfsEntry) ModTime() time.Time {
+	return e.modTime
+}
+
+func (e *hfsEntry) IsDir() bool {
+	return e.mode.IsDir()
+}
+
+func (e *hfsEntry) Sys() interface{} {
+	return nil
+}
+
+func (e *hfsEntry) Type() fs.FileMode {
+	return e.mode.Type()
+}
+
+func (e *hfsEntry) Info() (fs.FileInfo, error) {
+	return e, nil
+}
+
+// hfsFile is an open file of an HFS volume.
+type hfsFile struct {
+	*io.SectionReader
+	entry *hfsEntry
+}
+
+func (f *hfsFile) Stat() (fs.FileInfo, error) {
+	return f.entry, nil
+}
+
+func (f *hfsFile) Close() error {
+	return nil
+}
+
+// hfsDir is an open folder of an HFS volume.
+type hfsDir struct {
+	h       *HFS
+	path    string
+	entry   *hfsEntry
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *hfsDir) Stat() (fs.FileInfo, error) {
+	return d.entry, nil
+}
+
+func (d *hfsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *hfsDir) Close() error {
+	return nil
+}
+
+func (d *hfsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		entries, err := d.h.readDir(d.entry)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.path, Err: err}
+		}
+		d.entries = entries
+	}
+
+	entries := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return entries, nil
+	}
+	if len(entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(entries))
+	d.offset += n
+	return entries[:n], nil
+}
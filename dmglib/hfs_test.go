@@ -0,0 +1,121 @@
+package dmglib
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestHFS(t *testing.T) {
+	for _, tc := range []struct {
+		testfile string
+		files    map[string]string
+	}{
+		{
+			testfile: "../testdata/attributable.dmg",
+			files:    map[string]string{"a": "content-a\n", "b": "content-b\n"},
+		},
+		{
+			testfile: "../testdata/attributed.dmg",
+			files:    map[string]string{"a": "content-a\n", "b": "content-b\n"},
+		},
+		{
+			// The private folders of the volume are hidden.
+			testfile: "../testdata/empty.dmg",
+			files:    map[string]string{"x": "content-x\n"},
+		},
+	} {
+		t.Run(tc.testfile, func(t *testing.T) {
+			volume, err := parseTestFile(t, tc.testfile).HFS()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			var expected []string
+			for name, content := range tc.files {
+				expected = append(expected, name)
+				data, err := fs.ReadFile(volume, name)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if string(data) != content {
+					t.Errorf("expected %s to contain %q, got: %q", name, content, data)
+				}
+			}
+			if err := fstest.TestFS(volume, expected...); err != nil {
+				t.Error(err)
+			}
+
+			entries, err := fs.ReadDir(volume, ".")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(entries) != len(tc.files) {
+				t.Errorf("expected %d entries, got: %v", len(tc.files), entries)
+			}
+		})
+	}
+}
+
+func TestHFSInvalid(t *testing.T) {
+	dmg := parseTestFile(t, "../testdata/attributable.dmg")
+	volume, err := dmg.HFS()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, name := range []string{"c", "a/b"} {
+		if _, err := volume.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("opening %s, expected fs.ErrNotExist, got: %v", name, err)
+		}
+	}
+	if _, err := volume.Open("/a"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("expected fs.ErrInvalid, got: %v", err)
+	}
+	if _, err := volume.ReadDir("a"); err == nil {
+		t.Error("expected an error reading a file as a directory")
+	}
+
+	p, err := dmg.Partition("Driver Descriptor Map")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := NewHFS(p); !errors.Is(err, ErrNotHFS) {
+		t.Errorf("expected ErrNotHFS, got: %v", err)
+	}
+	if _, err := NewHFS(bytes.NewReader(make([]byte, 4096))); !errors.Is(err, ErrNotHFS) {
+		t.Errorf("expected ErrNotHFS, got: %v", err)
+	}
+}
+
+func TestHFSFork(t *testing.T) {
+	volume := make([]byte, 8*512)
+	for i := range volume {
+		volume[i] = byte(i / 512)
+	}
+	// The fork is stored in blocks 5-6 then 1, and ends in the middle of
+	// block 1.
+	fork := &hfsFork{
+		r:         bytes.NewReader(volume),
+		blockSize: 512,
+		size:      2*512 + 100,
+		extents:   []hfsExtent{{StartBlock: 5, BlockCount: 2}, {StartBlock: 1, BlockCount: 1}},
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(fork, 0, 4096))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := append(append(bytes.Repeat([]byte{5}, 512), bytes.Repeat([]byte{6}, 512)...), bytes.Repeat([]byte{1}, 100)...)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("fork data does not match its extents")
+	}
+
+	b := make([]byte, 10)
+	if n, err := fork.ReadAt(b, 2*512+95); n != 5 || err != io.EOF {
+		t.Errorf("reading past the end, expected 5 bytes and io.EOF, got: %d, %v", n, err)
+	}
+}
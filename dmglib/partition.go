@@ -0,0 +1,226 @@
+package dmglib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// partitionCacheSize is the number of decompressed runs a Partition
+	// keeps.
+	partitionCacheSize = 8
+
+	// maxDecompressedRunSize is the size of the largest compressed run a
+	// Partition decompresses. Runs are usually at most 1MiB.
+	maxDecompressedRunSize = 64 << 20
+)
+
+var (
+	ErrPartitionNotFound = errors.New("dmglib: partition not found")
+	ErrNegativeOffset    = errors.New("dmglib: negative offset")
+)
+
+// Partition is the uncompressed image of a partition of a DMG, as described
+// by its blkx resource. Runs are decompressed when they are read, and the
+// most recently read ones are cached. A Partition is safe for concurrent use.
+type Partition struct {
+	// Name is the name of the blkx resource of the partition.
+	Name string
+
+	dataFork []byte
+	table    *BLKXTable
+	runs     []partitionRun
+	size     int64
+
+	mu    sync.Mutex
+	cache []cachedRun
+}
+
+// partitionRun is a run of a partition, which holds the bytes [offset,
+// offset+size) of the partition image.
+type partitionRun struct {
+	BLKXRun
+	index  int
+	offset int64
+	size   int64
+}
+
+// cachedRun is the decompressed data of the run at index in
+// Partition.runs.
+type cachedRun struct {
+	index int
+	data  []byte
+}
+
+// Partition returns the partition of `d` whose blkx resource is named
+// `name`. When there is none, the first partition whose name contains `name`
+// is returned, so that partitions can be selected by their type, such as
+// "Apple_HFS".
+func (d *DMG) Partition(name string) (*Partition, error) {
+	blkx, err := d.Resources.GetResourceDataByName("blkx")
+	if err != nil {
+		return nil, err
+	}
+	index := -1
+	for i, res := range blkx {
+		if res.Name == name {
+			index = i
+			break
+		}
+		if index == -1 && strings.Contains(res.Name, name) {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, ErrPartitionNotFound
+	}
+
+	dataFork, err := d.dataFork()
+	if err != nil {
+		return nil, err
+	}
+	container, err := ParseBlkxData(blkx[index].Data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Partition{
+		Name:     blkx[index].Name,
+		dataFork: dataFork,
+		table:    container.Table,
+	}
+	for i, run := range container.Runs {
+		if run.Type_ == blkxRunComment || run.Type_ == blkxRunTerminator {
+			continue
+		}
+		if run.SectorStart != uint64(p.size/sectorSize) {
+			return nil, fmt.Errorf("%w: run %d does not follow the previous one", ErrBadRun, i)
+		}
+		if run.SectorCount > uint64(math.MaxInt64/sectorSize-p.size/sectorSize) {
+			return nil, fmt.Errorf("%w: run %d is too long", ErrBadRun, i)
+		}
+		size := int64(run.SectorCount) * sectorSize
+		if run.Type_ == blkxRunRaw {
+			if run.CompLength != uint64(size) {
+				return nil, fmt.Errorf("%w: raw run %d is %d bytes long, expected %d", ErrBadRun, i, run.CompLength, size)
+			}
+			if _, err := p.rawData(run, i); err != nil {
+				return nil, err
+			}
+		}
+		if size > 0 {
+			p.runs = append(p.runs, partitionRun{BLKXRun: run, index: i, offset: p.size, size: size})
+		}
+		p.size += size
+	}
+	if uint64(p.size/sectorSize) != container.Table.SectorCount {
+		return nil, fmt.Errorf("%w: runs hold %d sectors, expected %d", ErrBadRun, p.size/sectorSize, container.Table.SectorCount)
+	}
+
+	return p, nil
+}
+
+// ExtractPartition writes the uncompressed image of the partition of `d`
+// selected by `name`, as Partition does, to `w`.
+func (d *DMG) ExtractPartition(name string, w io.Writer) error {
+	p, err := d.Partition(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(p, 0, p.Size()))
+	return err
+}
+
+// Size returns the size of the partition image.
+func (p *Partition) Size() int64 {
+	return p.size
+}
+
+// ReadAt reads len(b) bytes of the partition image at offset `off`.
+func (p *Partition) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+
+	n := 0
+	for n < len(b) {
+		if off >= p.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(p.runs), func(i int) bool {
+			return p.runs[i].offset+p.runs[i].size > off
+		})
+		run := p.runs[i]
+		start := off - run.offset
+		end := min(run.size, start+int64(len(b)-n))
+		dst := b[n : n+int(end-start)]
+
+		switch run.Type_ {
+		case blkxRunZeroFill, blkxRunIgnore:
+			clear(dst)
+		case blkxRunRaw:
+			data, err := p.rawData(run.BLKXRun, run.index)
+			if err != nil {
+				return n, err
+			}
+			copy(dst, data[start:end])
+		default:
+			data, err := p.decompressed(i)
+			if err != nil {
+				return n, err
+			}
+			copy(dst, data[start:end])
+		}
+
+		n += len(dst)
+		off += int64(len(dst))
+	}
+	return n, nil
+}
+
+// rawData returns the data of the uncompressed run `run`, the `i`-th run of
+// the blkx resource.
+func (p *Partition) rawData(run BLKXRun, i int) ([]byte, error) {
+	start := p.table.DataStart + run.CompOffset
+	if start < run.CompOffset || start > uint64(len(p.dataFork)) || run.CompLength > uint64(len(p.dataFork))-start {
+		return nil, fmt.Errorf("%w: run %d is outside of the data fork", ErrBadRun, i)
+	}
+	return p.dataFork[start : start+run.CompLength], nil
+}
+
+// decompressed returns the decompressed data of the run at index `i` in
+// p.runs, from the cache when possible.
+func (p *Partition) decompressed(i int) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for j, cached := range p.cache {
+		if cached.index == i {
+			// Move the run to the end of the cache, which is evicted last.
+			copy(p.cache[j:], p.cache[j+1:])
+			p.cache[len(p.cache)-1] = cached
+			return cached.data, nil
+		}
+	}
+
+	run := p.runs[i]
+	if run.size > maxDecompressedRunSize {
+		return nil, fmt.Errorf("%w: run %d is too long", ErrBadRun, run.index)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, run.size))
+	if err := decodeRun(buf, p.dataFork, p.table, run.BLKXRun, run.index, run.size); err != nil {
+		return nil, err
+	}
+
+	if len(p.cache) == partitionCacheSize {
+		p.cache = append(p.cache[:0], p.cache[1:]...)
+	}
+	p.cache = append(p.cache, cachedRun{index: i, data: buf.Bytes()})
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,119 @@
+package dmglib
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+func TestPartition(t *testing.T) {
+	for _, tc := range []struct {
+		testfile  string
+		name      string
+		fullName  string
+		signature string
+	}{
+		{
+			testfile:  "../testdata/attributable.dmg",
+			name:      "Apple_HFS",
+			fullName:  "Mac_OS_X (Apple_HFSX : 3)",
+			signature: "H+",
+		},
+		{
+			testfile:  "../testdata/empty.dmg",
+			name:      "disk image (Apple_HFS : 4)",
+			fullName:  "disk image (Apple_HFS : 4)",
+			signature: "H+",
+		},
+	} {
+		t.Run(tc.testfile, func(t *testing.T) {
+			dmg := parseTestFile(t, tc.testfile)
+			p, err := dmg.Partition(tc.name)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if p.Name != tc.fullName {
+				t.Errorf("expected partition %q, got: %q", tc.fullName, p.Name)
+			}
+			if p.Size() != int64(p.table.SectorCount)*sectorSize {
+				t.Errorf("expected a size of %d sectors, got: %d bytes", p.table.SectorCount, p.Size())
+			}
+
+			image := &bytes.Buffer{}
+			if err := dmg.ExtractPartition(tc.name, image); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if int64(image.Len()) != p.Size() {
+				t.Fatalf("expected %d bytes, got: %d", p.Size(), image.Len())
+			}
+
+			// The HFS+ volume header is 1024 bytes into the partition.
+			if signature := string(image.Bytes()[1024:1026]); signature != tc.signature {
+				t.Errorf("expected the volume signature %q, got: %q", tc.signature, signature)
+			}
+
+			// Reads across runs, in any order, match the extracted image.
+			for _, run := range []partitionRun{p.runs[len(p.runs)-1], p.runs[0], p.runs[1]} {
+				off := run.offset + run.size - 100
+				b := make([]byte, 300)
+				n, err := p.ReadAt(b, off)
+				if off+int64(len(b)) > p.Size() {
+					if err != io.EOF || int64(n) != p.Size()-off {
+						t.Errorf("reading past the end, expected %d bytes and io.EOF, got: %d, %v", p.Size()-off, n, err)
+					}
+				} else if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if !bytes.Equal(b[:n], image.Bytes()[off:off+int64(n)]) {
+					t.Errorf("bytes read at %d do not match the image", off)
+				}
+			}
+		})
+	}
+}
+
+func TestPartitionChecksum(t *testing.T) {
+	// The partition has no ignored runs, so its checksum covers the whole
+	// image.
+	dmg := parseTestFile(t, "../testdata/attributed.dmg")
+	p, err := dmg.Partition("Apple_HFS")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(p, 0, p.Size())); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.Sum32() != p.table.Checksum.Data[0] {
+		t.Errorf("expected a checksum of %08x, got: %08x", p.table.Checksum.Data[0], h.Sum32())
+	}
+}
+
+func TestPartitionInvalid(t *testing.T) {
+	dmg := parseTestFile(t, "../testdata/attributable.dmg")
+	if _, err := dmg.Partition("Apple_UFS"); err != ErrPartitionNotFound {
+		t.Errorf("expected ErrPartitionNotFound, got: %v", err)
+	}
+
+	p, err := dmg.Partition("Driver Descriptor Map")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := p.ReadAt(make([]byte, 1), -1); err != ErrNegativeOffset {
+		t.Errorf("expected ErrNegativeOffset, got: %v", err)
+	}
+
+	// The first run of the partition is bzip2 compressed, at the start of
+	// the data fork.
+	copy(dmg.Data, "corrupt")
+	if _, err := p.ReadAt(make([]byte, 1), 0); !errors.Is(err, ErrBadRun) {
+		t.Errorf("expected ErrBadRun, got: %v", err)
+	}
+
+	modifyFirstRun(t, dmg, func(run *BLKXRun) { run.SectorStart = 1 })
+	if _, err := dmg.Partition("Driver Descriptor Map"); !errors.Is(err, ErrBadRun) {
+		t.Errorf("expected ErrBadRun, got: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package dmglib
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Types of BLKXRun.
+const (
+	blkxRunZeroFill   uint32 = 0x00000000
+	blkxRunRaw        uint32 = 0x00000001
+	blkxRunIgnore     uint32 = 0x00000002
+	blkxRunZlib       uint32 = 0x80000005
+	blkxRunBzip2      uint32 = 0x80000006
+	blkxRunComment    uint32 = 0x7ffffffe
+	blkxRunTerminator uint32 = 0xffffffff
+
+	sectorSize = 512
+)
+
+var (
+	ErrChecksumMismatch = errors.New("dmglib: checksum mismatch")
+	ErrUnsupportedRun   = errors.New("dmglib: unsupported blkx run type")
+	ErrBadRun           = errors.New("dmglib: invalid blkx run")
+	ErrBadDataFork      = errors.New("dmglib: data fork is outside of the dmg")
+)
+
+// Verify checks the checksums of `d` against its data: the checksum of each
+// blkx resource against its decompressed data, the data fork checksum
+// against the data fork, and the overall checksum against the blkx
+// checksums. Only CRC32 checksums are checked. Errors wrap
+// ErrChecksumMismatch when a checksum does not match, and ErrBadRun or
+// ErrUnsupportedRun when the data of a blkx resource cannot be decompressed.
+//
+// zlib (UDZO) and bzip2 (UDBZ) compressed runs are supported, as well as
+// uncompressed ones.
+func (d *DMG) Verify() error {
+	blkx, err := d.Resources.GetResourceDataByName("blkx")
+	if err != nil {
+		return err
+	}
+	dataFork, err := d.dataFork()
+	if err != nil {
+		return err
+	}
+
+	for _, res := range blkx {
+		container, err := ParseBlkxData(res.Data)
+		if err != nil {
+			return err
+		}
+		if container.Table.Checksum.Type_ != blkxUDIFCRC32 {
+			continue
+		}
+		checksum, err := blkxChecksum(dataFork, container)
+		if err != nil {
+			return fmt.Errorf("%w (blkx %q)", err, res.Name)
+		}
+		if expected := container.Table.Checksum.Data[0]; checksum != expected {
+			return fmt.Errorf("%w: blkx %q is %08x, expected %08x", ErrChecksumMismatch, res.Name, checksum, expected)
+		}
+	}
+
+	if d.Koly.DataChecksumType == blkxUDIFCRC32 {
+		checksum := crc32.Checksum(dataFork, crc32.MakeTable(0xedb88320))
+		if expected := d.Koly.DataChecksum[0]; checksum != expected {
+			return fmt.Errorf("%w: data fork is %08x, expected %08x", ErrChecksumMismatch, checksum, expected)
+		}
+	}
+
+	if d.Koly.ChecksumType == blkxUDIFCRC32 {
+		checksum, err := d.overallChecksum()
+		if err != nil {
+			return err
+		}
+		if expected := d.Koly.Checksum[0]; checksum != expected {
+			return fmt.Errorf("%w: overall checksum is %08x, expected %08x", ErrChecksumMismatch, checksum, expected)
+		}
+	}
+
+	return nil
+}
+
+// dataFork returns the data fork of `d`, which holds the data of the blkx
+// resources.
+func (d *DMG) dataFork() ([]byte, error) {
+	if d.Koly.DataForkOffset > uint64(len(d.Data)) || d.Koly.DataForkLength > uint64(len(d.Data))-d.Koly.DataForkOffset {
+		return nil, ErrBadDataFork
+	}
+	return d.Data[d.Koly.DataForkOffset : d.Koly.DataForkOffset+d.Koly.DataForkLength], nil
+}
+
+// blkxChecksum returns the CRC32 of the decompressed data described by the
+// runs of `blkx`. Zero-filled runs are included in the checksum, but ignored
+// runs are not.
+func blkxChecksum(dataFork []byte, blkx *BLKXContainer) (uint32, error) {
+	h := crc32.New(crc32.MakeTable(0xedb88320))
+	for i, run := range blkx.Runs {
+		if run.SectorCount > math.MaxInt64/sectorSize {
+			return 0, fmt.Errorf("%w: run %d is too long", ErrBadRun, i)
+		}
+		size := int64(run.SectorCount) * sectorSize
+
+		switch run.Type_ {
+		case blkxRunComment, blkxRunTerminator, blkxRunIgnore:
+			continue
+		case blkxRunZeroFill:
+			if err := writeZeros(h, size); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if err := decodeRun(h, dataFork, blkx.Table, run, i, size); err != nil {
+			return 0, err
+		}
+	}
+	return h.Sum32(), nil
+}
+
+// decodeRun writes the `size` bytes of decompressed data of `run`, the `i`-th
+// run of `table`, to `w`. The run must be stored in the data fork.
+func decodeRun(w io.Writer, dataFork []byte, table *BLKXTable, run BLKXRun, i int, size int64) error {
+	start := table.DataStart + run.CompOffset
+	if start < run.CompOffset || start > uint64(len(dataFork)) || run.CompLength > uint64(len(dataFork))-start {
+		return fmt.Errorf("%w: run %d is outside of the data fork", ErrBadRun, i)
+	}
+	compressed := bytes.NewReader(dataFork[start : start+run.CompLength])
+
+	var r io.Reader
+	switch run.Type_ {
+	case blkxRunRaw:
+		r = compressed
+	case blkxRunZlib:
+		zr, err := zlib.NewReader(compressed)
+		if err != nil {
+			return fmt.Errorf("%w: run %d: %s", ErrBadRun, i, err)
+		}
+		defer zr.Close()
+		r = zr
+	case blkxRunBzip2:
+		r = bzip2.NewReader(compressed)
+	default:
+		return fmt.Errorf("%w: run %d has type %08x", ErrUnsupportedRun, i, run.Type_)
+	}
+
+	// Read one byte more than expected to detect runs which decompress to
+	// more data than their sectors hold.
+	n, err := io.Copy(w, io.LimitReader(r, size+1))
+	if err != nil {
+		return fmt.Errorf("%w: run %d: %s", ErrBadRun, i, err)
+	}
+	if n != size {
+		return fmt.Errorf("%w: run %d decompresses to %d bytes, expected %d", ErrBadRun, i, n, size)
+	}
+	return nil
+}
+
+// writeZeros writes `n` zero bytes to `h`.
+func writeZeros(h hash.Hash32, n int64) error {
+	zeros := make([]byte, 64*1024)
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		if _, err := h.Write(zeros[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
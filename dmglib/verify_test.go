@@ -0,0 +1,129 @@
+package dmglib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func parseTestFile(t *testing.T, name string) *DMG {
+	file, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer file.Close()
+
+	dmg, err := file.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return dmg
+}
+
+func TestVerify(t *testing.T) {
+	// empty.dmg has zlib compressed, zero-filled and ignored runs, and the
+	// other ones bzip2 compressed and raw runs.
+	for _, testfile := range []string{
+		"../testdata/empty.dmg",
+		"../testdata/attributable.dmg",
+		"../testdata/attributed.dmg",
+	} {
+		if err := parseTestFile(t, testfile).Verify(); err != nil {
+			t.Errorf("%s: unexpected error: %s", testfile, err)
+		}
+	}
+
+	// The existing code was added without updating the checksums.
+	err := parseTestFile(t, "../testdata/attributable-with-existing-data.dmg").Verify()
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got: %v", err)
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		modify   func(t *testing.T, dmg *DMG)
+		expected error
+	}{
+		{
+			name: "modified raw run",
+			modify: func(t *testing.T, dmg *DMG) {
+				dmg.Data[1000] ^= 0xff
+			},
+			expected: ErrChecksumMismatch,
+		},
+		{
+			name: "data checksum",
+			modify: func(t *testing.T, dmg *DMG) {
+				dmg.Koly.DataChecksum[0]++
+			},
+			expected: ErrChecksumMismatch,
+		},
+		{
+			name: "overall checksum",
+			modify: func(t *testing.T, dmg *DMG) {
+				dmg.Koly.Checksum[0]++
+			},
+			expected: ErrChecksumMismatch,
+		},
+		{
+			name: "corrupt bzip2 run",
+			modify: func(t *testing.T, dmg *DMG) {
+				// The first run of the first blkx resource is bzip2
+				// compressed, at the start of the data fork.
+				copy(dmg.Data, "corrupt")
+			},
+			expected: ErrBadRun,
+		},
+		{
+			name: "unsupported run",
+			modify: func(t *testing.T, dmg *DMG) {
+				modifyFirstRun(t, dmg, func(run *BLKXRun) { run.Type_ = 0x80000007 })
+			},
+			expected: ErrUnsupportedRun,
+		},
+		{
+			name: "run outside of the data fork",
+			modify: func(t *testing.T, dmg *DMG) {
+				modifyFirstRun(t, dmg, func(run *BLKXRun) { run.CompOffset = uint64(len(dmg.Data)) })
+			},
+			expected: ErrBadRun,
+		},
+		{
+			name: "run of the wrong size",
+			modify: func(t *testing.T, dmg *DMG) {
+				modifyFirstRun(t, dmg, func(run *BLKXRun) { run.Type_ = blkxRunRaw })
+			},
+			expected: ErrBadRun,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dmg := parseTestFile(t, "../testdata/attributable.dmg")
+			tc.modify(t, dmg)
+			if err := dmg.Verify(); !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+// modifyFirstRun modifies the first run of the first blkx resource of `dmg`.
+func modifyFirstRun(t *testing.T, dmg *DMG, modify func(run *BLKXRun)) {
+	blkx, err := dmg.Resources.GetResourceDataByName("blkx")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	container, err := ParseBlkxData(blkx[0].Data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	modify(&container.Runs[0])
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, container.Table)
+	binary.Write(buf, binary.BigEndian, container.Runs)
+	blkx[0].Data = buf.Bytes()
+	dmg.Resources.UpdateByName("blkx", blkx)
+}
@@ -13,83 +13,201 @@ import (
 )
 
 var (
-	ErrSentinelMissing        = errors.New("dmgmodify: sentinel value not found")
-	ErrBlkxResNotFound        = errors.New("dmgmodify: unable to find blkx resource to update")
-	ErrCodeTooLong            = errors.New("dmgmodify: attribution code is too long")
-	TAB                       = 0x9
-	NUL                       = 0x0
-	crcPolynomial      uint32 = 0xedb88320
-	dmgSentinel               = "__MOZCUSTOM__"
+	ErrSentinelMissing          = errors.New("dmgmodify: sentinel value not found")
+	ErrBlkxResNotFound          = errors.New("dmgmodify: unable to find blkx resource to update")
+	ErrCodeTooLong              = errors.New("dmgmodify: attribution code is too long")
+	ErrBadRawBlock              = errors.New("dmgmodify: attribution raw block is outside of the dmg")
+	ErrNotReattributable        = errors.New("dmgmodify: raw block does not match the attribution resource")
+	TAB                         = 0x9
+	NUL                         = 0x0
+	crcPolynomial        uint32 = 0xedb88320
+	dmgSentinel                 = "__MOZCUSTOM__"
 )
 
-// Update `dmg`, replacing the `sentinel` area with the provided `code`.
-// This function is a port of the C implementation from libdmg-hfsplus
-// (https://github.com/mozilla/libdmg-hfsplus/blob/a0a959bd25370c1c0a00c9ec525e3e78285adbf9/dmg/attribution.c#L209)
-// Note: We explicitly do _not_ update the Attribution resource here, as it is
-// not necessary, and makes for unnecessary work in the critical path of a
-// new Firefox install. This does not impact the attribution of the build, but
-// it does mean the build cannot be re-attributed later (which is not something
-// that ever needs to happen).
-func WriteAttributionCode(dmg *dmglib.DMG, code []byte) error {
-	// First, pull the information we need to update the attribution code.
-	// The blkx resource has some metadata that we need to update after
-	// injecting the attribution code.
-	blkxRes, err := dmg.Resources.GetResourceDataByName("blkx")
+// Option configures WriteAttributionCode.
+type Option func(*options)
+
+type options struct {
+	reattribution bool
+}
+
+// WithReattribution keeps the attributed DMG re-attributable: the attribution
+// area is padded with tabs rather than NULs, and the Attribution resource is
+// updated with the checksum of the new raw block. Attributing a DMG twice
+// gives the same DMG as attributing it once with the second code.
+func WithReattribution() Option {
+	return func(o *options) {
+		o.reattribution = true
+	}
+}
+
+// AttributionCapacity returns the number of bytes available for an
+// attribution code in `dmg`.
+func AttributionCapacity(dmg *dmglib.DMG) (int, error) {
+	_, codeOffset, paddingOffset, err := attributionArea(dmg)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	return paddingOffset - codeOffset, nil
+}
+
+// attributionArea locates the attribution area of `dmg`. The code is written
+// at `codeOffset` and the area ends at `paddingOffset`.
+func attributionArea(dmg *dmglib.DMG) (attr *dmglib.AttributionResource, codeOffset, paddingOffset int, err error) {
+	attr, codeOffset, err = locateSentinel(dmg)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	// The attribution area extends to all tabs AFTER the sentinel AND any
+	// existing attribution code. The simplest way to find this is to seek to
+	// the first tab, and then continue seeking until the next non-tab.
+	paddingOffset = codeOffset
+	// First, seek past any existing attribution data to the next tab.
+	for paddingOffset < len(dmg.Data) && dmg.Data[paddingOffset] != byte(TAB) {
+		if dmg.Data[paddingOffset] == byte(NUL) {
+			// The DMG was attributed without WithReattribution, so the
+			// padding is made of NULs.
+			paddingOffset, err = nulPaddedAreaEnd(dmg, attr, codeOffset, paddingOffset)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			return attr, codeOffset, paddingOffset, nil
+		}
+		paddingOffset += 1
+	}
+	// Now, seek past all subsequent tabs.
+	for paddingOffset < len(dmg.Data) && dmg.Data[paddingOffset] == byte(TAB) {
+		paddingOffset += 1
+	}
+
+	return attr, codeOffset, paddingOffset, nil
+}
+
+// nulPaddedAreaEnd returns the end of the attribution area of a DMG attributed
+// without WithReattribution, whose code at `codeOffset` is followed by NULs
+// from `nulOffset`. The Attribution resource still has the checksum of the raw
+// block as built, when the area was made of tabs: the area ends where filling
+// it with tabs gives back that checksum.
+func nulPaddedAreaEnd(dmg *dmglib.DMG, attr *dmglib.AttributionResource, codeOffset, nulOffset int) (int, error) {
+	rawPos, rawEnd := int(attr.RawPos), int(attr.RawPos+attr.RawLength)
+	if nulOffset > rawEnd {
+		return 0, ErrNotReattributable
+	}
+	nulEnd := nulOffset
+	for nulEnd < rawEnd && dmg.Data[nulEnd] == byte(NUL) {
+		nulEnd += 1
+	}
+
+	// Filling [codeOffset, end) with tabs XORs the raw block with the code
+	// XOR tabs, then tabs up to `end`. This XORs the CRC of the raw block with
+	// the CRC register, without conditioning, of these bytes followed by zeros
+	// up to the end of the raw block. Going down from `nulEnd`, each end
+	// removes one tab, which is shifted by one more zero than the previous.
+	register := func(r uint32, p []byte) uint32 {
+		return ^crc32.Update(^r, crcTable, p)
+	}
+	area := bytes.Repeat([]byte{byte(TAB)}, nulEnd-codeOffset)
+	for i, c := range dmg.Data[codeOffset:nulOffset] {
+		area[i] ^= c
+	}
+	zeros := make([]byte, rawEnd-nulEnd)
+	tabs := register(register(0, area), zeros)
+	tab := register(register(0, []byte{byte(TAB)}), zeros)
+	rawCrc := crc32.Checksum(dmg.Data[rawPos:rawEnd], crcTable)
+	for end := nulEnd; end >= nulOffset; end-- {
+		if rawCrc^tabs == attr.RawChecksum {
+			return end, nil
+		}
+		tabs ^= tab
+		tab = register(tab, []byte{byte(NUL)})
 	}
+	return 0, ErrNotReattributable
+}
 
+// locateSentinel returns the attribution metadata of `dmg`, and the offset
+// following the sentinel, where the attribution code starts.
+func locateSentinel(dmg *dmglib.DMG) (attr *dmglib.AttributionResource, codeOffset int, err error) {
 	// The plst resource contains some metadata that help us quickly
 	// locate the attribution data, and update the blkx and top level dmg
 	// metadata.
 	plstRes, err := dmg.Resources.GetResourceDataByName("plst")
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
-	attr, err := dmglib.ParseAttribution(plstRes[0].Name)
+	attr, err = dmglib.ParseAttribution(plstRes[0].Name)
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+	if attr.RawPos > uint64(len(dmg.Data)) || attr.RawLength > uint64(len(dmg.Data))-attr.RawPos {
+		return nil, 0, ErrBadRawBlock
 	}
 
 	// Find the offset of the sentinel string within the raw block, if exists
 	attrOffset := bytes.Index(dmg.Data[attr.RawPos:attr.RawPos+attr.RawLength], []byte(dmgSentinel))
 	if attrOffset == -1 {
-		return ErrSentinelMissing
+		return nil, 0, ErrSentinelMissing
 	}
-	// Finally, calculate the overall offset for the attribution area within `dmg.Data`
-	fullAttrOffset := int(attr.RawPos) + attrOffset
+	// Finally, calculate the overall offset for the attribution code within `dmg.Data`
+	return attr, int(attr.RawPos) + attrOffset + len(dmgSentinel), nil
+}
 
-	// Zero out the attribution area, which extends to all tabs AFTER the sentinel
-	// AND any existing attribution code. The simplest way to find this is to seek
-	// to the first tab, and then continue seeking until the next non-tab.
-	codeOffset := fullAttrOffset + len(dmgSentinel)
-	paddingOffset := codeOffset
-	// First, seek past any existing attribution data to the next tab,
-	// replacing any attribution data with nuls along the way.
-	for {
-		if dmg.Data[paddingOffset] == byte(TAB) {
-			break
-		}
-		dmg.Data[paddingOffset] = byte(NUL)
-		paddingOffset += 1
+// Update `dmg`, replacing the `sentinel` area with the provided `code`.
+// This function is a port of the C implementation from libdmg-hfsplus
+// (https://github.com/mozilla/libdmg-hfsplus/blob/a0a959bd25370c1c0a00c9ec525e3e78285adbf9/dmg/attribution.c#L209)
+// Note: By default, we explicitly do _not_ update the Attribution resource
+// here, as it is not necessary, and makes for unnecessary work in the critical
+// path of a new Firefox install. This does not impact the attribution of the
+// build. Such a build can still be re-attributed, with or without
+// WithReattribution: the NUL padded area is found from the checksum of the raw
+// block that the Attribution resource has kept, and the result is the same as
+// attributing the original build. ErrNotReattributable is returned when the
+// raw block does not match that checksum.
+func WriteAttributionCode(dmg *dmglib.DMG, code []byte, opts ...Option) error {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
 	}
-	// Now, replace all subsequent tabs with nuls to finish zeroing out the
-	// attribution area.
-	for {
-		if dmg.Data[paddingOffset] == byte(TAB) {
-			dmg.Data[paddingOffset] = byte(NUL)
-		} else {
-			break
-		}
-		paddingOffset += 1
+
+	// First, pull the information we need to update the attribution code.
+	// The blkx resource has some metadata that we need to update after
+	// injecting the attribution code.
+	blkxRes, err := dmg.Resources.GetResourceDataByName("blkx")
+	if err != nil {
+		return err
 	}
 
-	// Ensure the new code will fit in the attribution area
+	attr, codeOffset, paddingOffset, err := attributionArea(dmg)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the new code will fit in the attribution area before anything
+	// is written
 	if len(code) > paddingOffset-codeOffset {
 		return ErrCodeTooLong
 	}
 
+	// Zero out the attribution area, which extends to all tabs AFTER the sentinel
+	// AND any existing attribution code. Re-attributable DMGs are padded with
+	// tabs instead, so that the area can be found again.
+	padding := byte(NUL)
+	if o.reattribution {
+		// The checksum of a NUL padded area was already checked when the
+		// area was located.
+		if bytes.IndexByte(dmg.Data[codeOffset:paddingOffset], byte(NUL)) == -1 {
+			rawCrc := crc32.Checksum(dmg.Data[attr.RawPos:attr.RawPos+attr.RawLength], crcTable)
+			if rawCrc != attr.RawChecksum {
+				return ErrNotReattributable
+			}
+		}
+		padding = byte(TAB)
+	}
+	for i := codeOffset; i < paddingOffset; i++ {
+		dmg.Data[i] = padding
+	}
+
 	// Update the attribution area with the new attribution code
 	copy(dmg.Data[codeOffset:codeOffset+len(code)], code[:])
 
@@ -99,15 +217,66 @@ func WriteAttributionCode(dmg *dmglib.DMG, code []byte) error {
 		dmg.Data[attr.RawPos:attr.RawPos+attr.RawLength],
 		crc32.MakeTable(crcPolynomial),
 	)
-	// Calculate the new CRC values for the blkx checksum and Koly block checksum
-	// This is done by combining 3 separate CRCs:
-	// 1) The CRC of the data _prior_ to the block the attribution data is in.
-	//    This CRC comes from the attribution metadata in the plst resource.
-	// 2) The CRC of the block the attribution data is in, which we calculated
-	//    just above.
-	// 3) The CRC of the data _after_ the block the attribution data is in.
-	//    This CRC also comes from the attribution metadata.
-	newBlkxChecksum := crc32combine.CRC32Combine(
+	newBlkxChecksum, newDataChecksum := combineChecksums(attr, rawCrc)
+
+	if o.reattribution {
+		// Only the raw block changed, so the checksums of the data before
+		// and after it are still valid.
+		if err := updateAttributionResource(dmg, attr, rawCrc); err != nil {
+			return err
+		}
+	}
+
+	// At this point we've updated the raw attribution code in the dmg
+	// but the metadata (resources and checksums) are invalid, and need
+	// to be updated.
+
+	blkxIndex, err := attributableBlkx(blkxRes)
+	if err != nil {
+		return err
+	}
+
+	// Parse the blkx metadata into an updatable struct
+	blkx, err := dmglib.ParseBlkxData(blkxRes[blkxIndex].Data)
+	if err != nil {
+		return fmt.Errorf("dmgmodify: %w", err)
+	}
+
+	// Update its checksum
+	blkx.Table.Checksum.Data[0] = newBlkxChecksum
+
+	// Update the serialized version of the `blkx` metadata in the `blkxRes`.
+	blkxRes[blkxIndex].Data, err = encodeBlkx(blkx)
+	if err != nil {
+		return err
+	}
+
+	// Update the DMG's parsed and raw data with the new blkx resource data.
+	err = dmg.UpdateResource("blkx", blkxRes)
+	if err != nil {
+		return err
+	}
+
+	// Update the Koly block parsed and raw data as well
+	err = dmg.UpdateKolyBlock(newDataChecksum)
+	if err != nil {
+		return fmt.Errorf("WriteAttributionCode: %w", err)
+	}
+
+	// At this point we've inserted the new attribution data and updated all
+	// of the necessary metadata. Easy, right?!
+	return nil
+}
+
+// combineChecksums returns the blkx and data fork checksums of a DMG whose
+// raw block has the CRC `rawCrc`. This is done by combining 3 separate CRCs:
+//  1. The CRC of the data _prior_ to the block the attribution data is in.
+//     This CRC comes from the attribution metadata in the plst resource.
+//  2. The CRC of the block the attribution data is in.
+//  3. The CRC of the data _after_ the block the attribution data is in.
+//     This CRC also comes from the attribution metadata.
+func combineChecksums(attr *dmglib.AttributionResource, rawCrc uint32) (blkxChecksum, dataChecksum uint32) {
+	blkxChecksum = crc32combine.CRC32Combine(
 		crcPolynomial,
 		crc32combine.CRC32Combine(crcPolynomial,
 			attr.BeforeUncompressedChecksum,
@@ -117,7 +286,7 @@ func WriteAttributionCode(dmg *dmglib.DMG, code []byte) error {
 		attr.AfterUncompressedChecksum,
 		int64(attr.AfterUncompressedLength),
 	)
-	newDataChecksum := crc32combine.CRC32Combine(
+	dataChecksum = crc32combine.CRC32Combine(
 		crcPolynomial,
 		crc32combine.CRC32Combine(crcPolynomial,
 			attr.BeforeCompressedChecksum,
@@ -127,58 +296,52 @@ func WriteAttributionCode(dmg *dmglib.DMG, code []byte) error {
 		attr.AfterCompressedChecksum,
 		int64(attr.AfterCompressedLength),
 	)
+	return blkxChecksum, dataChecksum
+}
 
-	// At this point we've updated the raw attribution code in the dmg
-	// but the metadata (resources and checksums) are invalid, and need
-	// to be updated.
-
-	// First, we need to find the correct blkx resource. (We assume the first
-	// one with an HFS filesystem is the correct one.)
-	blkxIndex := -1
+// attributableBlkx returns the index of the blkx resource which contains the
+// attribution code. (We assume the first one with an HFS filesystem is the
+// correct one.)
+func attributableBlkx(blkxRes []dmglib.ResourceData) (int, error) {
 	for i, res := range blkxRes {
 		if strings.Contains(res.Name, "Apple_HFS") {
-			blkxIndex = i
-			break
+			return i, nil
 		}
 	}
-	if blkxIndex == -1 {
-		return ErrBlkxResNotFound
-	}
-
-	// Parse the blkx metadata into an updatable struct
-	blkx, err := dmglib.ParseBlkxData(blkxRes[blkxIndex].Data)
-	if err != nil {
-		return fmt.Errorf("dmgmodify: %w", err)
-	}
-
-	// Update its checksum
-	blkx.Table.Checksum.Data[0] = newBlkxChecksum
+	return -1, ErrBlkxResNotFound
+}
 
-	// Update the serialized version of the `blkx` metadata in the `blkxRes`.
+// encodeBlkx serializes `blkx` as the data of a blkx resource.
+func encodeBlkx(blkx *dmglib.BLKXContainer) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	err = binary.Write(buf, binary.BigEndian, blkx.Table)
+	err := binary.Write(buf, binary.BigEndian, blkx.Table)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = binary.Write(buf, binary.BigEndian, blkx.Runs)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	blkxRes[blkxIndex].Data = buf.Bytes()
+	return buf.Bytes(), nil
+}
 
-	// Update the DMG's parsed and raw data with the new blkx resource data.
-	err = dmg.UpdateResource("blkx", blkxRes)
+// updateAttributionResource updates the raw block checksum of the Attribution
+// resource in the plst resource of `dmg`. The resources are written to
+// `dmg.Data` with the blkx resource.
+func updateAttributionResource(dmg *dmglib.DMG, attr *dmglib.AttributionResource, rawCrc uint32) error {
+	plstRes, err := dmg.Resources.GetResourceDataByName("plst")
 	if err != nil {
 		return err
 	}
 
-	// Update the Koly block parsed and raw data as well
-	err = dmg.UpdateKolyBlock(newDataChecksum)
+	updated := *attr
+	updated.RawChecksum = rawCrc
+	encoded, err := updated.Encode()
 	if err != nil {
-		return fmt.Errorf("WriteAttributionCode: %w", err)
+		return err
 	}
+	plstRes[0].Name = encoded
+	dmg.Resources.UpdateByName("plst", plstRes)
 
-	// At this point we've inserted the new attribution data and updated all
-	// of the necessary metadata. Easy, right?!
 	return nil
 }
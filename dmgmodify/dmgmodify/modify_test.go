@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"hash/crc32"
 	"io"
 	"os"
 	"reflect"
@@ -53,6 +54,11 @@ func TestWriteAttributionCode(t *testing.T) {
 			t.Errorf("updated dmg is not the same as its source after being reparsed!")
 		}
 
+		// Verify the checksums of the updated dmg against its data.
+		if err := newDmg.Verify(); err != nil {
+			t.Errorf("updated dmg cannot be verified, got error: %s", err)
+		}
+
 		// Compare the hash against what we expect it to be
 		f, err := os.Open("../../testdata/attributed.dmg")
 		expectedHash := sha256.New()
@@ -88,12 +94,16 @@ func TestWriteAttributionCodeTooLong(t *testing.T) {
 	}
 
 	newCode := bytes.Repeat([]byte("Z"), 2000)
+	original := append([]byte(nil), dmg.Data...)
 
 	err = WriteAttributionCode(dmg, newCode)
 
 	if err != ErrCodeTooLong {
 		t.Errorf("expected ErrCodeTooLong, got: %s", err)
 	}
+	if !bytes.Equal(dmg.Data, original) {
+		t.Error("dmg was modified by a code which does not fit")
+	}
 }
 
 func TestWriteAttributionCodeSentinelMissing(t *testing.T) {
@@ -116,3 +126,152 @@ func TestWriteAttributionCodeSentinelMissing(t *testing.T) {
 		t.Errorf("expected ErrSentinelMissing, got: %s", err)
 	}
 }
+
+func TestAttributionCapacity(t *testing.T) {
+	file, err := dmglib.OpenFile("../../testdata/attributable.dmg")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer file.Close()
+
+	dmg, err := file.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	capacity, err := AttributionCapacity(dmg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if capacity <= 0 {
+		t.Fatalf("expected a positive capacity, got: %d", capacity)
+	}
+
+	// Each write needs a fresh copy: the padding is not restored after the
+	// code is written.
+	for length, expected := range map[int]error{capacity: nil, capacity + 1: ErrCodeTooLong} {
+		dmg, err := file.Parse()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := WriteAttributionCode(dmg, bytes.Repeat([]byte("Z"), length)); err != expected {
+			t.Errorf("writing %d bytes, expected: %v, got: %v", length, expected, err)
+		}
+	}
+}
+
+func TestWriteAttributionCodeReattribution(t *testing.T) {
+	once := parseTestDMG(t, "../../testdata/attributable.dmg")
+	if err := WriteAttributionCode(once, []byte("campaign%3Dsecond"), WithReattribution()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	twice := parseTestDMG(t, "../../testdata/attributable.dmg")
+	for _, code := range []string{"campaign%3Dfirst%26source%3Dlonger", "campaign%3Dsecond"} {
+		if err := WriteAttributionCode(twice, []byte(code), WithReattribution()); err != nil {
+			t.Fatalf("unexpected error writing %q: %s", code, err)
+		}
+	}
+	if !bytes.Equal(once.Data, twice.Data) {
+		t.Error("attributing twice does not match attributing once")
+	}
+
+	// Ensure the updated dmg can be parsed, and records the checksum of its
+	// raw block.
+	newDmg, err := dmglib.ParseDMG(bytes.NewReader(twice.Data))
+	if err != nil {
+		t.Fatalf("updated dmg data cannot be parsed, got error: %s", err)
+	}
+	if !reflect.DeepEqual(twice, newDmg) {
+		t.Errorf("updated dmg is not the same as its source after being reparsed!")
+	}
+	if err := newDmg.Verify(); err != nil {
+		t.Errorf("updated dmg cannot be verified, got error: %s", err)
+	}
+	plstRes, err := newDmg.Resources.GetResourceDataByName("plst")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	attr, err := dmglib.ParseAttribution(plstRes[0].Name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rawCrc := crc32.Checksum(newDmg.Data[attr.RawPos:attr.RawPos+attr.RawLength], crcTable); rawCrc != attr.RawChecksum {
+		t.Errorf("expected a raw checksum of %d, got: %d", rawCrc, attr.RawChecksum)
+	}
+
+	res, err := ReadAttributionCode(newDmg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.State != Attributed || res.Code != "campaign%3Dsecond" {
+		t.Errorf("expected the second code, got: %+v", res)
+	}
+
+}
+
+func TestWriteAttributionCodeNULPadded(t *testing.T) {
+	// DMGs attributed without WithReattribution, such as cached builds, give
+	// the same DMG as attributing the original build, in both modes.
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "default"},
+		{name: "reattribution", opts: []Option{WithReattribution()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fresh := parseTestDMG(t, "../../testdata/attributable.dmg")
+			if err := WriteAttributionCode(fresh, []byte("campaign%3Dsecond"), tc.opts...); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			for _, first := range []string{"", "campaign%3Dfirst%26source%3Dlonger", "c"} {
+				cached := parseTestDMG(t, "../../testdata/attributable.dmg")
+				if err := WriteAttributionCode(cached, []byte(first)); err != nil {
+					t.Fatalf("unexpected error writing %q: %s", first, err)
+				}
+				if err := WriteAttributionCode(cached, []byte("campaign%3Dsecond"), tc.opts...); err != nil {
+					t.Fatalf("unexpected error re-attributing %q: %s", first, err)
+				}
+				if !bytes.Equal(fresh.Data, cached.Data) {
+					t.Errorf("re-attributing %q does not match attributing the original dmg", first)
+				}
+			}
+
+			attributed := parseTestDMG(t, "../../testdata/attributed.dmg")
+			if err := WriteAttributionCode(attributed, []byte("campaign%3Dsecond"), tc.opts...); err != nil {
+				t.Fatalf("unexpected error re-attributing attributed.dmg: %s", err)
+			}
+			if !bytes.Equal(fresh.Data, attributed.Data) {
+				t.Error("re-attributing attributed.dmg does not match attributing the original dmg")
+			}
+		})
+	}
+
+	capacity, err := AttributionCapacity(parseTestDMG(t, "../../testdata/attributable.dmg"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	full := parseTestDMG(t, "../../testdata/attributable.dmg")
+	if err := WriteAttributionCode(full, bytes.Repeat([]byte("Z"), capacity)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c, err := AttributionCapacity(full); err != nil || c != capacity {
+		t.Errorf("expected a capacity of %d, got: %d, %v", capacity, c, err)
+	}
+
+	// The raw block of the attributed dmg must otherwise be unchanged.
+	modified := parseTestDMG(t, "../../testdata/attributable.dmg")
+	if err := WriteAttributionCode(modified, []byte("campaign%3Dfirst")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	attr, _, err := locateSentinel(modified)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	modified.Data[int(attr.RawPos)] ^= 0xff
+	if err := WriteAttributionCode(modified, []byte("campaign%3Dsecond")); err != ErrNotReattributable {
+		t.Errorf("expected ErrNotReattributable, got: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package dmgmodify
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/mozilla-services/stubattribution/dmglib"
+)
+
+// AttributionState tells whether the attribution area of a DMG contains an
+// attribution code.
+type AttributionState int
+
+const (
+	// AttributionEmpty means that the sentinel is directly followed by
+	// padding.
+	AttributionEmpty AttributionState = iota
+	// Attributed means that the sentinel is followed by an attribution code.
+	Attributed
+	// AttributionCorrupt means that the attribution area or the checksums
+	// which cover it are invalid. See AttributionCode.Reason.
+	AttributionCorrupt
+)
+
+func (s AttributionState) String() string {
+	switch s {
+	case AttributionEmpty:
+		return "empty"
+	case Attributed:
+		return "attributed"
+	case AttributionCorrupt:
+		return "corrupt"
+	}
+	return fmt.Sprintf("AttributionState(%d)", int(s))
+}
+
+// AttributionCode is the content of the attribution area of a DMG.
+type AttributionCode struct {
+	State AttributionState
+	// Code is the attribution code following the sentinel, up to the first
+	// NUL or tab. It is set for corrupt DMGs when it can be read.
+	Code string
+	// Offset is the offset of the code in the DMG.
+	Offset int
+	// Reason describes why the attribution area is corrupt.
+	Reason string
+}
+
+// ReadAttributionCode returns the attribution code of `dmg`, as written by
+// WriteAttributionCode or libdmg-hfsplus. An error is returned when `dmg`
+// does not have an attribution area.
+func ReadAttributionCode(dmg *dmglib.DMG) (*AttributionCode, error) {
+	attr, codeOffset, err := locateSentinel(dmg)
+	if err != nil {
+		return nil, err
+	}
+	res := &AttributionCode{Offset: codeOffset}
+	corrupt := func(format string, args ...interface{}) (*AttributionCode, error) {
+		res.State = AttributionCorrupt
+		res.Reason = fmt.Sprintf(format, args...)
+		return res, nil
+	}
+
+	// The code is terminated by the padding, which is made of tabs when the
+	// DMG is built, and of NULs once it is attributed.
+	rawEnd := int(attr.RawPos + attr.RawLength)
+	end := codeOffset
+	for end < rawEnd && dmg.Data[end] != byte(NUL) && dmg.Data[end] != byte(TAB) {
+		end++
+	}
+	if end == rawEnd {
+		return corrupt("attribution code is not terminated")
+	}
+	res.Code = string(dmg.Data[codeOffset:end])
+	for i, c := range dmg.Data[codeOffset:end] {
+		if c < 0x20 || c > 0x7e {
+			return corrupt("attribution code has a non-printable character at %d", codeOffset+i)
+		}
+	}
+
+	// The checksums must cover the attribution area as it is, otherwise the
+	// DMG cannot be mounted.
+	blkxChecksum, dataChecksum, err := storedChecksums(dmg)
+	if err != nil {
+		return nil, err
+	}
+	expectedBlkx, expectedData := combineChecksums(attr, crc32.Checksum(dmg.Data[attr.RawPos:rawEnd], crcTable))
+	if blkxChecksum != expectedBlkx {
+		return corrupt("blkx checksum is %08x, expected %08x", blkxChecksum, expectedBlkx)
+	}
+	if dataChecksum != expectedData {
+		return corrupt("data fork checksum is %08x, expected %08x", dataChecksum, expectedData)
+	}
+
+	if len(res.Code) == 0 {
+		res.State = AttributionEmpty
+	} else {
+		res.State = Attributed
+	}
+	return res, nil
+}
+
+// storedChecksums returns the checksums of `dmg` which WriteAttributionCode
+// updates: the checksum of the attributable blkx resource, and the data fork
+// checksum of the koly block.
+func storedChecksums(dmg *dmglib.DMG) (blkxChecksum, dataChecksum uint32, err error) {
+	blkxRes, err := dmg.Resources.GetResourceDataByName("blkx")
+	if err != nil {
+		return 0, 0, err
+	}
+	blkxIndex, err := attributableBlkx(blkxRes)
+	if err != nil {
+		return 0, 0, err
+	}
+	blkx, err := dmglib.ParseBlkxData(blkxRes[blkxIndex].Data)
+	if err != nil {
+		return 0, 0, fmt.Errorf("dmgmodify: %w", err)
+	}
+	if blkx.Table.Checksum.Type_ != udifCRC32 || dmg.Koly.DataChecksumType != udifCRC32 {
+		return 0, 0, fmt.Errorf("dmgmodify: unsupported checksum types: %d, %d", blkx.Table.Checksum.Type_, dmg.Koly.DataChecksumType)
+	}
+	return blkx.Table.Checksum.Data[0], dmg.Koly.DataChecksum[0], nil
+}
@@ -0,0 +1,99 @@
+package dmgmodify
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadAttributionCode(t *testing.T) {
+	for _, tc := range []struct {
+		testfile string
+		state    AttributionState
+		code     string
+	}{
+		{testfile: "../../testdata/attributable.dmg", state: AttributionEmpty},
+		{testfile: "../../testdata/attributed.dmg", state: Attributed, code: "updated attribution code"},
+		// The existing code was added without updating the checksums.
+		{testfile: "../../testdata/attributable-with-existing-data.dmg", state: AttributionCorrupt, code: "dlsource%3Dmozillaci"},
+	} {
+		t.Run(tc.testfile, func(t *testing.T) {
+			res, err := ReadAttributionCode(parseTestDMG(t, tc.testfile))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if res.State != tc.state {
+				t.Errorf("expected state %s, got: %s (%s)", tc.state, res.State, res.Reason)
+			}
+			if res.Code != tc.code {
+				t.Errorf("expected code %q, got: %q", tc.code, res.Code)
+			}
+		})
+	}
+
+	t.Run("written code", func(t *testing.T) {
+		dmg := parseTestDMG(t, "../../testdata/attributable.dmg")
+		if err := WriteAttributionCode(dmg, []byte("campaign%3Dtest")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		res, err := ReadAttributionCode(dmg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if res.State != Attributed || res.Code != "campaign%3Dtest" {
+			t.Errorf("expected the written code, got: %+v", res)
+		}
+		if string(dmg.Data[res.Offset-len(dmgSentinel):res.Offset]) != dmgSentinel {
+			t.Errorf("offset %d does not follow the sentinel", res.Offset)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			modify func(data []byte, offset int)
+			reason string
+		}{
+			{
+				name:   "modified code",
+				modify: func(data []byte, offset int) { data[offset] = 'x' },
+				reason: "blkx checksum",
+			},
+			{
+				name:   "non-printable code",
+				modify: func(data []byte, offset int) { data[offset] = 0x01 },
+				reason: "non-printable character",
+			},
+			{
+				name: "unterminated code",
+				modify: func(data []byte, offset int) {
+					// Fill the rest of the raw block of attributed.dmg.
+					for i := offset; i < 280+262144; i++ {
+						data[i] = 'x'
+					}
+				},
+				reason: "not terminated",
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				dmg := parseTestDMG(t, "../../testdata/attributed.dmg")
+				res, err := ReadAttributionCode(dmg)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				tc.modify(dmg.Data, res.Offset)
+
+				res, err = ReadAttributionCode(dmg)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if res.State != AttributionCorrupt || !strings.Contains(res.Reason, tc.reason) {
+					t.Errorf("expected a corrupt state because of %q, got: %+v", tc.reason, res)
+				}
+			})
+		}
+	})
+
+	if _, err := ReadAttributionCode(parseTestDMG(t, "../../testdata/empty.dmg")); err != ErrSentinelMissing {
+		t.Errorf("expected ErrSentinelMissing, got: %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package dmgmodify
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/mozilla-services/stubattribution/dmglib"
+	"github.com/vimeo/go-util/crc32combine"
+)
+
+const (
+	// udifCRC32 is the UDIF checksum type of CRC32 checksums.
+	udifCRC32 = 2
+
+	// blkxChecksumOffset is the offset of the first word of the checksum
+	// in the data of a blkx resource.
+	blkxChecksumOffset = 72
+
+	// kolyDataChecksumOffset and kolyChecksumOffset are the offsets of the
+	// first words of the data fork and overall checksums in the koly block.
+	kolyDataChecksumOffset = 88
+	kolyChecksumOffset     = 360
+)
+
+var (
+	crcTable = crc32.MakeTable(crcPolynomial)
+
+	errBlkxChecksumNotFound = errors.New("dmgmodify: unable to locate the blkx checksum in the property list")
+)
+
+// Patch replaces the bytes of a DMG at Offset with Data. It has the same
+// fields as stubmodify.Patch, so patches can be served with a
+// stubmodify.PatchedFile.
+type Patch struct {
+	Offset int
+	Data   []byte
+}
+
+// Template is a DMG prepared for attribution. It records everything
+// WriteAttributionCode computes from the DMG which does not depend on the
+// attribution code, so that attributing the DMG only takes a CRC over the
+// attribution area and a few byte writes.
+//
+// A Template does not keep a reference to the data of the DMG.
+type Template struct {
+	// The attribution area is [codeOffset, paddingOffset). rawBeforeCrc is
+	// the CRC of the raw block before it.
+	codeOffset    int
+	paddingOffset int
+	rawBeforeCrc  uint32
+
+	// rawCrc returns the CRC of the raw block from the CRC of the raw
+	// block up to the end of the attribution area, and blkxChecksum and
+	// dataChecksum return the checksums from the CRC of the raw block.
+	rawCrc       *affineCrc
+	blkxChecksum *affineCrc
+	dataChecksum *affineCrc
+
+	// xml is the property list as WriteAttributionCode writes it, at
+	// xmlOffset. blkxQuanta are the 6 bytes of the attributable blkx
+	// resource starting at its checksum, and blkxChars the offsets in xml
+	// of the 8 base64 characters encoding them.
+	xmlOffset  int
+	xml        []byte
+	blkxQuanta []byte
+	blkxChars  [8]int
+
+	// blkxChecksums are the checksums of the blkx resources which the
+	// overall checksum is computed from, and blkxIndex the index of the
+	// attributable one, or -1 when it is not included.
+	blkxChecksums []byte
+	blkxIndex     int
+
+	// koly is the koly block, at kolyOffset.
+	kolyOffset int
+	koly       []byte
+}
+
+// NewTemplate returns the template of `dmg`, which is not modified.
+func NewTemplate(dmg *dmglib.DMG) (*Template, error) {
+	blkxRes, err := dmg.Resources.GetResourceDataByName("blkx")
+	if err != nil {
+		return nil, err
+	}
+	attr, codeOffset, paddingOffset, err := attributionArea(dmg)
+	if err != nil {
+		return nil, err
+	}
+	rawEnd := int(attr.RawPos + attr.RawLength)
+	if paddingOffset > rawEnd {
+		return nil, errors.New("dmgmodify: attribution area extends past its raw block")
+	}
+
+	rawAfterCrc := crc32.Checksum(dmg.Data[paddingOffset:rawEnd], crcTable)
+	t := &Template{
+		codeOffset:    codeOffset,
+		paddingOffset: paddingOffset,
+		rawBeforeCrc:  crc32.Checksum(dmg.Data[attr.RawPos:codeOffset], crcTable),
+		rawCrc: newAffineCrc(func(crc uint32) uint32 {
+			return crc32combine.CRC32Combine(crcPolynomial, crc, rawAfterCrc, int64(rawEnd-paddingOffset))
+		}),
+		blkxChecksum: newAffineCrc(func(crc uint32) uint32 {
+			blkxChecksum, _ := combineChecksums(attr, crc)
+			return blkxChecksum
+		}),
+		dataChecksum: newAffineCrc(func(crc uint32) uint32 {
+			_, dataChecksum := combineChecksums(attr, crc)
+			return dataChecksum
+		}),
+		xmlOffset:  int(dmg.Koly.XMLOffset),
+		blkxIndex:  -1,
+		kolyOffset: len(dmg.Data) - binary.Size(dmglib.KolyBlock{}),
+	}
+	if t.overlaps(t.xmlOffset, t.xmlOffset+int(dmg.Koly.XMLLength)) || t.overlaps(t.kolyOffset, len(dmg.Data)) {
+		return nil, errors.New("dmgmodify: attribution area overlaps the DMG metadata")
+	}
+
+	blkxIndex, err := attributableBlkx(blkxRes)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.prepareResources(dmg, blkxRes, blkxIndex); err != nil {
+		return nil, err
+	}
+
+	// The overall checksum only includes the CRC32 blkx checksums.
+	for i, res := range blkxRes {
+		blkx, err := dmglib.ParseBlkxData(res.Data)
+		if err != nil {
+			return nil, fmt.Errorf("dmgmodify: %w", err)
+		}
+		checksum := make([]byte, 4)
+		if blkx.Table.Checksum.Type_ == udifCRC32 {
+			binary.BigEndian.PutUint32(checksum, blkx.Table.Checksum.Data[0])
+			if i == blkxIndex {
+				t.blkxIndex = i
+			}
+		}
+		t.blkxChecksums = append(t.blkxChecksums, checksum...)
+	}
+
+	// Let UpdateKolyBlock set the checksum types of a copy of the koly block.
+	koly := *dmg.Koly
+	scratch := &dmglib.DMG{
+		Koly:      &koly,
+		Resources: dmg.Resources,
+		Data:      make([]byte, len(dmg.Data)-t.kolyOffset),
+	}
+	if err := scratch.UpdateKolyBlock(0); err != nil {
+		return nil, err
+	}
+	t.koly = scratch.Data
+
+	return t, nil
+}
+
+// prepareResources encodes the property list as WriteAttributionCode
+// writes it, and locates the checksum of the attributable blkx resource in
+// it. The property list is encoded with two checksums which differ in every
+// bit, and the blkx resource is the <data> element where they differ.
+func (t *Template) prepareResources(dmg *dmglib.DMG, blkxRes []dmglib.ResourceData, blkxIndex int) error {
+	blkx, err := dmglib.ParseBlkxData(blkxRes[blkxIndex].Data)
+	if err != nil {
+		return fmt.Errorf("dmgmodify: %w", err)
+	}
+
+	var encoded [2][]byte
+	var xml [2][]byte
+	for i, checksum := range []uint32{0, 0xffffffff} {
+		blkx.Table.Checksum.Data[0] = checksum
+		if encoded[i], err = encodeBlkx(blkx); err != nil {
+			return err
+		}
+
+		entries := make(map[string][]dmglib.ResourceData, len(dmg.Resources.Entries))
+		for name, res := range dmg.Resources.Entries {
+			entries[name] = res
+		}
+		res := append([]dmglib.ResourceData(nil), blkxRes...)
+		res[blkxIndex].Data = encoded[i]
+		entries["blkx"] = res
+
+		scratch := &dmglib.DMG{Koly: dmg.Koly, Resources: &dmglib.Resources{Entries: entries}}
+		if xml[i], err = scratch.EncodeResources(); err != nil {
+			return err
+		}
+	}
+
+	diff := 0
+	for diff < len(xml[0]) && xml[0][diff] == xml[1][diff] {
+		diff++
+	}
+	start := bytes.LastIndex(xml[0][:diff], []byte("<data>"))
+	if diff == len(xml[0]) || start == -1 || len(encoded[0]) < blkxChecksumOffset+6 {
+		return errBlkxChecksumNotFound
+	}
+
+	// Each group of 3 bytes is encoded as 4 characters, and the checksum
+	// starts a group.
+	first := blkxChecksumOffset / 3 * 4
+	n := 0
+	found := 0
+	for offset := start + len("<data>"); offset < len(xml[0]) && found < len(t.blkxChars); offset++ {
+		c := xml[0][offset]
+		if c == '<' {
+			break
+		}
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			continue
+		}
+		if n >= first {
+			t.blkxChars[found] = offset
+			found++
+		}
+		n++
+	}
+	if found != len(t.blkxChars) {
+		return errBlkxChecksumNotFound
+	}
+	for i := range xml {
+		chars := base64.StdEncoding.EncodeToString(encoded[i][blkxChecksumOffset : blkxChecksumOffset+6])
+		for j, offset := range t.blkxChars {
+			if xml[i][offset] != chars[j] {
+				return errBlkxChecksumNotFound
+			}
+		}
+	}
+
+	t.xml = xml[0]
+	t.blkxQuanta = encoded[0][blkxChecksumOffset : blkxChecksumOffset+6]
+	return nil
+}
+
+// overlaps returns true when the attribution area overlaps [start, end).
+func (t *Template) overlaps(start, end int) bool {
+	return t.codeOffset < end && t.paddingOffset > start
+}
+
+// Capacity returns the number of bytes available for an attribution code,
+// as AttributionCapacity does.
+func (t *Template) Capacity() int {
+	return t.paddingOffset - t.codeOffset
+}
+
+// Patches returns the patches which write `code` to the DMG the template was
+// created from. The DMG with the patches applied is the same as the one
+// written by WriteAttributionCode without WithReattribution. The patches
+// share data with the template and must not be modified.
+func (t *Template) Patches(code []byte) ([]Patch, error) {
+	// Ensure the new code will fit in the attribution area
+	if len(code) > t.Capacity() {
+		return nil, ErrCodeTooLong
+	}
+
+	// The attribution area is zeroed out before the code is written.
+	area := make([]byte, t.Capacity())
+	copy(area, code)
+
+	rawCrc := t.rawCrc.apply(crc32.Update(t.rawBeforeCrc, crcTable, area))
+	newBlkxChecksum := t.blkxChecksum.apply(rawCrc)
+	newDataChecksum := t.dataChecksum.apply(rawCrc)
+
+	// Only the base64 characters encoding the blkx checksum change in the
+	// property list.
+	quanta := make([]byte, len(t.blkxQuanta))
+	copy(quanta, t.blkxQuanta)
+	binary.BigEndian.PutUint32(quanta, newBlkxChecksum)
+	chars := make([]byte, base64.StdEncoding.EncodedLen(len(quanta)))
+	base64.StdEncoding.Encode(chars, quanta)
+
+	first, last := t.blkxChars[0], t.blkxChars[len(t.blkxChars)-1]+1
+	xml := make([]byte, last-first)
+	copy(xml, t.xml[first:last])
+	for i, offset := range t.blkxChars {
+		xml[offset-first] = chars[i]
+	}
+
+	checksums := make([]byte, len(t.blkxChecksums))
+	copy(checksums, t.blkxChecksums)
+	if t.blkxIndex != -1 {
+		binary.BigEndian.PutUint32(checksums[t.blkxIndex*4:], newBlkxChecksum)
+	}
+	koly := make([]byte, len(t.koly))
+	copy(koly, t.koly)
+	binary.BigEndian.PutUint32(koly[kolyDataChecksumOffset:], newDataChecksum)
+	binary.BigEndian.PutUint32(koly[kolyChecksumOffset:], crc32.Checksum(checksums, crcTable))
+
+	return []Patch{
+		{Offset: t.codeOffset, Data: area},
+		{Offset: t.xmlOffset, Data: t.xml[:first]},
+		{Offset: t.xmlOffset + first, Data: xml},
+		{Offset: t.xmlOffset + last, Data: t.xml[last:]},
+		{Offset: t.kolyOffset, Data: koly},
+	}, nil
+}
+
+// affineCrc is a function of a CRC which is affine over GF(2), such as
+// combining the CRC with the CRC of following data. It is computed from the
+// bits of the CRC, which is much faster than combining CRCs.
+type affineCrc struct {
+	constant uint32
+	columns  [32]uint32
+}
+
+func newAffineCrc(f func(crc uint32) uint32) *affineCrc {
+	a := &affineCrc{constant: f(0)}
+	for i := range a.columns {
+		a.columns[i] = f(1<<i) ^ a.constant
+	}
+	return a
+}
+
+func (a *affineCrc) apply(crc uint32) uint32 {
+	result := a.constant
+	for i := range a.columns {
+		if crc&(1<<i) != 0 {
+			result ^= a.columns[i]
+		}
+	}
+	return result
+}
+
+// ApplyPatches returns a copy of `data` with `patches` applied.
+func ApplyPatches(data []byte, patches []Patch) []byte {
+	modBytes := make([]byte, len(data))
+	copy(modBytes, data)
+	for _, patch := range patches {
+		copy(modBytes[patch.Offset:], patch.Data)
+	}
+	return modBytes
+}
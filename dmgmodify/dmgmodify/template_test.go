@@ -0,0 +1,104 @@
+package dmgmodify
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/mozilla-services/stubattribution/dmglib"
+)
+
+func parseTestDMG(tb testing.TB, name string) *dmglib.DMG {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		tb.Fatalf("unexpected error: %s", err)
+	}
+	dmg, err := dmglib.ParseDMG(bytes.NewReader(data))
+	if err != nil {
+		tb.Fatalf("unexpected error: %s", err)
+	}
+	return dmg
+}
+
+func BenchmarkWriteAttributionCode(b *testing.B) {
+	data, err := os.ReadFile("../../testdata/attributable.dmg")
+	if err != nil {
+		b.Fatalf("unexpected error: %s", err)
+	}
+	code := []byte("updated attribution code")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dmg, err := dmglib.ParseDMG(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := WriteAttributionCode(dmg, code); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTemplatePatches(b *testing.B) {
+	template, err := NewTemplate(parseTestDMG(b, "../../testdata/attributable.dmg"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	code := []byte("updated attribution code")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := template.Patches(code); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	for _, testfile := range []string{
+		"../../testdata/attributable.dmg",
+		"../../testdata/attributable-with-existing-data.dmg",
+	} {
+		t.Run(testfile, func(t *testing.T) {
+			dmg := parseTestDMG(t, testfile)
+			original := append([]byte(nil), dmg.Data...)
+
+			template, err := NewTemplate(dmg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(dmg.Data, original) {
+				t.Fatal("NewTemplate modified the dmg")
+			}
+			capacity, err := AttributionCapacity(dmg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if template.Capacity() != capacity {
+				t.Errorf("expected a capacity of %d, got: %d", capacity, template.Capacity())
+			}
+
+			for _, code := range []string{"", "updated attribution code", string(bytes.Repeat([]byte("Z"), capacity))} {
+				patches, err := template.Patches([]byte(code))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				expected := parseTestDMG(t, testfile)
+				if err := WriteAttributionCode(expected, []byte(code)); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if !bytes.Equal(ApplyPatches(original, patches), expected.Data) {
+					t.Errorf("patches writing %q do not match WriteAttributionCode", code)
+				}
+			}
+
+			if _, err := template.Patches(make([]byte, capacity+1)); err != ErrCodeTooLong {
+				t.Errorf("expected ErrCodeTooLong, got: %v", err)
+			}
+		})
+	}
+
+	if _, err := NewTemplate(parseTestDMG(t, "../../testdata/empty.dmg")); err != ErrSentinelMissing {
+		t.Errorf("expected ErrSentinelMissing, got: %v", err)
+	}
+}
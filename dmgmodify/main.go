@@ -34,5 +34,11 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Check that the attributed DMG is consistent before writing it.
+	err = dmgObj.Verify()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	output.Write(dmgObj.Data)
 }
@@ -0,0 +1,333 @@
+// Package testpki builds certificates, PKCS#7 signatures and signed PE files
+// for tests.
+package testpki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var (
+	OIDData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	OIDSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	OIDSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	OIDECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	OIDContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	OIDMessageDigest    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	OIDSigningTime      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	OIDCounterSignature = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 6}
+	OIDTimestampToken   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+	OIDTSTInfo          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+
+	OIDSpcIndirectDataContent = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	OIDSpcPEImageData         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	OIDNestedSignature        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 4, 1}
+)
+
+// DER encodes an element with the identifier octet id.
+func DER(id byte, contents ...[]byte) []byte {
+	content := bytes.Join(contents, nil)
+	if len(content) < 0x80 {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	var octets []byte
+	for n := len(content); n > 0; n >>= 8 {
+		octets = append([]byte{byte(n)}, octets...)
+	}
+	header := append([]byte{id, 0x80 | byte(len(octets))}, octets...)
+	return append(header, content...)
+}
+
+// OID encodes an OBJECT IDENTIFIER.
+func OID(oid asn1.ObjectIdentifier) []byte {
+	b, err := asn1.Marshal(oid)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Attribute returns a PKCS#7 attribute with the given DER encoded values.
+func Attribute(oid asn1.ObjectIdentifier, values ...[]byte) []byte {
+	return DER(0x30, OID(oid), DER(0x31, values...))
+}
+
+// Signer is a certificate and its private key.
+type Signer struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// NewSigner returns a certificate for template issued by parent, or a
+// self-signed one when parent is nil.
+func NewSigner(t testing.TB, template *x509.Certificate, parent *Signer) *Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, issuerKey := template, key
+	if parent != nil {
+		issuer, issuerKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Signer{Cert: cert, Key: key}
+}
+
+// Unauthenticated returns the unauthenticated attributes of a SignerInfo
+// whose signature is signature, e.g. a timestamp of the signature.
+type Unauthenticated func(t testing.TB, signature []byte) [][]byte
+
+// SignerInfo returns a SignerInfo of s over content, signed with ECDSA and
+// SHA-256. The messageDigest of content is appended to the authenticated
+// attributes. The unauthenticated attributes are added unless unauth is nil.
+func (s *Signer) SignerInfo(t testing.TB, content []byte, attributes [][]byte, unauth Unauthenticated) []byte {
+	digest := sha256.Sum256(content)
+	attributes = append(attributes, Attribute(OIDMessageDigest, DER(0x04, digest[:])))
+	signed := sha256.Sum256(DER(0x31, attributes...))
+	signature, err := ecdsa.SignASN1(rand.Reader, s.Key, signed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := asn1.Marshal(s.Cert.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var unauthenticatedAttributes []byte
+	if unauth != nil {
+		unauthenticatedAttributes = DER(0xa1, unauth(t, signature)...)
+	}
+	return DER(0x30,
+		DER(0x02, []byte{1}),
+		DER(0x30, s.Cert.RawIssuer, serial),
+		DER(0x30, OID(OIDSHA256)),
+		DER(0xa0, attributes...),
+		DER(0x30, OID(OIDECDSAWithSHA256)),
+		DER(0x04, signature),
+		unauthenticatedAttributes,
+	)
+}
+
+// CounterSignature returns an Authenticode countersignature by s at the given
+// time. The certificates of s must be included in the signature.
+func (s *Signer) CounterSignature(at time.Time) Unauthenticated {
+	return func(t testing.TB, signature []byte) [][]byte {
+		signingTime, err := asn1.Marshal(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return [][]byte{Attribute(OIDCounterSignature, s.SignerInfo(t, signature, [][]byte{
+			Attribute(OIDContentType, OID(OIDData)),
+			Attribute(OIDSigningTime, signingTime),
+		}, nil))}
+	}
+}
+
+// TimestampToken returns an RFC 3161 timestamp token by s at the given time,
+// which includes certs.
+func (s *Signer) TimestampToken(at time.Time, certs ...*x509.Certificate) Unauthenticated {
+	return func(t testing.TB, signature []byte) [][]byte {
+		genTime, err := asn1.MarshalWithParams(at, "generalized")
+		if err != nil {
+			t.Fatal(err)
+		}
+		imprint := sha256.Sum256(signature)
+		info := DER(0x30,
+			DER(0x02, []byte{1}),
+			OID(asn1.ObjectIdentifier{1, 2, 3, 4}),
+			DER(0x30, DER(0x30, OID(OIDSHA256)), DER(0x04, imprint[:])),
+			DER(0x02, []byte{5}),
+			genTime,
+		)
+		signerInfo := s.SignerInfo(t, info, [][]byte{Attribute(OIDContentType, OID(OIDTSTInfo))}, nil)
+		return [][]byte{Attribute(OIDTimestampToken,
+			SignedData(OIDTSTInfo, DER(0x04, info), Raw(append(certs, s.Cert)...), signerInfo),
+		)}
+	}
+}
+
+// Nested returns an unauthenticated attribute containing the nested
+// Authenticode signature contentInfo.
+func Nested(contentInfo []byte) Unauthenticated {
+	return func(t testing.TB, signature []byte) [][]byte {
+		return [][]byte{Attribute(OIDNestedSignature, contentInfo)}
+	}
+}
+
+// Raw returns the DER encoding of certs.
+func Raw(certs ...*x509.Certificate) [][]byte {
+	var raw [][]byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw)
+	}
+	return raw
+}
+
+// SignedData returns a ContentInfo containing SignedData with the given
+// content, DER encoded certificates and signer infos. The content is left
+// out when it is nil.
+func SignedData(contentType asn1.ObjectIdentifier, content []byte, certs [][]byte, signerInfos ...[]byte) []byte {
+	var explicitContent []byte
+	if content != nil {
+		explicitContent = DER(0xa0, content)
+	}
+	return DER(0x30,
+		OID(OIDSignedData),
+		DER(0xa0, DER(0x30,
+			DER(0x02, []byte{1}),
+			DER(0x31, DER(0x30, OID(OIDSHA256))),
+			DER(0x30, OID(contentType), explicitContent),
+			DER(0xa0, certs...),
+			DER(0x31, signerInfos...),
+		)),
+	)
+}
+
+// Authenticode returns a ContentInfo containing an Authenticode signature by
+// s of a file whose SHA-256 Authenticode digest is digest, which includes
+// certs.
+func (s *Signer) Authenticode(t testing.TB, digest []byte, certs []*x509.Certificate, unauth Unauthenticated) []byte {
+	spcContents := [][]byte{
+		DER(0x30, OID(OIDSpcPEImageData)),
+		DER(0x30, DER(0x30, OID(OIDSHA256)), DER(0x04, digest)),
+	}
+	signerInfo := s.SignerInfo(t, bytes.Join(spcContents, nil),
+		[][]byte{Attribute(OIDContentType, OID(OIDSpcIndirectDataContent))},
+		unauth,
+	)
+	return SignedData(OIDSpcIndirectDataContent, DER(0x30, spcContents...), Raw(certs...), signerInfo)
+}
+
+// Entry returns a certificate table entry containing contentInfo.
+func Entry(contentInfo []byte) []byte {
+	length := 8 + len(contentInfo)
+	entry := make([]byte, (length+7)&^7)
+	binary.LittleEndian.PutUint32(entry[0:4], uint32(length))
+	binary.LittleEndian.PutUint16(entry[4:6], 0x200)
+	binary.LittleEndian.PutUint16(entry[6:8], 2) // WIN_CERT_TYPE_PKCS_SIGNED_DATA
+	copy(entry[8:], contentInfo)
+	return entry
+}
+
+// PEHeaderSize is the size of the headers of the files returned by PE, which
+// are followed by the certificate table.
+const PEHeaderSize = 0x160
+
+// PE returns a minimal PE32+ file whose certificate table contains table.
+func PE(table []byte) []byte {
+	const (
+		peHeaderOffset       = 0x80
+		optionalHeaderOffset = peHeaderOffset + 24
+		certDirEntryOffset   = optionalHeaderOffset + 144
+	)
+	mapped := make([]byte, PEHeaderSize+len(table))
+	copy(mapped, "MZ")
+	binary.LittleEndian.PutUint32(mapped[0x3C:0x40], peHeaderOffset)
+	binary.LittleEndian.PutUint16(mapped[optionalHeaderOffset:], 0x20b)
+	binary.LittleEndian.PutUint32(mapped[certDirEntryOffset:], PEHeaderSize)
+	binary.LittleEndian.PutUint32(mapped[certDirEntryOffset+4:], uint32(len(table)))
+	copy(mapped[PEHeaderSize:], table)
+	return mapped
+}
+
+// DigestFunc computes the Authenticode digest of a PE file, e.g.
+// stubmodify.AuthenticodeDigest.
+type DigestFunc func(mapped []byte) ([]byte, error)
+
+// SignPE returns a PE file signed by s, which includes certs. The
+// certificate table is not covered by the digest.
+func (s *Signer) SignPE(t testing.TB, digest DigestFunc, certs []*x509.Certificate, unauth Unauthenticated) []byte {
+	d, err := digest(PE(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PE(Entry(s.Authenticode(t, d, certs, unauth)))
+}
+
+// PKI is a root, an intermediate, a code signing and a time stamping
+// certificate valid from notBefore to notAfter.
+type PKI struct {
+	Root, Intermediate, Leaf, TSA *Signer
+}
+
+// NewPKI returns a PKI valid from notBefore to notAfter. The subject of its
+// leaf is "CN=Test Signer,O=Test".
+func NewPKI(t testing.TB, notBefore, notAfter time.Time) *PKI {
+	root := NewSigner(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             notBefore.Add(-time.Hour),
+		NotAfter:              notAfter.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	intermediate := NewSigner(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Test Intermediate"},
+		NotBefore:             notBefore.Add(-time.Hour),
+		NotAfter:              notAfter.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, root)
+	leaf := NewSigner(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "Test Signer", Organization: []string{"Test"}},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, intermediate)
+	tsa := NewSigner(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}, intermediate)
+	return &PKI{Root: root, Intermediate: intermediate, Leaf: leaf, TSA: tsa}
+}
+
+// Roots returns a pool containing the root of p.
+func (p *PKI) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.Root.Cert)
+	return pool
+}
+
+// Certificates returns the intermediate, leaf and time stamping certificates
+// of p, which are included in its signatures.
+func (p *PKI) Certificates() []*x509.Certificate {
+	return []*x509.Certificate{p.Intermediate.Cert, p.Leaf.Cert, p.TSA.Cert}
+}
+
+// Authenticode returns a ContentInfo containing an Authenticode signature by
+// the leaf of p of a file whose SHA-256 Authenticode digest is digest.
+func (p *PKI) Authenticode(t testing.TB, digest []byte, unauth Unauthenticated) []byte {
+	return p.Leaf.Authenticode(t, digest, p.Certificates(), unauth)
+}
+
+// SignPE returns a PE file signed by the leaf of p.
+func (p *PKI) SignPE(t testing.TB, digest DigestFunc, unauth Unauthenticated) []byte {
+	return p.Leaf.SignPE(t, digest, p.Certificates(), unauth)
+}
@@ -0,0 +1,341 @@
+// stubmodify reads and writes the attribution code of signed Windows
+// installers.
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mozilla-services/stubattribution/stubmodify/stubmodify"
+)
+
+// Exit statuses. Each kind of failure has its own status, so that scripts
+// can tell them apart.
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+	exitIO
+	exitInvalidPE
+	exitNotAttributable
+	exitCodeTooLong
+	exitNoCode
+	exitDigestChanged
+	exitCodeMismatch
+)
+
+const usage = `Usage:
+  stubmodify write [options] input.exe output.exe code
+  stubmodify read [options] input.exe
+  stubmodify verify [options] original.exe modified.exe [code]
+  stubmodify info input.exe
+
+Options:
+  -signature index  use the placeholders of the index-th signature listed by info
+  -all-signatures   use the placeholders of every signature
+  -checksum         update the CheckSum field (write only)
+
+Exit statuses:
+  1  unexpected error
+  2  invalid arguments
+  3  a file cannot be read or written
+  4  the input is not a valid PE file
+  5  the input is not signed or has no attribution placeholder
+  6  the code does not fit in the placeholder
+  7  the input does not contain an attribution code
+  8  the Authenticode digest changed
+  9  the code read back is not the expected one
+`
+
+// exitError is an error with the status the command exits with.
+type exitError struct {
+	status int
+	err    error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func fail(status int, format string, args ...interface{}) error {
+	return &exitError{status, fmt.Errorf(format, args...)}
+}
+
+// stubError wraps an error returned by stubmodify with the matching status.
+func stubError(err error) error {
+	switch {
+	case errors.Is(err, stubmodify.ErrNotSigned), errors.Is(err, stubmodify.ErrNoTag):
+		return &exitError{exitNotAttributable, err}
+	case errors.Is(err, stubmodify.ErrEmptyCode), errors.Is(err, stubmodify.ErrPlaceholdersDisagree):
+		return &exitError{exitNoCode, err}
+	case errors.Is(err, stubmodify.ErrDigestChanged):
+		return &exitError{exitDigestChanged, err}
+	}
+	return &exitError{exitInvalidPE, err}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the subcommand named by args[0] and returns the exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 1 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	commands := map[string]func(args []string, stdout io.Writer) error{
+		"write":  write,
+		"read":   read,
+		"verify": verify,
+		"info":   info,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	if err := command(args[1:], stdout); err != nil {
+		status := exitFailure
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			status = exitErr.status
+		}
+		if status == exitUsage {
+			fmt.Fprintf(stderr, "%s\n\n%s", err, usage)
+		} else {
+			fmt.Fprintf(stderr, "stubmodify %s: %s\n", args[0], err)
+		}
+		return status
+	}
+	return exitOK
+}
+
+// newFlagSet returns the flags of a subcommand. The signature flags select
+// the placeholders as the stubmodify options do.
+func newFlagSet(name string, opts *[]stubmodify.Option) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	if opts == nil {
+		return flags
+	}
+
+	flags.Func("signature", "use the placeholders of the `index`-th signature", func(value string) error {
+		var i int
+		if _, err := fmt.Sscan(value, &i); err != nil || i < 0 {
+			return fmt.Errorf("invalid signature index: %s", value)
+		}
+		*opts = append(*opts, stubmodify.WithSignature(i))
+		return nil
+	})
+	flags.BoolFunc("all-signatures", "use the placeholders of every signature", func(string) error {
+		*opts = append(*opts, stubmodify.WithAllSignatures())
+		return nil
+	})
+	return flags
+}
+
+// parseArgs parses the flags and returns the positional arguments, of which
+// there must be between min and max.
+func parseArgs(flags *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, &exitError{exitUsage, err}
+	}
+	if flags.NArg() < min || flags.NArg() > max {
+		return nil, fail(exitUsage, "%s: wrong number of arguments", flags.Name())
+	}
+	return flags.Args(), nil
+}
+
+func readFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, &exitError{exitIO, err}
+	}
+	return data, nil
+}
+
+func write(args []string, stdout io.Writer) error {
+	var opts []stubmodify.Option
+	flags := newFlagSet("write", &opts)
+	checksum := flags.Bool("checksum", false, "update the CheckSum field")
+	args, err := parseArgs(flags, args, 3, 3)
+	if err != nil {
+		return err
+	}
+	if *checksum {
+		opts = append(opts, stubmodify.WithChecksum())
+	}
+
+	input, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+	code := []byte(args[2])
+
+	capacity, err := stubmodify.AttributionCapacity(input, opts...)
+	if err != nil {
+		return stubError(err)
+	}
+	if limit := stubmodify.MaxLength - len(stubmodify.MozTag); capacity > limit {
+		capacity = limit
+	}
+	if len(code) > capacity {
+		return fail(exitCodeTooLong, "code is %d bytes long, only %d bytes are available", len(code), capacity)
+	}
+
+	output, err := stubmodify.WriteAttributionCode(input, code, opts...)
+	if err != nil {
+		return stubError(err)
+	}
+	if err := os.WriteFile(args[1], output, 0644); err != nil {
+		return &exitError{exitIO, err}
+	}
+	return nil
+}
+
+func read(args []string, stdout io.Writer) error {
+	var opts []stubmodify.Option
+	args, err := parseArgs(newFlagSet("read", &opts), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	input, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+	code, err := stubmodify.ReadAttributionCode(input, opts...)
+	if err != nil {
+		return stubError(err)
+	}
+	_, err = fmt.Fprintln(stdout, code.Raw)
+	return err
+}
+
+func verify(args []string, stdout io.Writer) error {
+	var opts []stubmodify.Option
+	args, err := parseArgs(newFlagSet("verify", &opts), args, 2, 3)
+	if err != nil {
+		return err
+	}
+
+	original, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+	modified, err := readFile(args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := stubmodify.VerifyUnchanged(original, modified); err != nil {
+		return stubError(err)
+	}
+	code, err := stubmodify.ReadAttributionCode(modified, opts...)
+	if err != nil {
+		return stubError(err)
+	}
+	if len(args) == 3 && code.Raw != args[2] {
+		return fail(exitCodeMismatch, "read %q, expected %q", code.Raw, args[2])
+	}
+	_, err = fmt.Fprintln(stdout, code.Raw)
+	return err
+}
+
+func info(args []string, stdout io.Writer) error {
+	args, err := parseArgs(newFlagSet("info", nil), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	input, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	// What was found is printed even when a later part of the file is
+	// invalid. Write errors are returned by Flush.
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	err = printInfo(w, input)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// printInfo prints the layout, certificate table and placeholders of input.
+func printInfo(w io.Writer, input []byte) error {
+	layout, err := stubmodify.ParseLayout(input)
+	if err != nil {
+		return stubError(err)
+	}
+
+	format := "PE32"
+	if layout.PE32Plus {
+		format = "PE32+"
+	}
+	fmt.Fprintf(w, "Format:\t%s\n", format)
+	fmt.Fprintf(w, "Size:\t%d\n", len(input))
+	checksum, err := stubmodify.Checksum(input)
+	if err != nil {
+		return stubError(err)
+	}
+	fmt.Fprintf(w, "CheckSum:\t0x%08x at %d (computed: 0x%08x)\n", layout.CheckSum, layout.CheckSumOffset, checksum)
+	fmt.Fprintf(w, "Certificate directory entry:\t%d\n", layout.CertDirEntryOffset)
+	if layout.CertTableSize == 0 {
+		fmt.Fprintf(w, "Certificate table:\tnone\n")
+		return nil
+	}
+	fmt.Fprintf(w, "Certificate table:\t%d-%d (%d bytes)\n", layout.CertTableOffset, layout.CertTableOffset+layout.CertTableSize, layout.CertTableSize)
+	digest, err := stubmodify.AuthenticodeDigest(input)
+	if err != nil {
+		return stubError(err)
+	}
+	fmt.Fprintf(w, "Authenticode digest:\tsha256:%x\n", digest)
+
+	certs, err := stubmodify.ParseCertificateTable(input)
+	if err != nil {
+		return stubError(err)
+	}
+	for i, cert := range certs {
+		fmt.Fprintf(w, "Entry %d:\t%d-%d, revision 0x%04x, type %d\n", i, cert.Offset, cert.Offset+int(cert.Length), cert.Revision, cert.CertificateType)
+	}
+
+	sigs, err := stubmodify.Signatures(input)
+	if err != nil {
+		return stubError(err)
+	}
+	for i, sig := range sigs {
+		signer := "unknown"
+		if len(sig.SignedData.SignerInfos) > 0 {
+			if cert, err := sig.SignedData.SignerCertificate(sig.SignedData.SignerInfos[0]); err == nil {
+				signer = signerName(cert)
+			}
+		}
+		fmt.Fprintf(w, "Signature %d:\tentry %d, depth %d, %d certificates, signed by %s\n", i, sig.Entry, sig.Depth, len(sig.SignedData.Certificates), signer)
+		for _, placeholder := range sig.SignedData.Placeholders {
+			code := input[placeholder.Offset+len(stubmodify.MozTag) : placeholder.Offset+len(stubmodify.MozTag)+placeholder.Capacity]
+			if end := bytes.IndexByte(code, 0); end != -1 {
+				code = code[:end]
+			}
+			fmt.Fprintf(w, "  Placeholder:\t%d, %d bytes available, code %q\n", placeholder.Offset, placeholder.Capacity, code)
+		}
+	}
+	return nil
+}
+
+func signerName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/stubattribution/internal/testpki"
+	"github.com/mozilla-services/stubattribution/stubmodify/stubmodify"
+)
+
+// failingWriter fails every write, like a closed pipe.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestRun(t *testing.T) {
+	original, err := os.ReadFile("../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("could not read test-stub.exe", err)
+	}
+	attributed, err := stubmodify.WriteAttributionCode(original, []byte("campaign%3Dtest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The placeholder of test-stub.exe is filled with static data, which is
+	// cleared.
+	certs, err := stubmodify.ParseCertificateTable(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeholder := certs[0].SignedData.Placeholders[0]
+	empty := append([]byte(nil), original...)
+	start := placeholder.Offset + len(stubmodify.MozTag)
+	copy(empty[start:start+placeholder.Capacity], make([]byte, placeholder.Capacity))
+
+	// A byte covered by the Authenticode digest is changed.
+	tampered := append([]byte(nil), attributed...)
+	tampered[0x400] ^= 0xff
+
+	now := time.Now()
+	pki := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"original.exe":       original,
+		"attributed.exe":     attributed,
+		"tampered.exe":       tampered,
+		"empty.exe":          empty,
+		"unsigned.exe":       testpki.PE(nil),
+		"no-placeholder.exe": pki.SignPE(t, stubmodify.AuthenticodeDigest, nil),
+		"not-pe.exe":         []byte("not a PE file"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	for _, test := range []struct {
+		name   string
+		args   []string
+		stdout string
+		status int
+	}{
+		{"write", []string{"write", file("original.exe"), file("written.exe"), "campaign%3Dtest"}, "", exitOK},
+		{"write -checksum", []string{"write", "-checksum", file("original.exe"), file("checksum.exe"), "campaign%3Dtest"}, "", exitOK},
+		{"read", []string{"read", file("attributed.exe")}, "campaign%3Dtest\n", exitOK},
+		{"read -signature", []string{"read", "-signature", "0", file("attributed.exe")}, "campaign%3Dtest\n", exitOK},
+		{"read -all-signatures", []string{"read", "-all-signatures", file("attributed.exe")}, "campaign%3Dtest\n", exitOK},
+		{"verify", []string{"verify", file("original.exe"), file("attributed.exe")}, "campaign%3Dtest\n", exitOK},
+		{"verify code", []string{"verify", file("original.exe"), file("attributed.exe"), "campaign%3Dtest"}, "campaign%3Dtest\n", exitOK},
+		{"no command", nil, "", exitUsage},
+		{"unknown command", []string{"attribute", file("original.exe")}, "", exitUsage},
+		{"unknown flag", []string{"read", "-output", file("attributed.exe")}, "", exitUsage},
+		{"invalid signature index", []string{"read", "-signature", "-1", file("attributed.exe")}, "", exitUsage},
+		{"missing argument", []string{"write", file("original.exe"), file("written.exe")}, "", exitUsage},
+		{"extra argument", []string{"info", file("original.exe"), file("attributed.exe")}, "", exitUsage},
+		{"missing input", []string{"read", file("missing.exe")}, "", exitIO},
+		{"unwritable output", []string{"write", file("original.exe"), file("missing/written.exe"), "campaign%3Dtest"}, "", exitIO},
+		{"not a PE file", []string{"info", file("not-pe.exe")}, "", exitInvalidPE},
+		{"unsigned", []string{"write", file("unsigned.exe"), file("written.exe"), "campaign%3Dtest"}, "", exitNotAttributable},
+		{"no placeholder", []string{"write", file("no-placeholder.exe"), file("written.exe"), "campaign%3Dtest"}, "", exitNotAttributable},
+		{"code too long", []string{"write", file("original.exe"), file("written.exe"), strings.Repeat("a", stubmodify.MaxLength)}, "", exitCodeTooLong},
+		{"no code", []string{"read", file("empty.exe")}, "", exitNoCode},
+		{"digest changed", []string{"verify", file("original.exe"), file("tampered.exe")}, "", exitDigestChanged},
+		{"code mismatch", []string{"verify", file("original.exe"), file("attributed.exe"), "campaign%3Dother"}, "", exitCodeMismatch},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+			if status := run(test.args, stdout, stderr); status != test.status {
+				t.Errorf("status: %d, expected %d (stderr: %s)", status, test.status, stderr)
+			}
+			if stdout.String() != test.stdout {
+				t.Errorf("stdout: %q, expected %q", stdout, test.stdout)
+			}
+			if test.status != exitOK && stderr.Len() == 0 {
+				t.Error("nothing was written to stderr")
+			}
+		})
+	}
+
+	t.Run("written", func(t *testing.T) {
+		written, err := os.ReadFile(file("written.exe"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written, attributed) {
+			t.Error("write did not write the same file as WriteAttributionCode")
+		}
+	})
+
+	t.Run("info", func(t *testing.T) {
+		stdout := new(bytes.Buffer)
+		if status := run([]string{"info", file("original.exe")}, stdout, new(bytes.Buffer)); status != exitOK {
+			t.Fatalf("status: %d, expected %d", status, exitOK)
+		}
+		for _, line := range []string{"Format:", "Certificate table:", "Entry 0:", "Signature 0:", "Placeholder:"} {
+			if !strings.Contains(stdout.String(), line) {
+				t.Errorf("%q is missing from:\n%s", line, stdout)
+			}
+		}
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"read", file("attributed.exe")},
+			{"info", file("original.exe")},
+		} {
+			if status := run(args, failingWriter{}, new(bytes.Buffer)); status != exitFailure {
+				t.Errorf("%s: status %d, expected %d", args[0], status, exitFailure)
+			}
+		}
+	})
+}
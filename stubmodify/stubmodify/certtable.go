@@ -0,0 +1,651 @@
+package stubmodify
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// winCertTypePKCSSignedData is the WIN_CERTIFICATE type of Authenticode
+// signatures.
+const winCertTypePKCSSignedData = 2
+
+var (
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	// oidNestedSignature identifies the unauthenticated attributes containing
+	// nested signatures (SPC_NESTED_SIGNATURE_OBJID).
+	oidNestedSignature = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 4, 1}
+
+	// oidMozAttribution identifies the certificate extensions and
+	// unauthenticated attributes reserved for the attribution code. Their
+	// value is an OCTET STRING starting with MozTag.
+	oidMozAttribution = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 13769, 666, 666, 666, 9999, 1}
+)
+
+var (
+	// ErrUnexpectedTag is returned when MozTag appears in the certificate
+	// table outside of an attribution placeholder.
+	ErrUnexpectedTag = errors.New("mapped contains MozTag outside of an attribution placeholder")
+	// ErrNoSignerCertificate is returned when SignedData does not contain the
+	// certificate of a signer.
+	ErrNoSignerCertificate = errors.New("signer certificate not found")
+)
+
+// WinCertificate is an entry of the certificate table.
+type WinCertificate struct {
+	// Offset is the offset of the entry in the file.
+	Offset          int
+	Length          uint32
+	Revision        uint16
+	CertificateType uint16
+
+	// SignedData is set for Authenticode signatures.
+	SignedData *SignedData
+}
+
+// SignedData is a PKCS#7 SignedData structure.
+type SignedData struct {
+	// ContentType and Content are the type and the DER encoding of the
+	// signed content, e.g. SpcIndirectDataContent for Authenticode. Content
+	// is nil when the content is detached.
+	ContentType asn1.ObjectIdentifier
+	Content     []byte
+
+	// Certificates are the DER encoded certificates, which can be parsed
+	// with x509.ParseCertificate.
+	Certificates [][]byte
+	SignerInfos  []*SignerInfo
+
+	// Placeholders are the areas reserved for the attribution code in
+	// certificate extensions and unauthenticated attributes. The
+	// placeholders of nested signatures are not included.
+	Placeholders []Placeholder
+}
+
+// SignerInfo is a PKCS#7 SignerInfo structure.
+type SignerInfo struct {
+	// Issuer is the DER encoded issuer name of the signer certificate.
+	Issuer       []byte
+	SerialNumber *big.Int
+
+	DigestAlgorithm asn1.ObjectIdentifier
+
+	// AuthenticatedAttributes are nil when the signature is computed over
+	// the content itself. RawAuthenticatedAttributes is their DER encoding
+	// as a SET OF, which is what the signature is computed over otherwise.
+	AuthenticatedAttributes    []*Attribute
+	RawAuthenticatedAttributes []byte
+
+	DigestEncryptionAlgorithm asn1.ObjectIdentifier
+	EncryptedDigest           []byte
+
+	UnauthenticatedAttributes []*Attribute
+
+	// Nested are the signatures nested in the unauthenticated attributes,
+	// e.g. a SHA-256 signature nested in a SHA-1 one.
+	Nested []*SignedData
+}
+
+// SignerCertificate returns the certificate of signer. Certificates which
+// cannot be parsed are skipped.
+func (s *SignedData) SignerCertificate(signer *SignerInfo) (*x509.Certificate, error) {
+	for _, raw := range s.Certificates {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(cert.RawIssuer, signer.Issuer) && cert.SerialNumber.Cmp(signer.SerialNumber) == 0 {
+			return cert, nil
+		}
+	}
+	return nil, ErrNoSignerCertificate
+}
+
+// Attribute is a PKCS#7 attribute.
+type Attribute struct {
+	Type asn1.ObjectIdentifier
+	// Values are the DER encoded values of the attribute.
+	Values [][]byte
+}
+
+// Placeholder is an area of the certificate table reserved for the
+// attribution code.
+type Placeholder struct {
+	// Offset is the offset of MozTag in the file.
+	Offset int
+	// Capacity is the number of bytes available after MozTag.
+	Capacity int
+}
+
+// ParseCertificateTable parses the certificate table of a signed PE file.
+func ParseCertificateTable(mapped []byte) ([]*WinCertificate, error) {
+	certTableOffset, certTableSize, err := certTable(mapped)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificateTable(mapped, certTableOffset, certTableOffset+certTableSize)
+}
+
+func parseCertificateTable(mapped []byte, offset, end int) ([]*WinCertificate, error) {
+	byteOrder := binary.LittleEndian
+
+	var certs []*WinCertificate
+	// Entries are aligned on 8 bytes. Anything shorter than a header at the
+	// end of the table is padding.
+	for offset+8 <= end {
+		cert := &WinCertificate{
+			Offset:          offset,
+			Length:          byteOrder.Uint32(mapped[offset : offset+4]),
+			Revision:        byteOrder.Uint16(mapped[offset+4 : offset+6]),
+			CertificateType: byteOrder.Uint16(mapped[offset+6 : offset+8]),
+		}
+		if cert.Length < 8 || int(cert.Length) > end-offset {
+			return nil, fmt.Errorf("certificate table entry at %d has an invalid length: %d", offset, cert.Length)
+		}
+
+		if cert.CertificateType == winCertTypePKCSSignedData {
+			contentInfo, err := parseDER(mapped, offset+8, offset+int(cert.Length))
+			if err != nil {
+				return nil, err
+			}
+			if cert.SignedData, err = parseContentInfo(mapped, contentInfo); err != nil {
+				return nil, err
+			}
+		}
+
+		certs = append(certs, cert)
+		offset += (int(cert.Length) + 7) &^ 7
+	}
+
+	return certs, nil
+}
+
+// parseContentInfo parses a PKCS#7 ContentInfo containing SignedData.
+func parseContentInfo(b []byte, e derElement) (*SignedData, error) {
+	elems, err := children(b, e)
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) != 2 || !elems[1].is(classContext, 0) {
+		return nil, fmt.Errorf("ContentInfo at %d is malformed", e.offset)
+	}
+	contentType, err := parseOID(b, elems[0])
+	if err != nil {
+		return nil, err
+	}
+	if !contentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("ContentInfo at %d has an unsupported content type: %s", e.offset, contentType)
+	}
+
+	content, err := children(b, elems[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(content) != 1 || !content[0].is(classUniversal, tagSequence) {
+		return nil, fmt.Errorf("ContentInfo at %d is malformed", e.offset)
+	}
+	return parseSignedData(b, content[0])
+}
+
+// parseSignedData parses:
+//
+//	SignedData ::= SEQUENCE {
+//		version INTEGER,
+//		digestAlgorithms SET OF AlgorithmIdentifier,
+//		contentInfo ContentInfo,
+//		certificates [0] IMPLICIT SET OF Certificate OPTIONAL,
+//		crls [1] IMPLICIT SET OF CertificateList OPTIONAL,
+//		signerInfos SET OF SignerInfo }
+func parseSignedData(b []byte, e derElement) (*SignedData, error) {
+	elems, err := children(b, e)
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) < 4 || !elems[len(elems)-1].is(classUniversal, tagSet) {
+		return nil, fmt.Errorf("SignedData at %d is malformed", e.offset)
+	}
+
+	signedData := new(SignedData)
+
+	// ContentInfo ::= SEQUENCE { contentType OBJECT IDENTIFIER, content [0] EXPLICIT ANY OPTIONAL }
+	contentInfo, err := children(b, elems[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(contentInfo) == 0 || len(contentInfo) > 2 {
+		return nil, fmt.Errorf("SignedData at %d has a malformed content", e.offset)
+	}
+	if signedData.ContentType, err = parseOID(b, contentInfo[0]); err != nil {
+		return nil, err
+	}
+	if len(contentInfo) == 2 {
+		content, err := children(b, contentInfo[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(content) != 1 {
+			return nil, fmt.Errorf("SignedData at %d has a malformed content", e.offset)
+		}
+		signedData.Content = b[content[0].offset:content[0].end()]
+	}
+
+	for _, elem := range elems[3 : len(elems)-1] {
+		if !elem.is(classContext, 0) {
+			continue
+		}
+		certs, err := children(b, elem)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certs {
+			signedData.Certificates = append(signedData.Certificates, b[cert.offset:cert.end()])
+			placeholders, err := certificatePlaceholders(b, cert)
+			if err != nil {
+				return nil, err
+			}
+			signedData.Placeholders = append(signedData.Placeholders, placeholders...)
+		}
+	}
+
+	signerInfos, err := children(b, elems[len(elems)-1])
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range signerInfos {
+		signerInfo, placeholders, err := parseSignerInfo(b, elem)
+		if err != nil {
+			return nil, err
+		}
+		signedData.SignerInfos = append(signedData.SignerInfos, signerInfo)
+		signedData.Placeholders = append(signedData.Placeholders, placeholders...)
+	}
+
+	return signedData, nil
+}
+
+// certificatePlaceholders returns the placeholders in the extensions of an
+// X.509 certificate. Only the path to the extensions is parsed.
+func certificatePlaceholders(b []byte, e derElement) ([]Placeholder, error) {
+	elems, err := children(b, e)
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 || !elems[0].is(classUniversal, tagSequence) {
+		return nil, fmt.Errorf("certificate at %d is malformed", e.offset)
+	}
+	tbsCertificate, err := children(b, elems[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var placeholders []Placeholder
+	for _, elem := range tbsCertificate {
+		if !elem.is(classContext, 3) {
+			continue
+		}
+		wrapped, err := children(b, elem)
+		if err != nil {
+			return nil, err
+		}
+		if len(wrapped) != 1 {
+			return nil, fmt.Errorf("certificate extensions at %d are malformed", elem.offset)
+		}
+		extensions, err := children(b, wrapped[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, extension := range extensions {
+			// Extension ::= SEQUENCE { extnID, critical BOOLEAN OPTIONAL, extnValue OCTET STRING }
+			fields, err := children(b, extension)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("certificate extension at %d is malformed", extension.offset)
+			}
+			extnID, err := parseOID(b, fields[0])
+			if err != nil {
+				return nil, err
+			}
+			placeholder, ok, err := parsePlaceholder(b, extnID, fields[len(fields)-1])
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				placeholders = append(placeholders, placeholder)
+			}
+		}
+	}
+	return placeholders, nil
+}
+
+// parseSignerInfo parses:
+//
+//	SignerInfo ::= SEQUENCE {
+//		version INTEGER,
+//		issuerAndSerialNumber IssuerAndSerialNumber,
+//		digestAlgorithm AlgorithmIdentifier,
+//		authenticatedAttributes [0] IMPLICIT Attributes OPTIONAL,
+//		digestEncryptionAlgorithm AlgorithmIdentifier,
+//		encryptedDigest OCTET STRING,
+//		unauthenticatedAttributes [1] IMPLICIT Attributes OPTIONAL }
+func parseSignerInfo(b []byte, e derElement) (*SignerInfo, []Placeholder, error) {
+	elems, err := children(b, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(elems) < 5 {
+		return nil, nil, fmt.Errorf("SignerInfo at %d is malformed", e.offset)
+	}
+
+	// IssuerAndSerialNumber ::= SEQUENCE { issuer Name, serialNumber INTEGER }
+	issuerAndSerial, err := children(b, elems[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(issuerAndSerial) != 2 {
+		return nil, nil, fmt.Errorf("SignerInfo at %d is malformed", e.offset)
+	}
+	issuer, serial := issuerAndSerial[0], issuerAndSerial[1]
+	signerInfo := &SignerInfo{
+		Issuer: b[issuer.offset:issuer.end()],
+	}
+	if _, err := asn1.Unmarshal(b[serial.offset:serial.end()], &signerInfo.SerialNumber); err != nil {
+		return nil, nil, fmt.Errorf("SignerInfo at %d: %v", e.offset, err)
+	}
+	if signerInfo.DigestAlgorithm, err = parseAlgorithm(b, elems[2]); err != nil {
+		return nil, nil, err
+	}
+
+	i := 3
+	if elems[i].is(classContext, 0) {
+		if signerInfo.AuthenticatedAttributes, err = parseAttributes(b, elems[i]); err != nil {
+			return nil, nil, err
+		}
+		// The signature is computed over the EXPLICIT SET OF encoding.
+		signerInfo.RawAuthenticatedAttributes = derEncode(0x31, b[elems[i].start():elems[i].end()])
+		i++
+	}
+	if len(elems) < i+2 || !elems[i+1].is(classUniversal, tagOctetString) {
+		return nil, nil, fmt.Errorf("SignerInfo at %d is malformed", e.offset)
+	}
+	if signerInfo.DigestEncryptionAlgorithm, err = parseAlgorithm(b, elems[i]); err != nil {
+		return nil, nil, err
+	}
+	signerInfo.EncryptedDigest = b[elems[i+1].start():elems[i+1].end()]
+
+	var placeholders []Placeholder
+	if last := elems[len(elems)-1]; last.is(classContext, 1) {
+		attrs, err := children(b, last)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, elem := range attrs {
+			attrType, values, err := parseAttribute(b, elem)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			attr := &Attribute{Type: attrType}
+			for _, value := range values {
+				attr.Values = append(attr.Values, b[value.offset:value.end()])
+				if attrType.Equal(oidNestedSignature) {
+					nested, err := parseContentInfo(b, value)
+					if err != nil {
+						return nil, nil, err
+					}
+					signerInfo.Nested = append(signerInfo.Nested, nested)
+					continue
+				}
+				placeholder, ok, err := parsePlaceholder(b, attrType, value)
+				if err != nil {
+					return nil, nil, err
+				}
+				if ok {
+					placeholders = append(placeholders, placeholder)
+				}
+			}
+			signerInfo.UnauthenticatedAttributes = append(signerInfo.UnauthenticatedAttributes, attr)
+		}
+	}
+
+	return signerInfo, placeholders, nil
+}
+
+// parseAttribute parses:
+//
+//	Attribute ::= SEQUENCE { type OBJECT IDENTIFIER, values SET OF ANY }
+func parseAttribute(b []byte, e derElement) (asn1.ObjectIdentifier, []derElement, error) {
+	fields, err := children(b, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fields) != 2 || !fields[1].is(classUniversal, tagSet) {
+		return nil, nil, fmt.Errorf("attribute at %d is malformed", e.offset)
+	}
+	attrType, err := parseOID(b, fields[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := children(b, fields[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return attrType, values, nil
+}
+
+// parseAttributes parses a SET OF Attribute.
+func parseAttributes(b []byte, e derElement) ([]*Attribute, error) {
+	elems, err := children(b, e)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([]*Attribute, 0, len(elems))
+	for _, elem := range elems {
+		attrType, values, err := parseAttribute(b, elem)
+		if err != nil {
+			return nil, err
+		}
+		attr := &Attribute{Type: attrType}
+		for _, value := range values {
+			attr.Values = append(attr.Values, b[value.offset:value.end()])
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+// parseAlgorithm returns the algorithm of:
+//
+//	AlgorithmIdentifier ::= SEQUENCE { algorithm OBJECT IDENTIFIER, parameters ANY OPTIONAL }
+func parseAlgorithm(b []byte, e derElement) (asn1.ObjectIdentifier, error) {
+	fields, err := children(b, e)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("AlgorithmIdentifier at %d is malformed", e.offset)
+	}
+	return parseOID(b, fields[0])
+}
+
+// parsePlaceholder returns the placeholder in value when oid identifies an
+// attribution placeholder.
+func parsePlaceholder(b []byte, oid asn1.ObjectIdentifier, value derElement) (Placeholder, bool, error) {
+	if !oid.Equal(oidMozAttribution) {
+		return Placeholder{}, false, nil
+	}
+	if !value.is(classUniversal, tagOctetString) || value.constructed {
+		return Placeholder{}, false, fmt.Errorf("attribution placeholder at %d is not an OCTET STRING", value.offset)
+	}
+	if !bytes.HasPrefix(b[value.start():value.end()], []byte(MozTag)) {
+		return Placeholder{}, false, fmt.Errorf("attribution placeholder at %d does not start with %s", value.offset, MozTag)
+	}
+	return Placeholder{
+		Offset:   value.start(),
+		Capacity: value.length - len(MozTag),
+	}, true, nil
+}
+
+// Signature is an Authenticode signature of the certificate table.
+type Signature struct {
+	// Entry is the index of the certificate table entry containing the
+	// signature.
+	Entry int
+	// Depth is 0 for the signature of an entry, and 1 for signatures
+	// nested in it, and so on.
+	Depth      int
+	SignedData *SignedData
+}
+
+// Signatures returns every Authenticode signature of a signed PE file,
+// nested ones included. Each signature is followed by its nested
+// signatures.
+func Signatures(mapped []byte) ([]*Signature, error) {
+	certs, err := ParseCertificateTable(mapped)
+	if err != nil {
+		return nil, err
+	}
+	return signatures(certs), nil
+}
+
+func signatures(certs []*WinCertificate) []*Signature {
+	var sigs []*Signature
+	var walk func(entry, depth int, signedData *SignedData)
+	walk = func(entry, depth int, signedData *SignedData) {
+		sigs = append(sigs, &Signature{Entry: entry, Depth: depth, SignedData: signedData})
+		for _, signerInfo := range signedData.SignerInfos {
+			for _, nested := range signerInfo.Nested {
+				walk(entry, depth+1, nested)
+			}
+		}
+	}
+	for i, cert := range certs {
+		if cert.SignedData != nil {
+			walk(i, 0, cert.SignedData)
+		}
+	}
+	return sigs
+}
+
+// Option selects the placeholders used by WriteAttributionCode,
+// ReadAttributionCode and AttributionCapacity. By default, the first
+// placeholder of the certificate table is used.
+type Option func(*options)
+
+type options struct {
+	signature     int
+	allSignatures bool
+	checksum      bool
+}
+
+// WithSignature selects the placeholders of the i-th signature returned by
+// Signatures.
+func WithSignature(i int) Option {
+	return func(o *options) {
+		o.signature = i
+	}
+}
+
+// WithAllSignatures selects every placeholder of every signature.
+// WriteAttributionCode writes the same code to all of them, and
+// ReadAttributionCode fails with ErrPlaceholdersDisagree unless they all
+// contain the same code.
+func WithAllSignatures() Option {
+	return func(o *options) {
+		o.allSignatures = true
+	}
+}
+
+// WithChecksum makes WriteAttributionCode update the CheckSum field of the
+// optional header. The CheckSum is not part of the Authenticode digest, so
+// the signature stays valid. Other functions ignore it.
+func WithChecksum() Option {
+	return func(o *options) {
+		o.checksum = true
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{signature: -1}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// findPlaceholders returns the attribution placeholders selected by opts.
+// MozTag must not appear anywhere else in the certificate table.
+func findPlaceholders(mapped []byte, opts *options) ([]Placeholder, error) {
+	certTableOffset, certTableSize, err := certTable(mapped)
+	if err != nil {
+		return nil, err
+	}
+	start, end := certTableOffset, certTableOffset+certTableSize
+
+	certs, err := parseCertificateTable(mapped, start, end)
+	if err != nil {
+		return nil, err
+	}
+	sigs := signatures(certs)
+
+	known := make(map[int]bool)
+	var all []Placeholder
+	for _, sig := range sigs {
+		for _, placeholder := range sig.SignedData.Placeholders {
+			known[placeholder.Offset] = true
+			all = append(all, placeholder)
+		}
+	}
+
+	tag := []byte(MozTag)
+	for offset := start; ; {
+		i := bytes.Index(mapped[offset:end], tag)
+		if i == -1 {
+			break
+		}
+		if !known[offset+i] {
+			return nil, ErrUnexpectedTag
+		}
+		offset += i + len(tag)
+	}
+
+	var selected []Placeholder
+	switch {
+	case opts.allSignatures:
+		selected = all
+	case opts.signature >= 0:
+		if opts.signature >= len(sigs) {
+			return nil, fmt.Errorf("mapped has %d signatures, signature %d does not exist", len(sigs), opts.signature)
+		}
+		selected = sigs[opts.signature].SignedData.Placeholders
+	case len(all) > 0:
+		selected = all[:1]
+	}
+	if len(selected) == 0 {
+		return nil, ErrNoTag
+	}
+
+	return selected, nil
+}
+
+// AttributionCapacity returns the number of bytes available for the
+// attribution code in the placeholders of a signed PE file selected by opts.
+func AttributionCapacity(mapped []byte, opts ...Option) (int, error) {
+	placeholders, err := findPlaceholders(mapped, newOptions(opts))
+	if err != nil {
+		return 0, err
+	}
+	capacity := placeholders[0].Capacity
+	for _, placeholder := range placeholders[1:] {
+		if placeholder.Capacity < capacity {
+			capacity = placeholder.Capacity
+		}
+	}
+	return capacity, nil
+}
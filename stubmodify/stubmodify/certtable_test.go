@@ -0,0 +1,255 @@
+package stubmodify
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+	"testing/quick"
+
+	"github.com/mozilla-services/stubattribution/internal/testpki"
+)
+
+// buildContentInfo returns a ContentInfo containing SignedData with one
+// certificate carrying extensionValue in an extension with extensionOID, and
+// one signer info with the given unauthenticated attributes. A nil
+// extensionValue is left out.
+func buildContentInfo(extensionOID asn1.ObjectIdentifier, extensionValue []byte, attributes ...[]byte) []byte {
+	var extensions []byte
+	if extensionValue != nil {
+		extensions = derEncode(0xa3, derEncode(0x30, derEncode(0x30, derOID(extensionOID), derEncode(0x04, extensionValue))))
+	}
+	cert := derEncode(0x30,
+		derEncode(0x30, derEncode(0x02, []byte{1}), extensions),
+		derEncode(0x30, derOID(asn1.ObjectIdentifier{1, 2, 3})),
+		derEncode(0x03, []byte{0}),
+	)
+
+	var unauthenticatedAttributes []byte
+	if len(attributes) > 0 {
+		unauthenticatedAttributes = derEncode(0xa1, attributes...)
+	}
+	signerInfo := derEncode(0x30,
+		derEncode(0x02, []byte{1}),
+		derEncode(0x30, derEncode(0x30), derEncode(0x02, []byte{1})),
+		derEncode(0x30, derOID(oidSHA1)),
+		derEncode(0x30, derOID(oidRSAEncryption)),
+		derEncode(0x04, []byte("signature")),
+		unauthenticatedAttributes,
+	)
+
+	return testpki.SignedData(oidSpcIndirectDataContent, nil, [][]byte{cert}, signerInfo)
+}
+
+// buildWinCertificate returns a certificate table entry containing SignedData
+// with one certificate carrying extensionValue in an extension with
+// extensionOID, and one signer info carrying attributeValue in an
+// unauthenticated attribute. Nil values are left out.
+func buildWinCertificate(extensionOID asn1.ObjectIdentifier, extensionValue, attributeValue []byte) []byte {
+	var attributes [][]byte
+	if attributeValue != nil {
+		attributes = append(attributes, testpki.Attribute(oidMozAttribution, derEncode(0x04, attributeValue)))
+	}
+	return testpki.Entry(buildContentInfo(extensionOID, extensionValue, attributes...))
+}
+
+// buildNestedWinCertificate returns a certificate table entry with a
+// placeholder in the primary signature and in one nested signature.
+func buildNestedWinCertificate(primaryCapacity, nestedCapacity int) []byte {
+	nested := buildContentInfo(nil, nil, testpki.Attribute(oidMozAttribution, derEncode(0x04, buildPlaceholder(nestedCapacity))))
+	return testpki.Entry(buildContentInfo(nil, nil,
+		testpki.Attribute(oidMozAttribution, derEncode(0x04, buildPlaceholder(primaryCapacity))),
+		testpki.Attribute(oidNestedSignature, nested),
+	))
+}
+
+// buildPlaceholder returns a placeholder value with capacity bytes available
+// after MozTag.
+func buildPlaceholder(capacity int) []byte {
+	return append([]byte(MozTag), make([]byte, capacity)...)
+}
+
+func TestParseCertificateTable(t *testing.T) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+
+	certs, err := ParseCertificateTable(fileBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("expected 1 certificate table entry, got: %d", len(certs))
+	}
+	cert := certs[0]
+	if cert.Revision != 0x200 || cert.CertificateType != winCertTypePKCSSignedData {
+		t.Errorf("unexpected WIN_CERTIFICATE header: %+v", cert)
+	}
+
+	signedData := cert.SignedData
+	if signedData == nil {
+		t.Fatal("SignedData was not parsed")
+	}
+	for _, raw := range signedData.Certificates {
+		if _, err := x509.ParseCertificate(raw); err != nil {
+			t.Errorf("x509.ParseCertificate: %v", err)
+		}
+	}
+	if len(signedData.SignerInfos) != 1 {
+		t.Fatalf("expected 1 signer info, got: %d", len(signedData.SignerInfos))
+	}
+	countersignature := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 6}
+	if attrs := signedData.SignerInfos[0].UnauthenticatedAttributes; len(attrs) != 1 || !attrs[0].Type.Equal(countersignature) {
+		t.Errorf("expected a countersignature, got: %v", attrs)
+	}
+
+	signer, err := signedData.SignerCertificate(signedData.SignerInfos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Subject.CommonName != "Mozilla Corporation" {
+		t.Errorf("unexpected signer: %s", signer.Subject)
+	}
+
+	// Certificates which cannot be parsed do not hide the signer.
+	withBadCert := &SignedData{Certificates: append([][]byte{[]byte("not a certificate")}, signedData.Certificates...)}
+	if signer, err := withBadCert.SignerCertificate(signedData.SignerInfos[0]); err != nil || signer.Subject.CommonName != "Mozilla Corporation" {
+		t.Errorf("unexpected signer with an unparseable certificate: %v, %v", signer, err)
+	}
+	if _, err := withBadCert.SignerCertificate(&SignerInfo{Issuer: []byte("unknown"), SerialNumber: signer.SerialNumber}); err != ErrNoSignerCertificate {
+		t.Errorf("expected ErrNoSignerCertificate, got: %v", err)
+	}
+
+	if len(signedData.Placeholders) != 1 {
+		t.Fatalf("expected 1 placeholder, got: %d", len(signedData.Placeholders))
+	}
+	placeholder := signedData.Placeholders[0]
+	if placeholder.Capacity != MaxLength-len(MozTag) {
+		t.Errorf("Capacity: %d, expected %d", placeholder.Capacity, MaxLength-len(MozTag))
+	}
+	if !bytes.HasPrefix(fileBytes[placeholder.Offset:], []byte(MozTag)) {
+		t.Errorf("Offset %d does not point to MozTag", placeholder.Offset)
+	}
+}
+
+func TestAttributionCapacity(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		table    []byte
+		capacity int
+		err      error
+	}{
+		{"extension", buildWinCertificate(oidMozAttribution, buildPlaceholder(100), nil), 100, nil},
+		{"attribute", buildWinCertificate(nil, nil, buildPlaceholder(200)), 200, nil},
+		{"noPlaceholder", buildWinCertificate(nil, nil, nil), 0, ErrNoTag},
+		{
+			"unexpectedTag",
+			buildWinCertificate(asn1.ObjectIdentifier{1, 2, 3, 4}, buildPlaceholder(10), buildPlaceholder(200)),
+			0,
+			ErrUnexpectedTag,
+		},
+		{
+			"tagInPlaceholder",
+			buildWinCertificate(oidMozAttribution, append(buildPlaceholder(10), MozTag...), nil),
+			0,
+			ErrUnexpectedTag,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			capacity, err := AttributionCapacity(testpki.PE(test.table))
+			if err != test.err {
+				t.Fatalf("Incorrect error returned err: %v", err)
+			}
+			if capacity != test.capacity {
+				t.Errorf("capacity: %d, expected %d", capacity, test.capacity)
+			}
+		})
+	}
+
+	t.Run("placeholderWithoutTag", func(t *testing.T) {
+		table := buildWinCertificate(oidMozAttribution, make([]byte, 100), nil)
+		if _, err := AttributionCapacity(testpki.PE(table)); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("truncatedEntry", func(t *testing.T) {
+		table := buildWinCertificate(oidMozAttribution, buildPlaceholder(100), nil)
+		binary.LittleEndian.PutUint32(table[0:4], uint32(len(table)+8))
+		if _, err := AttributionCapacity(testpki.PE(table)); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("truncatedDER", func(t *testing.T) {
+		table := buildWinCertificate(oidMozAttribution, buildPlaceholder(100), nil)
+		binary.LittleEndian.PutUint32(table[0:4], 64)
+		if _, err := AttributionCapacity(testpki.PE(table)); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("fuzz for panics", func(t *testing.T) {
+		table := buildWinCertificate(oidMozAttribution, buildPlaceholder(100), buildPlaceholder(100))
+		f := func(offset int, b byte) bool {
+			corrupted := make([]byte, len(table))
+			copy(corrupted, table)
+			if offset < 0 {
+				offset = -offset
+			}
+			corrupted[offset%len(corrupted)] = b
+			AttributionCapacity(testpki.PE(corrupted))
+			return true
+		}
+		if err := quick.Check(f, &quick.Config{MaxCount: 10000}); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSignatures(t *testing.T) {
+	table := append(buildNestedWinCertificate(100, 200), buildWinCertificate(nil, nil, buildPlaceholder(300))...)
+	sigs, err := Signatures(testpki.PE(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct{ entry, depth, capacity int }{{0, 0, 100}, {0, 1, 200}, {1, 0, 300}}
+	if len(sigs) != len(expected) {
+		t.Fatalf("expected %d signatures, got: %d", len(expected), len(sigs))
+	}
+	for i, sig := range sigs {
+		if sig.Entry != expected[i].entry || sig.Depth != expected[i].depth {
+			t.Errorf("signature %d: entry %d depth %d, expected %+v", i, sig.Entry, sig.Depth, expected[i])
+		}
+		if len(sig.SignedData.Placeholders) != 1 || sig.SignedData.Placeholders[0].Capacity != expected[i].capacity {
+			t.Errorf("signature %d: unexpected placeholders: %+v", i, sig.SignedData.Placeholders)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		opts     []Option
+		capacity int
+		err      bool
+	}{
+		{"default", nil, 100, false},
+		{"nested", []Option{WithSignature(1)}, 200, false},
+		{"second entry", []Option{WithSignature(2)}, 300, false},
+		{"all", []Option{WithAllSignatures()}, 100, false},
+		{"out of range", []Option{WithSignature(3)}, 0, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			capacity, err := AttributionCapacity(testpki.PE(table), test.opts...)
+			if (err != nil) != test.err {
+				t.Fatalf("Incorrect error returned err: %v", err)
+			}
+			if capacity != test.capacity {
+				t.Errorf("capacity: %d, expected %d", capacity, test.capacity)
+			}
+		})
+	}
+}
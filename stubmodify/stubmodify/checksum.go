@@ -0,0 +1,76 @@
+package stubmodify
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrChecksumMismatch is returned by VerifyChecksum when the CheckSum field
+// does not match the contents of the file.
+var ErrChecksumMismatch = errors.New("mapped has an invalid CheckSum")
+
+// Checksum returns the PE image checksum of mapped, as computed by
+// CheckSumMappedFile: the one's complement sum of the 16-bit words of the
+// file, with the CheckSum field counted as zero, plus the length of the file.
+func Checksum(mapped []byte) (uint32, error) {
+	pe, err := parsePE(mapped)
+	if err != nil {
+		return 0, err
+	}
+	return checksum(mapped, int(pe.checkSumOffset)), nil
+}
+
+func checksum(mapped []byte, checkSumOffset int) uint32 {
+	return patchedSum(mapped, checkSumOffset, nil) + uint32(len(mapped))
+}
+
+// patchedSum returns the one's complement sum of the 16-bit words of mapped
+// with patches applied and the CheckSum field counted as zero.
+func patchedSum(mapped []byte, checkSumOffset int, patches []Patch) uint32 {
+	patches = append(patches[:len(patches):len(patches)], Patch{Offset: checkSumOffset, Data: make([]byte, 4)})
+
+	var sum uint32
+	offset := 0
+	NewPatchedFile(mapped, patches).each(func(chunk []byte) error {
+		sum = onesComplementSum(sum, offset, chunk)
+		offset += len(chunk)
+		return nil
+	})
+	return sum
+}
+
+// onesComplementSum adds the little endian 16-bit words of chunk, which
+// starts at offset in the file, to sum.
+func onesComplementSum(sum uint32, offset int, chunk []byte) uint32 {
+	i := 0
+	if offset%2 == 1 && len(chunk) > 0 {
+		// The first byte is the high byte of a word.
+		sum += uint32(chunk[0]) << 8
+		sum = (sum & 0xffff) + (sum >> 16)
+		i = 1
+	}
+	for ; i+1 < len(chunk); i += 2 {
+		sum += uint32(chunk[i]) | uint32(chunk[i+1])<<8
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	if i < len(chunk) {
+		sum += uint32(chunk[i])
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return sum
+}
+
+// VerifyChecksum returns ErrChecksumMismatch when the CheckSum field of
+// mapped is not its PE image checksum. A CheckSum of zero, which is common
+// for executables other than drivers, does not match either.
+func VerifyChecksum(mapped []byte) error {
+	pe, err := parsePE(mapped)
+	if err != nil {
+		return err
+	}
+	stored := binary.LittleEndian.Uint32(mapped[pe.checkSumOffset : pe.checkSumOffset+4])
+	if stored != checksum(mapped, int(pe.checkSumOffset)) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
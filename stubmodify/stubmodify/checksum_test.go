@@ -0,0 +1,80 @@
+package stubmodify
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	t.Run("folding", func(t *testing.T) {
+		// The only non-zero words are the PE header offset (0x80) and the
+		// magic number (0x20b), two 0xffff words, which fold back to the same
+		// sum, the trailing odd byte and the CheckSum field, which is ignored.
+		mapped := buildMapped(0x80+1001, 0x80, 0x20b, 0, 0, nil)
+		mapped[0x100], mapped[0x101], mapped[0x102], mapped[0x103] = 0xff, 0xff, 0xff, 0xff
+		mapped[len(mapped)-1] = 0x01
+		binary.LittleEndian.PutUint32(mapped[0x80+24+64:], 0xffffffff)
+
+		sum, err := Checksum(mapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := uint32(0x80 + 0x20b + 0x01 + len(mapped)); sum != expected {
+			t.Errorf("Checksum: 0x%x, expected 0x%x", sum, expected)
+		}
+	})
+
+	t.Run("test stub", func(t *testing.T) {
+		fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+		if err != nil {
+			t.Fatal("reading test-stub.exe", err)
+		}
+		sum, err := Checksum(fileBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != 0x3c326 {
+			t.Errorf("Checksum: 0x%x, expected 0x3c326", sum)
+		}
+		// The attribution area of test-stub.exe was filled after it was
+		// signed, so its CheckSum is stale.
+		if err := VerifyChecksum(fileBytes); err != ErrChecksumMismatch {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+}
+
+func TestWriteAttributionCodeChecksum(t *testing.T) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+	pe, err := parsePE(fileBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := binary.LittleEndian.Uint32(fileBytes[pe.checkSumOffset:])
+
+	modBytes, err := WriteAttributionCode(fileBytes, []byte("a test code"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(modBytes[pe.checkSumOffset:]) != stored {
+		t.Error("CheckSum was updated without WithChecksum")
+	}
+
+	modBytes, err = WriteAttributionCode(fileBytes, []byte("a test code"), WithChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyChecksum(modBytes); err != nil {
+		t.Errorf("Error returned: %s", err)
+	}
+	if err := VerifyUnchanged(fileBytes, modBytes); err != nil {
+		t.Errorf("Error returned: %s", err)
+	}
+	if err := VerifyChecksum(fileBytes); err != ErrChecksumMismatch {
+		t.Error("fileBytes was modified in WriteAttributionCode")
+	}
+}
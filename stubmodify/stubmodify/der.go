@@ -0,0 +1,170 @@
+package stubmodify
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"fmt"
+	"sort"
+)
+
+// ASN.1 classes and universal tags used by the certificate table parser.
+const (
+	classUniversal = 0
+	classContext   = 2
+
+	tagOctetString = 4
+	tagOID         = 6
+	tagSequence    = 16
+	tagSet         = 17
+)
+
+// derElement is a DER encoded ASN.1 element. Offsets are relative to the
+// buffer it was parsed from, which is the whole PE file.
+type derElement struct {
+	class       int
+	tag         int
+	constructed bool
+
+	// offset is the offset of the identifier octet.
+	offset int
+	// header is the length of the identifier and length octets.
+	header int
+	// length is the length of the contents.
+	length int
+}
+
+// start returns the offset of the contents of e.
+func (e derElement) start() int {
+	return e.offset + e.header
+}
+
+// end returns the offset of the first byte after e.
+func (e derElement) end() int {
+	return e.offset + e.header + e.length
+}
+
+func (e derElement) is(class, tag int) bool {
+	return e.class == class && e.tag == tag
+}
+
+// parseDER parses the element starting at offset in b, which must end at or
+// before end.
+func parseDER(b []byte, offset, end int) (derElement, error) {
+	if end > len(b) || offset+2 > end {
+		return derElement{}, fmt.Errorf("DER element at %d is truncated", offset)
+	}
+
+	id := b[offset]
+	e := derElement{
+		class:       int(id >> 6),
+		constructed: id&0x20 != 0,
+		tag:         int(id & 0x1f),
+		offset:      offset,
+		header:      2,
+	}
+	if e.tag == 0x1f {
+		return derElement{}, fmt.Errorf("DER element at %d has an unsupported tag number", offset)
+	}
+
+	length := int(b[offset+1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return derElement{}, fmt.Errorf("DER element at %d has an unsupported length", offset)
+		}
+		if offset+2+n > end {
+			return derElement{}, fmt.Errorf("DER element at %d is truncated", offset)
+		}
+		length = 0
+		for _, c := range b[offset+2 : offset+2+n] {
+			length = length<<8 | int(c)
+		}
+		e.header += n
+	}
+	e.length = length
+
+	if e.end() > end {
+		return derElement{}, fmt.Errorf("DER element at %d is longer than its container", offset)
+	}
+	return e, nil
+}
+
+// children parses the elements contained in e.
+func children(b []byte, e derElement) ([]derElement, error) {
+	if !e.constructed {
+		return nil, fmt.Errorf("DER element at %d is not constructed", e.offset)
+	}
+
+	var elems []derElement
+	for offset := e.start(); offset < e.end(); {
+		child, err := parseDER(b, offset, e.end())
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, child)
+		offset = child.end()
+	}
+	return elems, nil
+}
+
+// parseOID parses e, which must be an OBJECT IDENTIFIER.
+func parseOID(b []byte, e derElement) (asn1.ObjectIdentifier, error) {
+	if !e.is(classUniversal, tagOID) {
+		return nil, fmt.Errorf("DER element at %d is not an OBJECT IDENTIFIER", e.offset)
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(b[e.offset:e.end()], &oid); err != nil {
+		return nil, fmt.Errorf("DER element at %d: %v", e.offset, err)
+	}
+	return oid, nil
+}
+
+// derEncode encodes an element with the identifier octet id.
+func derEncode(id byte, contents ...[]byte) []byte {
+	content := bytes.Join(contents, nil)
+	return append(derHeader(id, len(content)), content...)
+}
+
+// derHeader returns the identifier and length octets of an element.
+func derHeader(id byte, length int) []byte {
+	if length < 0x80 {
+		return []byte{id, byte(length)}
+	}
+	var octets []byte
+	for n := length; n > 0; n >>= 8 {
+		octets = append([]byte{byte(n)}, octets...)
+	}
+	return append([]byte{id, 0x80 | byte(len(octets))}, octets...)
+}
+
+// derOID encodes an OBJECT IDENTIFIER.
+func derOID(oid asn1.ObjectIdentifier) []byte {
+	b, err := asn1.Marshal(oid)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// spliceDER returns the encoding of path[0] with b[start:end] replaced by
+// data. start and end must be within the contents of the last element of
+// path. Each element of path must contain the next one, and their lengths are
+// updated.
+func spliceDER(b []byte, path []derElement, start, end int, data []byte) []byte {
+	e := path[0]
+	if len(path) == 1 {
+		return derEncode(b[e.offset], b[e.start():start], data, b[end:e.end()])
+	}
+	child := path[1]
+	return derEncode(b[e.offset], b[e.start():child.offset], spliceDER(b, path[1:], start, end, data), b[child.end():e.end()])
+}
+
+// derSetOf encodes a SET OF with the identifier octet id, whose elements are
+// sorted by their encodings as required by DER.
+func derSetOf(id byte, elems [][]byte) []byte {
+	sorted := append([][]byte(nil), elems...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	return derEncode(id, sorted...)
+}
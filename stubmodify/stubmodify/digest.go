@@ -0,0 +1,63 @@
+package stubmodify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// ErrDigestChanged is returned by VerifyUnchanged when the Authenticode
+// digests of the original and the modified files differ.
+var ErrDigestChanged = errors.New("modified file has a different Authenticode digest")
+
+// AuthenticodeDigest returns the SHA-256 Authenticode image hash of a PE
+// file. The CheckSum field, the certificate directory entry and the
+// certificate table are excluded from the hash, so it is not changed by
+// WriteAttributionCode.
+func AuthenticodeDigest(mapped []byte) ([]byte, error) {
+	return authenticodeDigest(mapped, sha256.New())
+}
+
+func authenticodeDigest(mapped []byte, h hash.Hash) ([]byte, error) {
+	pe, err := parsePE(mapped)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ranges are hashed in file order: the CheckSum field comes before the
+	// certificate directory entry, which comes before the certificate table.
+	h.Write(mapped[:pe.checkSumOffset])
+	h.Write(mapped[pe.checkSumOffset+4 : pe.certDirEntryOffset])
+
+	if pe.certTableOffset == 0 || pe.certTableSize == 0 {
+		h.Write(mapped[pe.certDirEntryOffset+8:])
+		return h.Sum(nil), nil
+	}
+
+	if pe.certTableOffset < pe.certDirEntryOffset+8 {
+		return nil, fmt.Errorf("certificate table overlaps the PE headers: %d", pe.certTableOffset)
+	}
+	h.Write(mapped[pe.certDirEntryOffset+8 : pe.certTableOffset])
+	h.Write(mapped[int(pe.certTableOffset)+int(pe.certTableSize):])
+	return h.Sum(nil), nil
+}
+
+// VerifyUnchanged returns ErrDigestChanged when modified does not have the
+// same Authenticode digest as original, which would invalidate its
+// signature.
+func VerifyUnchanged(original, modified []byte) error {
+	originalDigest, err := AuthenticodeDigest(original)
+	if err != nil {
+		return fmt.Errorf("original: %v", err)
+	}
+	modifiedDigest, err := AuthenticodeDigest(modified)
+	if err != nil {
+		return fmt.Errorf("modified: %v", err)
+	}
+	if !bytes.Equal(originalDigest, modifiedDigest) {
+		return ErrDigestChanged
+	}
+	return nil
+}
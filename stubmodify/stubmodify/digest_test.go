@@ -0,0 +1,96 @@
+package stubmodify
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+	"testing/quick"
+)
+
+// testStubSHA1Digest is the SHA-1 Authenticode digest signed in
+// test-stub.exe.
+const testStubSHA1Digest = "326e77f037ae6c9d1136c2966e1c3ff65af29095"
+
+func TestAuthenticodeDigest(t *testing.T) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+
+	t.Run("signed digest", func(t *testing.T) {
+		digest, err := authenticodeDigest(fileBytes, sha1.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(digest) != testStubSHA1Digest {
+			t.Errorf("digest: %x, expected %s", digest, testStubSHA1Digest)
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		mapped := buildMapped(0x80+1000, 0x80, 0x20b, 0, 0, []byte(""))
+		if _, err := AuthenticodeDigest(mapped); err != nil {
+			t.Errorf("Error returned: %s", err)
+		}
+	})
+
+	t.Run("certTableInHeaders", func(t *testing.T) {
+		mapped := buildMapped(0x80+1000, 0x80, 0x20b, 0x40, 300, []byte(""))
+		if _, err := AuthenticodeDigest(mapped); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("fuzz for panics", func(t *testing.T) {
+		f := func(mapped ByteGenerator) bool {
+			AuthenticodeDigest(mapped)
+			return true
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestVerifyUnchanged(t *testing.T) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+
+	t.Run("attribution code", func(t *testing.T) {
+		f := func(code []byte) bool {
+			modBytes, err := WriteAttributionCode(fileBytes, code)
+			if err != nil {
+				t.Fatal("writing attribution code", err)
+			}
+			return VerifyUnchanged(fileBytes, modBytes) == nil
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("modified section", func(t *testing.T) {
+		modBytes := make([]byte, len(fileBytes))
+		copy(modBytes, fileBytes)
+		modBytes[0x400] ^= 0xff
+		if err := VerifyUnchanged(fileBytes, modBytes); err != ErrDigestChanged {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
+	t.Run("modified checksum", func(t *testing.T) {
+		pe, err := parsePE(fileBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modBytes := make([]byte, len(fileBytes))
+		copy(modBytes, fileBytes)
+		modBytes[pe.checkSumOffset] ^= 0xff
+		if err := VerifyUnchanged(fileBytes, modBytes); err != nil {
+			t.Errorf("Error returned: %s", err)
+		}
+	})
+}
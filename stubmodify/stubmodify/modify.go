@@ -0,0 +1,36 @@
+package stubmodify
+
+import "errors"
+
+// MozTag prefixes the attribution code
+const (
+	MozTag    = "__MOZCUSTOM__:"
+	MaxLength = 1024
+)
+
+// WriteAttributionCode inserts data into the attribution placeholder of a
+// signed PE file. The placeholder is a certificate extension or an
+// unauthenticated attribute whose value starts with MozTag. opts select the
+// placeholders to write to.
+func WriteAttributionCode(mapped, code []byte, opts ...Option) ([]byte, error) {
+	patches, err := AttributionPatches(mapped, code, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyPatches(mapped, patches), nil
+}
+
+// AttributionPatches returns the patches which WriteAttributionCode applies
+// to mapped, so that the attributed file can be served without copying
+// mapped. See PatchedFile.
+func AttributionPatches(mapped, code []byte, opts ...Option) ([]Patch, error) {
+	if len(code)+len(MozTag) > MaxLength {
+		return nil, errors.New("code + __MOZCUSTOM__ exceeds 1024 bytes")
+	}
+
+	t, err := NewTemplate(mapped, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return t.Patches(code)
+}
@@ -9,6 +9,8 @@ import (
 	"reflect"
 	"testing"
 	"testing/quick"
+
+	"github.com/mozilla-services/stubattribution/internal/testpki"
 )
 
 var maxQuickByteLen = 1024 * 64
@@ -44,7 +46,7 @@ func buildMapped(totalLen int, peHeaderOffset uint32, peMagicNumber uint16, cert
 }
 
 func BenchmarkWriteAttributionCodeFull(b *testing.B) {
-	fileBytes, err := ioutil.ReadFile("../testdata/test-stub.exe")
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
 	if err != nil {
 		b.Fatal("reading test-stub.exe", err)
 	}
@@ -64,7 +66,7 @@ func TestWriteAttributionCodeFull(t *testing.T) {
 	// is not exactly what we would see in a real installer. filling up
 	// the entire attribution area makes it easy for us to verify that any
 	// existing attribution data will be properly removed before new data is added.
-	fileBytes, err := ioutil.ReadFile("../testdata/test-stub.exe")
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
 	if err != nil {
 		t.Fatal("reading test-stub.exe", err)
 	}
@@ -211,29 +213,52 @@ func TestWriteAttributionCodeBounds(t *testing.T) {
 	})
 
 	t.Run("noDummyCert", func(t *testing.T) {
-		mapped := buildMapped(0x80+1000, 0x80, 0x20b, 0x160, 300, []byte("FAIL"))
+		mapped := testpki.PE(buildWinCertificate(nil, nil, nil))
 		_, err := WriteAttributionCode(mapped, []byte("a test code"))
 		if err.Error() != "mapped does not contain dummy cert" {
 			t.Errorf("Incorrect error returned err: %v", err)
 		}
 	})
 
+	t.Run("malformedCertTable", func(t *testing.T) {
+		mapped := buildMapped(0x80+1000, 0x80, 0x20b, 0x160, 300, []byte("FAIL"))
+		_, err := WriteAttributionCode(mapped, []byte("a test code"))
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+
 	t.Run("tooMuchData", func(t *testing.T) {
-		mapped := buildMapped(0x160+300, 0x80, 0x20b, 0x160, 300, []byte("__MOZCUSTOM__:"))
-		_, err := WriteAttributionCode(mapped, make([]byte, 980))
-		if err == nil || err.Error() != "we are trying to write past the end of mapped" {
+		mapped := testpki.PE(buildWinCertificate(oidMozAttribution, buildPlaceholder(MaxLength-len(MozTag)), nil))
+		_, err := WriteAttributionCode(mapped, make([]byte, MaxLength-len(MozTag)+1))
+		if err == nil || err.Error() != "code + __MOZCUSTOM__ exceeds 1024 bytes" {
 			t.Errorf("Incorrect error returned err: %v", err)
 		}
 	})
 
-	t.Run("writing outside of certtable", func(t *testing.T) {
-		mapped := buildMapped(0x160+6000, 0x80, 0x20b, 0x160, 300, []byte("__MOZCUSTOM__:"))
-		_, err := WriteAttributionCode(mapped, make([]byte, 980))
+	t.Run("writing outside of placeholder", func(t *testing.T) {
+		mapped := testpki.PE(buildWinCertificate(oidMozAttribution, buildPlaceholder(300), nil))
+		_, err := WriteAttributionCode(mapped, make([]byte, 301))
 		if err == nil || err.Error() != "code is longer than available cert table space" {
 			t.Errorf("Incorrect error returned err: %v", err)
 		}
 	})
 
+	t.Run("unexpectedTag", func(t *testing.T) {
+		// A second, non-PKCS#7, entry contains MozTag.
+		entry := make([]byte, 32)
+		binary.LittleEndian.PutUint32(entry[0:4], uint32(len(entry)))
+		binary.LittleEndian.PutUint16(entry[4:6], 0x200)
+		binary.LittleEndian.PutUint16(entry[6:8], 1)
+		copy(entry[8:], MozTag)
+		table := buildWinCertificate(oidMozAttribution, buildPlaceholder(300), nil)
+		mapped := testpki.PE(append(table, entry...))
+		_, err := WriteAttributionCode(mapped, []byte("a test code"))
+		if err != ErrUnexpectedTag {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
 	t.Run("code too long", func(t *testing.T) {
 		_, err := WriteAttributionCode([]byte(""), make([]byte, 1025))
 		if err.Error() != "code + __MOZCUSTOM__ exceeds 1024 bytes" {
@@ -243,17 +268,21 @@ func TestWriteAttributionCodeBounds(t *testing.T) {
 
 	t.Run("succesful run", func(t *testing.T) {
 		code := []byte("acustomcode")
-		mappedLen := 0x160 + 6000
-		mapped := buildMapped(mappedLen, 0x80, 0x20b, 0x160, 2000, []byte("__MOZCUSTOM__:"))
-		modBytes, err := WriteAttributionCode(mapped, code)
-		if err != nil {
-			t.Errorf("Error returned: %s", err)
-		}
-		if len(modBytes) != mappedLen {
-			t.Errorf("modBytes is the wrong size: %d", len(modBytes))
-		}
-		if !bytes.Contains(modBytes, code) {
-			t.Errorf("modBytes does not contain code")
+		for _, table := range [][]byte{
+			buildWinCertificate(oidMozAttribution, buildPlaceholder(MaxLength-len(MozTag)), nil),
+			buildWinCertificate(nil, nil, buildPlaceholder(MaxLength-len(MozTag))),
+		} {
+			mapped := testpki.PE(table)
+			modBytes, err := WriteAttributionCode(mapped, code)
+			if err != nil {
+				t.Errorf("Error returned: %s", err)
+			}
+			if len(modBytes) != len(mapped) {
+				t.Errorf("modBytes is the wrong size: %d", len(modBytes))
+			}
+			if !bytes.Contains(modBytes, code) {
+				t.Errorf("modBytes does not contain code")
+			}
 		}
 	})
 }
@@ -0,0 +1,135 @@
+package stubmodify
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+// Patch replaces the bytes of a file at Offset with Data.
+type Patch struct {
+	Offset int
+	Data   []byte
+}
+
+// ApplyPatches returns a copy of mapped with patches applied.
+func ApplyPatches(mapped []byte, patches []Patch) []byte {
+	modBytes := make([]byte, len(mapped))
+	copy(modBytes, mapped)
+	for _, patch := range patches {
+		copy(modBytes[patch.Offset:], patch.Data)
+	}
+	return modBytes
+}
+
+// VerifyPatches returns ErrDigestChanged when patches change bytes of mapped
+// which are part of its Authenticode digest. Unlike VerifyUnchanged, it does
+// not need the patched file.
+func VerifyPatches(mapped []byte, patches []Patch) error {
+	pe, err := parsePE(mapped)
+	if err != nil {
+		return err
+	}
+
+	excluded := [][2]int{
+		{int(pe.checkSumOffset), int(pe.checkSumOffset) + 4},
+		{int(pe.certTableOffset), int(pe.certTableOffset) + int(pe.certTableSize)},
+	}
+	for _, patch := range patches {
+		start, end := patch.Offset, patch.Offset+len(patch.Data)
+		inside := false
+		for _, r := range excluded {
+			if start >= r[0] && end <= r[1] {
+				inside = true
+			}
+		}
+		if !inside {
+			return ErrDigestChanged
+		}
+	}
+	return nil
+}
+
+// PatchedFile is a read-only view of a file with patches applied. The file
+// is not copied, so it can be shared between views, and it must not be
+// modified while they are in use.
+type PatchedFile struct {
+	base    []byte
+	patches []Patch
+}
+
+// NewPatchedFile returns a view of base with patches applied. Patches must
+// not overlap and must be within base.
+func NewPatchedFile(base []byte, patches []Patch) *PatchedFile {
+	sorted := make([]Patch, len(patches))
+	copy(sorted, patches)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+	return &PatchedFile{
+		base:    base,
+		patches: sorted,
+	}
+}
+
+// Size returns the size of the file.
+func (f *PatchedFile) Size() int64 {
+	return int64(len(f.base))
+}
+
+// each calls fn with the consecutive chunks of the patched file.
+func (f *PatchedFile) each(fn func(chunk []byte) error) error {
+	offset := 0
+	for _, patch := range f.patches {
+		if err := fn(f.base[offset:patch.Offset]); err != nil {
+			return err
+		}
+		if err := fn(patch.Data); err != nil {
+			return err
+		}
+		offset = patch.Offset + len(patch.Data)
+	}
+	return fn(f.base[offset:])
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *PatchedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= f.Size() {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.base[off:])
+	for _, patch := range f.patches {
+		// Copy the part of the patch overlapping p.
+		start, end := int64(patch.Offset), int64(patch.Offset+len(patch.Data))
+		if end <= off || start >= off+int64(n) {
+			continue
+		}
+		src, dst := patch.Data, p[:n]
+		if start < off {
+			src = src[off-start:]
+		} else {
+			dst = dst[start-off:]
+		}
+		copy(dst, src)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo.
+func (f *PatchedFile) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	err := f.each(func(chunk []byte) error {
+		n, err := w.Write(chunk)
+		written += int64(n)
+		return err
+	})
+	return written, err
+}
@@ -0,0 +1,114 @@
+package stubmodify
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/quick"
+)
+
+func BenchmarkAttributionPatches(b *testing.B) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		b.Fatal("reading test-stub.exe", err)
+	}
+	code := []byte("testattributioncode&stuff")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		patches, err := AttributionPatches(fileBytes, code)
+		if err != nil {
+			b.Error(err)
+		}
+		NewPatchedFile(fileBytes, patches).WriteTo(ioutil.Discard)
+	}
+}
+
+func TestPatchedFile(t *testing.T) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+	origBytes := make([]byte, len(fileBytes))
+	copy(origBytes, fileBytes)
+
+	code := []byte("a test code")
+	modBytes, err := WriteAttributionCode(fileBytes, code, WithChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches, err := AttributionPatches(fileBytes, code, WithChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("expected a placeholder and a CheckSum patch, got: %d", len(patches))
+	}
+	patched := NewPatchedFile(fileBytes, patches)
+
+	t.Run("WriteTo", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		n, err := patched.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != patched.Size() || !bytes.Equal(buf.Bytes(), modBytes) {
+			t.Error("WriteTo does not match WriteAttributionCode")
+		}
+	})
+
+	t.Run("ReadAt", func(t *testing.T) {
+		f := func(off, length uint32) bool {
+			off %= uint32(len(modBytes))
+			p := make([]byte, length%4096)
+			n, err := patched.ReadAt(p, int64(off))
+			end := int(off) + len(p)
+			if end > len(modBytes) {
+				end = len(modBytes)
+				if err != io.EOF {
+					return false
+				}
+			} else if err != nil {
+				return false
+			}
+			return n == end-int(off) && bytes.Equal(p[:n], modBytes[off:end])
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(err)
+		}
+
+		// Read around each patch, so reads start and end inside of them.
+		for _, patch := range patches {
+			for _, off := range []int{patch.Offset - 3, patch.Offset + 1} {
+				p := make([]byte, len(patch.Data)+2)
+				if _, err := patched.ReadAt(p, int64(off)); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(p, modBytes[off:off+len(p)]) {
+					t.Errorf("ReadAt(%d) does not match WriteAttributionCode", off)
+				}
+			}
+		}
+
+		if _, err := patched.ReadAt(make([]byte, 1), patched.Size()); err != io.EOF {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+		if _, err := patched.ReadAt(make([]byte, 1), -1); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("VerifyPatches", func(t *testing.T) {
+		if err := VerifyPatches(fileBytes, patches); err != nil {
+			t.Errorf("Error returned: %s", err)
+		}
+		bad := append(patches, Patch{Offset: 0x400, Data: []byte{1}})
+		if err := VerifyPatches(fileBytes, bad); err != ErrDigestChanged {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
+	if !bytes.Equal(origBytes, fileBytes) {
+		t.Error("fileBytes was modified")
+	}
+}
@@ -0,0 +1,122 @@
+package stubmodify
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotSigned is returned for PE files without a certificate table.
+	ErrNotSigned = errors.New("mapped is not signed")
+	// ErrNoTag is returned when the certificate table does not contain
+	// MozTag.
+	ErrNoTag = errors.New("mapped does not contain dummy cert")
+)
+
+// peFile holds the offsets of the PE fields which are excluded from the
+// Authenticode digest.
+type peFile struct {
+	pe32Plus           bool
+	checkSumOffset     uint32
+	certDirEntryOffset uint32
+	certTableOffset    uint32
+	certTableSize      uint32
+}
+
+// parsePE walks the PE header, the optional header and the certificate
+// directory entry of mapped.
+func parsePE(mapped []byte) (*peFile, error) {
+	byteOrder := binary.LittleEndian
+
+	// Get the location of the PE header and the option header
+	if len(mapped) < 0x40 {
+		return nil, fmt.Errorf("mapped must be at least %d bytes", 0x40)
+	}
+	peHeaderOffset := byteOrder.Uint32(mapped[0x3C:0x40])
+	optionalHeaderOffset := peHeaderOffset + 24
+
+	// Look up the magic number in the option header,
+	// so we know if we have a 32 or 64-bit executable.
+	// We need to know that so that we can find the data directories.
+	if len(mapped) < int(optionalHeaderOffset+2) {
+		return nil, fmt.Errorf("mapped is shorter than optionalHeaderOffset+2: %d", optionalHeaderOffset+2)
+	}
+	peMagicNumber := byteOrder.Uint16(mapped[optionalHeaderOffset : optionalHeaderOffset+2])
+
+	var certDirEntryOffset uint32
+	if peMagicNumber == 0x10b {
+		certDirEntryOffset = optionalHeaderOffset + 128
+	} else if peMagicNumber == 0x20b {
+		certDirEntryOffset = optionalHeaderOffset + 144
+	} else {
+		return nil, errors.New("mapped is not in a known PE format")
+	}
+
+	if len(mapped) < int(certDirEntryOffset+8) {
+		return nil, fmt.Errorf("mapped is shorter than certDirEntryOffset+8: %d", certDirEntryOffset+8)
+	}
+	certTableOffset := byteOrder.Uint32(mapped[certDirEntryOffset : certDirEntryOffset+4])
+	certTableSize := byteOrder.Uint32(mapped[certDirEntryOffset+4 : certDirEntryOffset+8])
+
+	signed := certTableOffset != 0 && certTableSize != 0
+	if signed && len(mapped) < int(certTableOffset)+int(certTableSize) {
+		return nil, fmt.Errorf("mapped is shorter than certTableOffset+certTableSize: %d", int(certTableOffset)+int(certTableSize))
+	}
+
+	return &peFile{
+		pe32Plus: peMagicNumber == 0x20b,
+
+		// CheckSum has the same offset in PE32 and PE32+ optional headers.
+		checkSumOffset:     optionalHeaderOffset + 64,
+		certDirEntryOffset: certDirEntryOffset,
+		certTableOffset:    certTableOffset,
+		certTableSize:      certTableSize,
+	}, nil
+}
+
+// certTable returns the location of the certificate table of mapped.
+func certTable(mapped []byte) (offset, size int, err error) {
+	pe, err := parsePE(mapped)
+	if err != nil {
+		return 0, 0, err
+	}
+	if pe.certTableOffset == 0 || pe.certTableSize == 0 {
+		return 0, 0, ErrNotSigned
+	}
+	return int(pe.certTableOffset), int(pe.certTableSize), nil
+}
+
+// Layout is the location of the PE fields used for attribution.
+type Layout struct {
+	// PE32Plus is true for PE32+ (64-bit) files.
+	PE32Plus bool
+
+	// CheckSumOffset is the offset of the CheckSum field, and CheckSum its
+	// value.
+	CheckSumOffset int
+	CheckSum       uint32
+
+	// CertDirEntryOffset is the offset of the certificate directory entry,
+	// which locates the certificate table. CertTableOffset and
+	// CertTableSize are 0 when the file is not signed.
+	CertDirEntryOffset int
+	CertTableOffset    int
+	CertTableSize      int
+}
+
+// ParseLayout returns the layout of a PE file.
+func ParseLayout(mapped []byte) (*Layout, error) {
+	pe, err := parsePE(mapped)
+	if err != nil {
+		return nil, err
+	}
+	return &Layout{
+		PE32Plus:           pe.pe32Plus,
+		CheckSumOffset:     int(pe.checkSumOffset),
+		CheckSum:           binary.LittleEndian.Uint32(mapped[pe.checkSumOffset : pe.checkSumOffset+4]),
+		CertDirEntryOffset: int(pe.certDirEntryOffset),
+		CertTableOffset:    int(pe.certTableOffset),
+		CertTableSize:      int(pe.certTableSize),
+	}, nil
+}
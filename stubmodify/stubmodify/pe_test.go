@@ -0,0 +1,55 @@
+package stubmodify
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestParseLayout(t *testing.T) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		mapped   []byte
+		expected *Layout
+	}{
+		{
+			name:   "test-stub.exe",
+			mapped: fileBytes,
+			expected: &Layout{
+				CheckSumOffset:     312,
+				CheckSum:           0x41023,
+				CertDirEntryOffset: 376,
+				CertTableOffset:    235976,
+				CertTableSize:      9432,
+			},
+		},
+		{
+			name:   "unsigned PE32+",
+			mapped: buildMapped(0x200, 0x80, 0x20b, 0, 0, nil),
+			expected: &Layout{
+				PE32Plus:           true,
+				CheckSumOffset:     0x80 + 24 + 64,
+				CertDirEntryOffset: 0x80 + 24 + 144,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			layout, err := ParseLayout(tc.mapped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(layout, tc.expected) {
+				t.Errorf("ParseLayout returned %+v, expected: %+v", layout, tc.expected)
+			}
+		})
+	}
+
+	if _, err := ParseLayout(make([]byte, 0x20)); err == nil {
+		t.Error("Expected an error parsing a truncated file")
+	}
+}
@@ -0,0 +1,148 @@
+package stubmodify
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrHasPlaceholder is returned by AddAttributionPlaceholder when the
+	// certificate table already contains an attribution placeholder.
+	ErrHasPlaceholder = errors.New("mapped already contains an attribution placeholder")
+	// ErrNoSignedData is returned by AddAttributionPlaceholder when the
+	// certificate table does not contain an Authenticode signature.
+	ErrNoSignedData = errors.New("mapped does not contain an Authenticode signature")
+)
+
+// AddAttributionPlaceholder adds an unauthenticated attribute carrying an
+// attribution placeholder with capacity bytes available after MozTag to the
+// first signer of the first Authenticode signature of a signed PE file. Only
+// the certificate table and the certificate directory entry are changed, so
+// the Authenticode digest stays the same.
+func AddAttributionPlaceholder(mapped []byte, capacity int) ([]byte, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid placeholder capacity: %d", capacity)
+	}
+
+	pe, err := parsePE(mapped)
+	if err != nil {
+		return nil, err
+	}
+	certTableOffset, certTableSize, err := certTable(mapped)
+	if err != nil {
+		return nil, err
+	}
+	certTableEnd := certTableOffset + certTableSize
+
+	certs, err := parseCertificateTable(mapped, certTableOffset, certTableEnd)
+	if err != nil {
+		return nil, err
+	}
+	sigs := signatures(certs)
+	if len(sigs) == 0 {
+		return nil, ErrNoSignedData
+	}
+	for _, sig := range sigs {
+		if len(sig.SignedData.Placeholders) > 0 {
+			return nil, ErrHasPlaceholder
+		}
+	}
+	cert := certs[sigs[0].Entry]
+	if bytes.Contains(mapped[certTableOffset:certTableEnd], []byte(MozTag)) {
+		return nil, ErrUnexpectedTag
+	}
+
+	entryEnd := cert.Offset + int(cert.Length)
+	path, err := signerInfoPath(mapped, cert.Offset+8, entryEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attribute ::= SEQUENCE { type OBJECT IDENTIFIER, values SET OF ANY }
+	value := append([]byte(MozTag), make([]byte, capacity)...)
+	attr := derEncode(0x30, derOID(oidMozAttribution), derEncode(0x31, derEncode(0x04, value)))
+
+	// The placeholder is added to the unauthenticated attributes of the
+	// signer, [1] IMPLICIT SET OF Attribute, which are created when missing.
+	// The elements of a SET OF are sorted by their encodings in DER.
+	signerInfo := path[len(path)-1]
+	attrs, err := children(mapped, signerInfo)
+	if err != nil {
+		return nil, err
+	}
+	start, end := signerInfo.end(), signerInfo.end()
+	unauthenticated := [][]byte{attr}
+	if last := attrs[len(attrs)-1]; last.is(classContext, 1) {
+		elems, err := children(mapped, last)
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range elems {
+			unauthenticated = append(unauthenticated, mapped[elem.offset:elem.end()])
+		}
+		start = last.offset
+	}
+
+	// The WIN_CERTIFICATE is rebuilt around the new ContentInfo, and padded
+	// so that the following entries stay aligned on 8 bytes.
+	contentInfo := spliceDER(mapped, path, start, end, derSetOf(0xa1, unauthenticated))
+	entryLength := (8 + len(contentInfo) + 7) &^ 7
+	entry := make([]byte, entryLength)
+	binary.LittleEndian.PutUint32(entry[0:4], uint32(entryLength))
+	binary.LittleEndian.PutUint16(entry[4:6], cert.Revision)
+	binary.LittleEndian.PutUint16(entry[6:8], cert.CertificateType)
+	copy(entry[8:], contentInfo)
+
+	nextEntry := cert.Offset + (int(cert.Length)+7)&^7
+	if nextEntry > certTableEnd {
+		nextEntry = certTableEnd
+	}
+	var table []byte
+	table = append(table, mapped[certTableOffset:cert.Offset]...)
+	table = append(table, entry...)
+	table = append(table, mapped[nextEntry:certTableEnd]...)
+	if padding := (len(table)+7)&^7 - len(table); padding > 0 {
+		table = append(table, make([]byte, padding)...)
+	}
+
+	modBytes := make([]byte, 0, len(mapped)-certTableSize+len(table))
+	modBytes = append(modBytes, mapped[:certTableOffset]...)
+	modBytes = append(modBytes, table...)
+	modBytes = append(modBytes, mapped[certTableEnd:]...)
+	binary.LittleEndian.PutUint32(modBytes[pe.certDirEntryOffset+4:pe.certDirEntryOffset+8], uint32(len(table)))
+
+	return modBytes, nil
+}
+
+// signerInfoPath returns the elements from the ContentInfo starting at
+// offset down to its first SignerInfo. The structure has already been checked
+// by parseCertificateTable.
+func signerInfoPath(b []byte, offset, end int) ([]derElement, error) {
+	contentInfo, err := parseDER(b, offset, end)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := children(b, contentInfo)
+	if err != nil {
+		return nil, err
+	}
+	content := elems[1]
+	if elems, err = children(b, content); err != nil {
+		return nil, err
+	}
+	signedData := elems[0]
+	if elems, err = children(b, signedData); err != nil {
+		return nil, err
+	}
+	signerInfos := elems[len(elems)-1]
+	if elems, err = children(b, signerInfos); err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("SignedData at %d has no signer", signedData.offset)
+	}
+
+	return []derElement{contentInfo, content, signedData, signerInfos, elems[0]}, nil
+}
@@ -0,0 +1,208 @@
+package stubmodify
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/stubattribution/internal/testpki"
+)
+
+// untaggedTestStub returns test-stub.exe with its placeholder extension
+// renamed, as if it had been signed without the dummy certificate.
+func untaggedTestStub(t *testing.T) []byte {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+	placeholders, err := findPlaceholders(fileBytes, newOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeholder := placeholders[0]
+
+	oid := derOID(oidMozAttribution)
+	i := bytes.LastIndex(fileBytes[:placeholder.Offset], oid)
+	fileBytes[i+len(oid)-1]++
+	copy(fileBytes[placeholder.Offset:], bytes.Repeat([]byte("X"), len(MozTag)))
+	return fileBytes
+}
+
+func TestAddAttributionPlaceholder(t *testing.T) {
+	t.Run("test stub", func(t *testing.T) {
+		original := untaggedTestStub(t)
+		if _, err := WriteAttributionCode(original, []byte("a=b")); err != ErrNoTag {
+			t.Fatalf("Incorrect error returned err: %v", err)
+		}
+
+		modBytes, err := AddAttributionPlaceholder(original, MaxLength-len(MozTag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyUnchanged(original, modBytes); err != nil {
+			t.Error(err)
+		}
+		digest, err := authenticodeDigest(modBytes, sha1.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(digest) != testStubSHA1Digest {
+			t.Errorf("digest: %x, expected %s", digest, testStubSHA1Digest)
+		}
+
+		certTableOffset, certTableSize, err := certTable(modBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certTableSize%8 != 0 {
+			t.Errorf("certificate table size is not aligned: %d", certTableSize)
+		}
+		if certTableOffset+certTableSize != len(modBytes) {
+			t.Errorf("certificate table does not end the file")
+		}
+
+		certs, err := ParseCertificateTable(modBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 1 || int(certs[0].Length) != certTableSize {
+			t.Fatalf("unexpected certificate table: %+v", certs)
+		}
+		// The countersignature is kept.
+		if attrs := certs[0].SignedData.SignerInfos[0].UnauthenticatedAttributes; len(attrs) != 2 || !attrs[1].Type.Equal(oidMozAttribution) {
+			t.Errorf("unexpected unauthenticated attributes: %v", attrs)
+		}
+
+		vals := url.Values{"source": {"partner"}, "campaign": {"test"}}
+		attributed, err := WriteAttributionCode(modBytes, []byte(url.QueryEscape(vals.Encode())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := ReadAttributionCode(attributed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code.Values.Encode() != vals.Encode() {
+			t.Errorf("Values: %v, expected %v", code.Values, vals)
+		}
+		if err := VerifyUnchanged(original, attributed); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("no unauthenticated attributes", func(t *testing.T) {
+		// A second entry checks that following entries are kept.
+		second := buildWinCertificate(nil, nil, nil)
+		mapped := testpki.PE(append(buildWinCertificate(nil, nil, nil), second...))
+
+		modBytes, err := AddAttributionPlaceholder(mapped, 70000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyUnchanged(mapped, modBytes); err != nil {
+			t.Error(err)
+		}
+		capacity, err := AttributionCapacity(modBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if capacity != 70000 {
+			t.Errorf("capacity: %d, expected 70000", capacity)
+		}
+		if !bytes.HasSuffix(modBytes, second) {
+			t.Error("the second entry was not kept")
+		}
+		certs, err := ParseCertificateTable(modBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 2 {
+			t.Errorf("expected 2 entries, got: %d", len(certs))
+		}
+	})
+
+	t.Run("countersigned", func(t *testing.T) {
+		now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+		pki := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+		mapped := pki.SignPE(t, AuthenticodeDigest, pki.TSA.CounterSignature(now))
+
+		// The encoding of the placeholder attribute sorts before the
+		// countersignature with a short length, and after it with a long one.
+		for _, capacity := range []int{16, MaxLength - len(MozTag)} {
+			modBytes, err := AddAttributionPlaceholder(mapped, capacity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyUnchanged(mapped, modBytes); err != nil {
+				t.Error(err)
+			}
+
+			certs, err := ParseCertificateTable(modBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path, err := signerInfoPath(modBytes, certs[0].Offset+8, certs[0].Offset+int(certs[0].Length))
+			if err != nil {
+				t.Fatal(err)
+			}
+			signerInfo, err := children(modBytes, path[len(path)-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			attrs, err := children(modBytes, signerInfo[len(signerInfo)-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attrs) != 2 {
+				t.Fatalf("capacity %d: expected 2 unauthenticated attributes, got %d", capacity, len(attrs))
+			}
+			if bytes.Compare(modBytes[attrs[0].offset:attrs[0].end()], modBytes[attrs[1].offset:attrs[1].end()]) > 0 {
+				t.Errorf("capacity %d: unauthenticated attributes are not sorted", capacity)
+			}
+
+			// The countersignature is still valid.
+			verified, err := verifyMapped(t, modBytes, VerifyOptions{Roots: pki.Roots(), CurrentTime: now.Add(24 * time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !verified.SigningTime.Equal(now) {
+				t.Errorf("capacity %d: expected signing time %s, got %s", capacity, now, verified.SigningTime)
+			}
+			if got, err := AttributionCapacity(modBytes); err != nil || got != capacity {
+				t.Errorf("capacity: %d, expected %d (%v)", got, capacity, err)
+			}
+		}
+	})
+
+	t.Run("hasPlaceholder", func(t *testing.T) {
+		for _, table := range [][]byte{
+			buildWinCertificate(nil, nil, buildPlaceholder(100)),
+			testpki.Entry(buildContentInfo(nil, nil, testpki.Attribute(oidNestedSignature, buildContentInfo(oidMozAttribution, buildPlaceholder(100))))),
+		} {
+			if _, err := AddAttributionPlaceholder(testpki.PE(table), 100); err != ErrHasPlaceholder {
+				t.Errorf("Incorrect error returned err: %v", err)
+			}
+		}
+	})
+
+	t.Run("noSignedData", func(t *testing.T) {
+		entry := make([]byte, 32)
+		binary.LittleEndian.PutUint32(entry[0:4], uint32(len(entry)))
+		binary.LittleEndian.PutUint16(entry[6:8], 1)
+		if _, err := AddAttributionPlaceholder(testpki.PE(entry), 100); err != ErrNoSignedData {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
+	t.Run("notSigned", func(t *testing.T) {
+		mapped := buildMapped(0x80+1000, 0x80, 0x20b, 0, 0, []byte(""))
+		if _, err := AddAttributionPlaceholder(mapped, 100); err != ErrNotSigned {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+}
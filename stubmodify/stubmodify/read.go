@@ -0,0 +1,69 @@
+package stubmodify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+var (
+	// ErrEmptyCode is returned when the attribution area following MozTag
+	// is empty.
+	ErrEmptyCode = errors.New("mapped does not contain an attribution code")
+	// ErrPlaceholdersDisagree is returned when the selected placeholders
+	// contain different codes.
+	ErrPlaceholdersDisagree = errors.New("attribution placeholders contain different codes")
+)
+
+// AttributionCode is an attribution code read from an installer.
+type AttributionCode struct {
+	// Raw is the code as written to the installer.
+	Raw string
+	// Values are the fields of the unescaped code.
+	Values url.Values
+}
+
+// ReadAttributionCode returns the attribution code written to a signed PE
+// file by WriteAttributionCode. opts select the placeholders to read from.
+func ReadAttributionCode(mapped []byte, opts ...Option) (*AttributionCode, error) {
+	placeholders, err := findPlaceholders(mapped, newOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	raw := placeholderCode(mapped, placeholders[0])
+	for _, placeholder := range placeholders[1:] {
+		if !bytes.Equal(placeholderCode(mapped, placeholder), raw) {
+			return nil, ErrPlaceholdersDisagree
+		}
+	}
+	if len(raw) == 0 {
+		return nil, ErrEmptyCode
+	}
+
+	unescaped, err := url.QueryUnescape(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("unescaping code: %v", err)
+	}
+	vals, err := url.ParseQuery(unescaped)
+	if err != nil {
+		return nil, fmt.Errorf("parsing code: %v", err)
+	}
+
+	return &AttributionCode{
+		Raw:    string(raw),
+		Values: vals,
+	}, nil
+}
+
+// placeholderCode returns the NUL-terminated code following MozTag in
+// placeholder.
+func placeholderCode(mapped []byte, placeholder Placeholder) []byte {
+	codeStart := placeholder.Offset + len(MozTag)
+	raw := mapped[codeStart : codeStart+placeholder.Capacity]
+	if i := bytes.IndexByte(raw, 0); i != -1 {
+		raw = raw[:i]
+	}
+	return raw
+}
@@ -0,0 +1,167 @@
+package stubmodify
+
+import (
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/mozilla-services/stubattribution/internal/testpki"
+)
+
+func TestReadAttributionCode(t *testing.T) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+
+	testRoundTrip := func(t *testing.T, vals url.Values) {
+		raw := url.QueryEscape(vals.Encode())
+		modBytes, err := WriteAttributionCode(fileBytes, []byte(raw))
+		if err != nil {
+			t.Fatal("writing attribution code", err)
+		}
+
+		code, err := ReadAttributionCode(modBytes)
+		if err != nil {
+			t.Fatal("reading attribution code", err)
+		}
+		if code.Raw != raw {
+			t.Errorf("Raw: %q, expected %q", code.Raw, raw)
+		}
+		if !reflect.DeepEqual(code.Values, vals) {
+			t.Errorf("Values: %v, expected %v", code.Values, vals)
+		}
+	}
+
+	t.Run("static code test", func(t *testing.T) {
+		testRoundTrip(t, url.Values{
+			"source":   {"google.com"},
+			"medium":   {"organic"},
+			"campaign": {"(not set)"},
+			"content":  {"rta:abc="},
+			"dltoken":  {"a9b1e0c2-6a2c-4b7b-8a3a-7c1d2a6e1f00"},
+		})
+	})
+
+	t.Run("fuzz code test", func(t *testing.T) {
+		f := func(source, content string) bool {
+			vals := url.Values{"source": {source}, "content": {content}}
+			if len(url.QueryEscape(vals.Encode()))+len(MozTag) > MaxLength {
+				return true
+			}
+			testRoundTrip(t, vals)
+			return true
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReadAttributionCodeErrors(t *testing.T) {
+	t.Run("fuzz for panics", func(t *testing.T) {
+		f := func(mapped ByteGenerator) bool {
+			ReadAttributionCode(mapped)
+			return true
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("badMagicNumber", func(t *testing.T) {
+		mapped := buildMapped(0x80+100, 0x80, 0, 0x160, 0, []byte(""))
+		_, err := ReadAttributionCode(mapped)
+		if err == nil || err.Error() != "mapped is not in a known PE format" {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
+	t.Run("mappedNotSigned", func(t *testing.T) {
+		mapped := buildMapped(0x80+1000, 0x80, 0x20b, 0x160, 0, []byte(""))
+		_, err := ReadAttributionCode(mapped)
+		if err != ErrNotSigned {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
+	t.Run("noDummyCert", func(t *testing.T) {
+		mapped := testpki.PE(buildWinCertificate(nil, nil, nil))
+		_, err := ReadAttributionCode(mapped)
+		if err != ErrNoTag {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
+	t.Run("emptyCode", func(t *testing.T) {
+		mapped := testpki.PE(buildWinCertificate(oidMozAttribution, buildPlaceholder(100), nil))
+		_, err := ReadAttributionCode(mapped)
+		if err != ErrEmptyCode {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
+	t.Run("codeFillsPlaceholder", func(t *testing.T) {
+		mapped := testpki.PE(buildWinCertificate(nil, nil, []byte(MozTag+"a=bcde")))
+		code, err := ReadAttributionCode(mapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code.Raw != "a=bcde" {
+			t.Errorf("Raw: %q, expected the code to end with the placeholder", code.Raw)
+		}
+	})
+
+	t.Run("badEscape", func(t *testing.T) {
+		mapped := testpki.PE(buildWinCertificate(nil, nil, []byte(MozTag+"a%zz")))
+		_, err := ReadAttributionCode(mapped)
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestReadAttributionCodeSignatures(t *testing.T) {
+	mapped := testpki.PE(buildNestedWinCertificate(100, 200))
+
+	t.Run("all signatures", func(t *testing.T) {
+		modBytes, err := WriteAttributionCode(mapped, []byte("a=b"), WithAllSignatures())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			code, err := ReadAttributionCode(modBytes, WithSignature(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code.Raw != "a=b" {
+				t.Errorf("signature %d: Raw: %q, expected %q", i, code.Raw, "a=b")
+			}
+		}
+		if _, err := ReadAttributionCode(modBytes, WithAllSignatures()); err != nil {
+			t.Errorf("Error returned: %s", err)
+		}
+	})
+
+	t.Run("one signature", func(t *testing.T) {
+		modBytes, err := WriteAttributionCode(mapped, []byte("a=b"), WithSignature(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadAttributionCode(modBytes); err != ErrEmptyCode {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+		if _, err := ReadAttributionCode(modBytes, WithAllSignatures()); err != ErrPlaceholdersDisagree {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+
+	t.Run("code too long for one placeholder", func(t *testing.T) {
+		_, err := WriteAttributionCode(mapped, make([]byte, 150), WithAllSignatures())
+		if err == nil || err.Error() != "code is longer than available cert table space" {
+			t.Errorf("Incorrect error returned err: %v", err)
+		}
+	})
+}
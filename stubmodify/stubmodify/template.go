@@ -0,0 +1,107 @@
+package stubmodify
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Template is a signed PE file prepared for attribution. It records the
+// placeholders selected by the options it was created with, and the
+// checksum of the parts of the file which do not change, so that
+// attributing the file does not parse it again.
+//
+// A Template does not keep a reference to the file.
+type Template struct {
+	size         int
+	placeholders []Placeholder
+
+	checksum       bool
+	checkSumOffset int
+	// sum is the one's complement sum of the file with the CheckSum field
+	// and the placeholders, MozTag excluded, counted as zero.
+	sum uint32
+}
+
+// NewTemplate returns the template of mapped. opts select the placeholders
+// as for WriteAttributionCode.
+func NewTemplate(mapped []byte, opts ...Option) (*Template, error) {
+	o := newOptions(opts)
+	placeholders, err := findPlaceholders(mapped, o)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Template{
+		size:         len(mapped),
+		placeholders: placeholders,
+		checksum:     o.checksum,
+	}
+	if !o.checksum {
+		return t, nil
+	}
+
+	pe, err := parsePE(mapped)
+	if err != nil {
+		return nil, err
+	}
+	t.checkSumOffset = int(pe.checkSumOffset)
+	zeroed := make([]Patch, 0, len(placeholders))
+	for _, placeholder := range placeholders {
+		offset := placeholder.Offset + len(MozTag)
+		if offset < t.checkSumOffset+4 && offset+placeholder.Capacity > t.checkSumOffset {
+			return nil, errors.New("placeholder overlaps the CheckSum field")
+		}
+		zeroed = append(zeroed, Patch{Offset: offset, Data: make([]byte, placeholder.Capacity)})
+	}
+	t.sum = patchedSum(mapped, t.checkSumOffset, zeroed)
+
+	return t, nil
+}
+
+// Capacity returns the number of bytes available for the attribution code,
+// as AttributionCapacity does.
+func (t *Template) Capacity() int {
+	capacity := t.placeholders[0].Capacity
+	for _, placeholder := range t.placeholders[1:] {
+		if placeholder.Capacity < capacity {
+			capacity = placeholder.Capacity
+		}
+	}
+	return capacity
+}
+
+// Patches returns the patches which write code to the file the template was
+// created from. See AttributionPatches.
+func (t *Template) Patches(code []byte) ([]Patch, error) {
+	if len(code)+len(MozTag) > MaxLength {
+		return nil, errors.New("code + __MOZCUSTOM__ exceeds 1024 bytes")
+	}
+	for _, placeholder := range t.placeholders {
+		if len(code) > placeholder.Capacity {
+			return nil, fmt.Errorf("code is longer than available cert table space")
+		}
+	}
+
+	patches := make([]Patch, 0, len(t.placeholders)+1)
+	sum := t.sum
+	for _, placeholder := range t.placeholders {
+		// Write out nuls to everything in the attribution space _after_
+		// the tag -- just in case there's any previous attribution information
+		// in it.
+		data := make([]byte, placeholder.Capacity)
+		copy(data, code)
+		offset := placeholder.Offset + len(MozTag)
+		patches = append(patches, Patch{Offset: offset, Data: data})
+		// The nuls do not change the sum.
+		sum = onesComplementSum(sum, offset, code)
+	}
+
+	if t.checksum {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, sum+uint32(t.size))
+		patches = append(patches, Patch{Offset: t.checkSumOffset, Data: data})
+	}
+
+	return patches, nil
+}
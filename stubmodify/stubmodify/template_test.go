@@ -0,0 +1,106 @@
+package stubmodify
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/mozilla-services/stubattribution/internal/testpki"
+)
+
+func BenchmarkTemplatePatches(b *testing.B) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		b.Fatal("reading test-stub.exe", err)
+	}
+	template, err := NewTemplate(fileBytes, WithChecksum())
+	if err != nil {
+		b.Fatal(err)
+	}
+	code := []byte("testattributioncode&stuff")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := template.Patches(code); err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func BenchmarkAttributionPatchesChecksum(b *testing.B) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		b.Fatal("reading test-stub.exe", err)
+	}
+	code := []byte("testattributioncode&stuff")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := AttributionPatches(fileBytes, code, WithChecksum()); err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("reading test-stub.exe", err)
+	}
+	nested := testpki.PE(buildNestedWinCertificate(60, 40))
+
+	for _, tc := range []struct {
+		name     string
+		mapped   []byte
+		opts     []Option
+		checksum bool
+	}{
+		{name: "test-stub.exe", mapped: fileBytes, opts: []Option{WithChecksum()}, checksum: true},
+		{name: "nested signatures", mapped: nested, opts: []Option{WithAllSignatures(), WithChecksum()}, checksum: true},
+		{name: "without checksum", mapped: nested, opts: []Option{WithSignature(1)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			template, err := NewTemplate(tc.mapped, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			capacity, err := AttributionCapacity(tc.mapped, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if template.Capacity() != capacity {
+				t.Errorf("Capacity returned %d, expected: %d", template.Capacity(), capacity)
+			}
+
+			// Odd and even lengths write to both halves of the 16-bit words
+			// of the checksum.
+			for _, code := range []string{"a=1", "a=12", "campaign=test&source=odd"} {
+				patches, err := template.Patches([]byte(code))
+				if err != nil {
+					t.Fatal(err)
+				}
+				modBytes := ApplyPatches(tc.mapped, patches)
+
+				read, err := ReadAttributionCode(modBytes, tc.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if read.Raw != code {
+					t.Errorf("ReadAttributionCode returned %q, expected: %q", read.Raw, code)
+				}
+				if err := VerifyUnchanged(tc.mapped, modBytes); err != nil {
+					t.Errorf("Error returned: %s", err)
+				}
+				if err := VerifyChecksum(modBytes); (err == nil) != tc.checksum {
+					t.Errorf("VerifyChecksum returned %v", err)
+				}
+			}
+
+			if _, err := template.Patches(make([]byte, capacity+1)); err == nil {
+				t.Error("Expected an error writing a code longer than the capacity")
+			}
+		})
+	}
+
+	if _, err := NewTemplate(testpki.PE(nil)); err == nil {
+		t.Error("Expected an error creating the template of an unsigned file")
+	}
+}
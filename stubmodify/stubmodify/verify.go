@@ -0,0 +1,385 @@
+package stubmodify
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"   // registers crypto.SHA1
+	_ "crypto/sha512" // registers crypto.SHA384 and crypto.SHA512
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	oidSpcIndirectDataContent = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+
+	oidContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidCounterSignature = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 6}
+
+	// oidTimestampToken identifies the unauthenticated attributes containing
+	// an RFC 3161 timestamp token (SPC_RFC3161_OBJID).
+	oidTimestampToken = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+	oidTSTInfo        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+var (
+	// ErrContentDigest is returned by VerifySignature when the messageDigest
+	// attribute of a signer does not match the signed content.
+	ErrContentDigest = errors.New("messageDigest does not match the signed content")
+	// ErrImageDigest is returned by VerifySignature when the digest in
+	// SpcIndirectDataContent does not match the Authenticode digest of the
+	// file.
+	ErrImageDigest = errors.New("signed digest does not match the Authenticode digest of mapped")
+)
+
+// VerifyOptions configures VerifySignature.
+type VerifyOptions struct {
+	// Roots are the trusted root certificates. The system roots are used
+	// when it is nil.
+	Roots *x509.CertPool
+
+	// CurrentTime is the time at which the certificates must be valid when
+	// the signature has no valid timestamp. It defaults to the current time.
+	CurrentTime time.Time
+}
+
+// VerifiedSignature is an Authenticode signature checked by VerifySignature.
+type VerifiedSignature struct {
+	Signer *x509.Certificate
+	Chains [][]*x509.Certificate
+
+	// SigningTime is the time of the timestamp of the signature, or zero
+	// when the signature has no valid timestamp.
+	SigningTime time.Time
+}
+
+// VerifySignature verifies the signer of signedData, which must be an
+// Authenticode signature of mapped. Authenticode signatures have exactly one
+// signer: other signers are carried by nested signatures, see Signatures. The signature of the signer, the
+// Authenticode digest of mapped and the certificate chain of the signer, built
+// with the certificates of signedData as intermediates, are checked.
+//
+// When the signer has an Authenticode countersignature or an RFC 3161
+// timestamp, whose signature and chain up to opts.Roots are valid, the
+// certificates are checked at the time of the timestamp instead of
+// opts.CurrentTime, so that builds stay valid after their signer certificate
+// expired.
+func VerifySignature(mapped []byte, signedData *SignedData, opts VerifyOptions) (*VerifiedSignature, error) {
+	if len(signedData.SignerInfos) != 1 {
+		return nil, fmt.Errorf("SignedData has %d signers, expected exactly one", len(signedData.SignerInfos))
+	}
+	if !signedData.ContentType.Equal(oidSpcIndirectDataContent) || signedData.Content == nil {
+		return nil, fmt.Errorf("SignedData has an unsupported content type: %s", signedData.ContentType)
+	}
+
+	signerInfo := signedData.SignerInfos[0]
+	signer, err := signedData.verifyContent(signerInfo, signedData.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	// SpcIndirectDataContent ::= SEQUENCE { data SpcAttributeTypeAndOptionalValue, messageDigest DigestInfo }
+	var content struct {
+		Data          asn1.RawValue
+		MessageDigest struct {
+			DigestAlgorithm pkix.AlgorithmIdentifier
+			Digest          []byte
+		}
+	}
+	if rest, err := asn1.Unmarshal(signedData.Content, &content); err != nil {
+		return nil, fmt.Errorf("SpcIndirectDataContent: %v", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("SpcIndirectDataContent has trailing data")
+	}
+	hash, err := digestHash(content.MessageDigest.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := authenticodeDigest(mapped, hash.New())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(digest, content.MessageDigest.Digest) {
+		return nil, ErrImageDigest
+	}
+
+	currentTime := opts.CurrentTime
+	signingTime, timestampErr := signedData.verifyTimestamp(signerInfo, opts.Roots)
+	if timestampErr != nil {
+		signingTime = time.Time{}
+	} else if !signingTime.IsZero() {
+		currentTime = signingTime
+	}
+
+	chains, err := signer.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: signedData.certPool(),
+		CurrentTime:   currentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		if timestampErr != nil {
+			return nil, fmt.Errorf("%v (invalid timestamp: %v)", err, timestampErr)
+		}
+		return nil, err
+	}
+
+	return &VerifiedSignature{Signer: signer, Chains: chains, SigningTime: signingTime}, nil
+}
+
+// verifyTimestamp returns the time of the countersignature or of the RFC 3161
+// timestamp of signerInfo, or zero when there is none. The timestamp must
+// cover the signature of signerInfo and be signed by a time stamping
+// certificate which chains up to roots.
+func (s *SignedData) verifyTimestamp(signerInfo *SignerInfo, roots *x509.CertPool) (time.Time, error) {
+	for _, attr := range signerInfo.UnauthenticatedAttributes {
+		if !attr.Type.Equal(oidCounterSignature) && !attr.Type.Equal(oidTimestampToken) {
+			continue
+		}
+		if len(attr.Values) != 1 {
+			return time.Time{}, fmt.Errorf("attribute %s has %d values, expected 1", attr.Type, len(attr.Values))
+		}
+		value := attr.Values[0]
+		e, err := parseDER(value, 0, len(value))
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		var (
+			cert          *x509.Certificate
+			signingTime   time.Time
+			intermediates *x509.CertPool
+		)
+		if attr.Type.Equal(oidCounterSignature) {
+			// The countersignature is a SignerInfo over the signature of
+			// signerInfo, whose certificate is one of the certificates of s.
+			counterSigner, _, err := parseSignerInfo(value, e)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if cert, err = s.verifySignature(counterSigner, signerInfo.EncryptedDigest, nil); err != nil {
+				return time.Time{}, err
+			}
+			if err := unmarshalAttribute(counterSigner.AuthenticatedAttributes, oidSigningTime, &signingTime); err != nil {
+				return time.Time{}, err
+			}
+			intermediates = s.certPool()
+		} else {
+			token, err := parseContentInfo(value, e)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if signingTime, err = verifyTimestampToken(token, signerInfo.EncryptedDigest); err != nil {
+				return time.Time{}, err
+			}
+			if cert, err = token.verifyContent(token.SignerInfos[0], oidTSTInfo); err != nil {
+				return time.Time{}, err
+			}
+			intermediates = token.certPool()
+		}
+
+		if _, err := cert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   signingTime,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		}); err != nil {
+			return time.Time{}, err
+		}
+		return signingTime, nil
+	}
+	return time.Time{}, nil
+}
+
+// verifyTimestampToken returns the time of an RFC 3161 timestamp token, after
+// checking that its message imprint is the digest of signature.
+func verifyTimestampToken(token *SignedData, signature []byte) (time.Time, error) {
+	if !token.ContentType.Equal(oidTSTInfo) || token.Content == nil || len(token.SignerInfos) == 0 {
+		return time.Time{}, errors.New("timestamp token is malformed")
+	}
+
+	// The content is an OCTET STRING containing TSTInfo.
+	var encoded []byte
+	if _, err := asn1.Unmarshal(token.Content, &encoded); err != nil {
+		return time.Time{}, fmt.Errorf("timestamp token: %v", err)
+	}
+	var info struct {
+		Version        int
+		Policy         asn1.ObjectIdentifier
+		MessageImprint struct {
+			HashAlgorithm pkix.AlgorithmIdentifier
+			HashedMessage []byte
+		}
+		SerialNumber asn1.RawValue
+		GenTime      time.Time `asn1:"generalized"`
+	}
+	if _, err := asn1.Unmarshal(encoded, &info); err != nil {
+		return time.Time{}, fmt.Errorf("TSTInfo: %v", err)
+	}
+
+	hash, err := digestHash(info.MessageImprint.HashAlgorithm.Algorithm)
+	if err != nil {
+		return time.Time{}, err
+	}
+	h := hash.New()
+	h.Write(signature)
+	if !bytes.Equal(info.MessageImprint.HashedMessage, h.Sum(nil)) {
+		return time.Time{}, errors.New("timestamp token does not cover the signature")
+	}
+	return info.GenTime, nil
+}
+
+// verifyContent checks the signature of signerInfo over the content of s and
+// returns the signer certificate. When signerInfo has authenticated
+// attributes, their content type must be contentType.
+func (s *SignedData) verifyContent(signerInfo *SignerInfo, contentType asn1.ObjectIdentifier) (*x509.Certificate, error) {
+	// The digest covers the contents of the content, without its identifier
+	// and length octets.
+	e, err := parseDER(s.Content, 0, len(s.Content))
+	if err != nil {
+		return nil, err
+	}
+	return s.verifySignature(signerInfo, s.Content[e.start():e.end()], contentType)
+}
+
+// verifySignature checks the signature of signerInfo over content and returns
+// the signer certificate, which must be one of the certificates of s. The
+// content type is not checked when contentType is nil.
+func (s *SignedData) verifySignature(signerInfo *SignerInfo, content []byte, contentType asn1.ObjectIdentifier) (*x509.Certificate, error) {
+	cert, err := s.SignerCertificate(signerInfo)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := digestHash(signerInfo.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	algo, err := signatureAlgorithm(hash, signerInfo.DigestEncryptionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := content
+	if signerInfo.AuthenticatedAttributes != nil {
+		if contentType != nil {
+			var attrContentType asn1.ObjectIdentifier
+			if err := unmarshalAttribute(signerInfo.AuthenticatedAttributes, oidContentType, &attrContentType); err != nil {
+				return nil, err
+			}
+			if !attrContentType.Equal(contentType) {
+				return nil, fmt.Errorf("contentType attribute is %s, expected %s", attrContentType, contentType)
+			}
+		}
+
+		var messageDigest []byte
+		if err := unmarshalAttribute(signerInfo.AuthenticatedAttributes, oidMessageDigest, &messageDigest); err != nil {
+			return nil, err
+		}
+		h := hash.New()
+		h.Write(content)
+		if !bytes.Equal(messageDigest, h.Sum(nil)) {
+			return nil, ErrContentDigest
+		}
+		signed = signerInfo.RawAuthenticatedAttributes
+	}
+
+	if err := cert.CheckSignature(algo, signed, signerInfo.EncryptedDigest); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// certPool returns the certificates of s which can be parsed.
+func (s *SignedData) certPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, raw := range s.Certificates {
+		if cert, err := x509.ParseCertificate(raw); err == nil {
+			pool.AddCert(cert)
+		}
+	}
+	return pool
+}
+
+// unmarshalAttribute unmarshals the single value of the attribute with type
+// oid into out.
+func unmarshalAttribute(attrs []*Attribute, oid asn1.ObjectIdentifier, out interface{}) error {
+	for _, attr := range attrs {
+		if !attr.Type.Equal(oid) {
+			continue
+		}
+		if len(attr.Values) != 1 {
+			return fmt.Errorf("attribute %s has %d values, expected 1", oid, len(attr.Values))
+		}
+		if rest, err := asn1.Unmarshal(attr.Values[0], out); err != nil {
+			return fmt.Errorf("attribute %s: %v", oid, err)
+		} else if len(rest) > 0 {
+			return fmt.Errorf("attribute %s has trailing data", oid)
+		}
+		return nil
+	}
+	return fmt.Errorf("attribute %s not found", oid)
+}
+
+// digestHash returns the hash function identified by oid.
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm: %s", oid)
+}
+
+// signatureAlgorithm returns the signature algorithm of a signer, given its
+// digest and digest encryption algorithms. The digest encryption algorithm
+// is either a public key algorithm or a signature algorithm.
+func signatureAlgorithm(hash crypto.Hash, encryption asn1.ObjectIdentifier) (x509.SignatureAlgorithm, error) {
+	var algos map[crypto.Hash]x509.SignatureAlgorithm
+	switch {
+	case encryption.Equal(oidRSAEncryption), encryption.Equal(oidSHA1WithRSA), encryption.Equal(oidSHA256WithRSA),
+		encryption.Equal(oidSHA384WithRSA), encryption.Equal(oidSHA512WithRSA):
+		algos = map[crypto.Hash]x509.SignatureAlgorithm{
+			crypto.SHA1:   x509.SHA1WithRSA,
+			crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA,
+			crypto.SHA512: x509.SHA512WithRSA,
+		}
+	case encryption.Equal(oidECPublicKey), encryption.Equal(oidECDSAWithSHA1), encryption.Equal(oidECDSAWithSHA256),
+		encryption.Equal(oidECDSAWithSHA384), encryption.Equal(oidECDSAWithSHA512):
+		algos = map[crypto.Hash]x509.SignatureAlgorithm{
+			crypto.SHA1:   x509.ECDSAWithSHA1,
+			crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384,
+			crypto.SHA512: x509.ECDSAWithSHA512,
+		}
+	default:
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported digest encryption algorithm: %s", encryption)
+	}
+	return algos[hash], nil
+}
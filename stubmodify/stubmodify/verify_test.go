@@ -0,0 +1,192 @@
+package stubmodify
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/stubattribution/internal/testpki"
+)
+
+// testStubSigningTime is the signing time of test-stub.exe, when its signer
+// certificate was valid.
+var testStubSigningTime = time.Date(2016, 11, 24, 2, 38, 6, 0, time.UTC)
+
+// verifyMapped calls VerifySignature with the first signature of mapped.
+func verifyMapped(t *testing.T, mapped []byte, opts VerifyOptions) (*VerifiedSignature, error) {
+	certs, err := ParseCertificateTable(mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return VerifySignature(mapped, certs[0].SignedData, opts)
+}
+
+func TestVerifySignature(t *testing.T) {
+	t.Run("test-stub.exe", func(t *testing.T) {
+		fileBytes, err := ioutil.ReadFile("../../testdata/test-stub.exe")
+		if err != nil {
+			t.Fatal("reading test-stub.exe", err)
+		}
+		certs, err := ParseCertificateTable(fileBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signedData := certs[0].SignedData
+
+		// The root is included in the certificates of test-stub.exe.
+		roots := x509.NewCertPool()
+		for _, raw := range signedData.Certificates {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Subject.CommonName == "DigiCert Assured ID Root CA" {
+				roots.AddCert(cert)
+			}
+		}
+
+		verified, err := VerifySignature(fileBytes, signedData, VerifyOptions{Roots: roots, CurrentTime: testStubSigningTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verified.Signer.Subject.CommonName != "Mozilla Corporation" {
+			t.Errorf("unexpected signer: %s", verified.Signer.Subject)
+		}
+
+		// The countersignature of test-stub.exe does not chain up to roots,
+		// so the signer certificate is checked at CurrentTime.
+		if _, err := VerifySignature(fileBytes, signedData, VerifyOptions{Roots: roots, CurrentTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}); err == nil {
+			t.Error("expected an error after the signer certificate expired")
+		}
+		if _, err := VerifySignature(fileBytes, signedData, VerifyOptions{Roots: x509.NewCertPool(), CurrentTime: testStubSigningTime}); err == nil {
+			t.Error("expected an error without trusted roots")
+		}
+
+		modified := append([]byte(nil), fileBytes...)
+		modified[0x400] ^= 0xff
+		if _, err := VerifySignature(modified, signedData, VerifyOptions{Roots: roots, CurrentTime: testStubSigningTime}); err != ErrImageDigest {
+			t.Errorf("expected ErrImageDigest, got: %v", err)
+		}
+
+		// Attribution does not invalidate the signature.
+		attributed, err := WriteAttributionCode(fileBytes, []byte("campaign%3Dtest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyMapped(t, attributed, VerifyOptions{Roots: roots, CurrentTime: testStubSigningTime}); err != nil {
+			t.Errorf("attributed file: %v", err)
+		}
+	})
+
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	pki := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+	mapped := pki.SignPE(t, AuthenticodeDigest, nil)
+
+	t.Run("valid", func(t *testing.T) {
+		verified, err := verifyMapped(t, mapped, VerifyOptions{Roots: pki.Roots(), CurrentTime: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verified.Signer.Subject.CommonName != "Test Signer" || len(verified.Chains) != 1 || len(verified.Chains[0]) != 3 {
+			t.Errorf("unexpected signature: %+v", verified)
+		}
+	})
+
+	t.Run("untrusted root", func(t *testing.T) {
+		other := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+		if _, err := verifyMapped(t, mapped, VerifyOptions{Roots: other.Roots(), CurrentTime: now}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("forged signer", func(t *testing.T) {
+		// The certificate of the signer is copied into a signature made with
+		// another key.
+		forger := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+		forger.Intermediate, forger.Leaf.Cert = pki.Intermediate, pki.Leaf.Cert
+		forged := forger.SignPE(t, AuthenticodeDigest, nil)
+		if _, err := verifyMapped(t, forged, VerifyOptions{Roots: pki.Roots(), CurrentTime: now}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("other file", func(t *testing.T) {
+		certs, err := ParseCertificateTable(mapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := append([]byte(nil), mapped...)
+		other[0x100] ^= 0xff
+		if _, err := VerifySignature(other, certs[0].SignedData, VerifyOptions{Roots: pki.Roots(), CurrentTime: now}); err != ErrImageDigest {
+			t.Errorf("expected ErrImageDigest, got: %v", err)
+		}
+	})
+
+	t.Run("modified content", func(t *testing.T) {
+		certs, err := ParseCertificateTable(mapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signedData := *certs[0].SignedData
+		signedData.Content = append([]byte(nil), signedData.Content...)
+		signedData.Content[len(signedData.Content)-1] ^= 0xff
+		if _, err := VerifySignature(mapped, &signedData, VerifyOptions{Roots: pki.Roots(), CurrentTime: now}); err != ErrContentDigest {
+			t.Errorf("expected ErrContentDigest, got: %v", err)
+		}
+	})
+
+	t.Run("two signers", func(t *testing.T) {
+		certs, err := ParseCertificateTable(mapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signedData := *certs[0].SignedData
+		signedData.SignerInfos = append(signedData.SignerInfos, signedData.SignerInfos[0])
+		if _, err := VerifySignature(mapped, &signedData, VerifyOptions{Roots: pki.Roots(), CurrentTime: now}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		if _, err := verifyMapped(t, mapped, VerifyOptions{Roots: pki.Roots(), CurrentTime: now.Add(2 * time.Hour)}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+	later := now.Add(24 * time.Hour)
+	other := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+	for _, tt := range []struct {
+		name      string
+		timestamp testpki.Unauthenticated
+		valid     bool
+	}{
+		{"countersignature", pki.TSA.CounterSignature(now), true},
+		{"RFC 3161", pki.TSA.TimestampToken(now, pki.Intermediate.Cert), true},
+		{"countersignature of another signature", func(t testing.TB, signature []byte) [][]byte {
+			return pki.TSA.CounterSignature(now)(t, []byte("other"))
+		}, false},
+		{"RFC 3161 of another signature", func(t testing.TB, signature []byte) [][]byte {
+			return pki.TSA.TimestampToken(now, pki.Intermediate.Cert)(t, []byte("other"))
+		}, false},
+		{"countersignature after expiry", pki.TSA.CounterSignature(later), false},
+		{"countersignature without time stamping usage", pki.Leaf.CounterSignature(now), false},
+		{"RFC 3161 by an untrusted TSA", other.TSA.TimestampToken(now, other.Intermediate.Cert), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			timestamped := pki.SignPE(t, AuthenticodeDigest, tt.timestamp)
+			verified, err := verifyMapped(t, timestamped, VerifyOptions{Roots: pki.Roots(), CurrentTime: later})
+			if !tt.valid {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !verified.SigningTime.Equal(now) {
+				t.Errorf("expected signing time %s, got %s", now, verified.SigningTime)
+			}
+		})
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/ed25519"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -27,7 +27,9 @@ import (
 )
 
 const (
-	hmacTimeoutDefault = 10 * time.Minute
+	hmacTimeoutDefault   = 10 * time.Minute
+	hmacClockSkewDefault = time.Minute
+	replayMaxKeysDefault = 100000
 	// versionFilePath is the path to the `version.json` file in the Docker container.
 	versionFilePath = "/app/version.json"
 )
@@ -38,9 +40,37 @@ var (
 	bouncerBaseURL = os.Getenv("BOUNCER_BASE_URL")
 
 	hmacKey        = os.Getenv("HMAC_KEY")
+	hmacKeysEnv    = os.Getenv("HMAC_KEYS")
+	hmacKeys       []*attributioncode.HMACKey
 	hmacTimeoutEnv = os.Getenv("HMAC_TIMEOUT")
 	hmacTimeout    = hmacTimeoutDefault
 
+	ed25519KeysEnv = os.Getenv("ED25519_KEYS")
+	ed25519Keys    []*attributioncode.Ed25519Key
+
+	pingdomEd25519KeyEnv = os.Getenv("PINGDOM_ED25519_KEY")
+	pingdomSigner        attributioncode.Signer
+
+	hmacClockSkewEnv = os.Getenv("HMAC_CLOCK_SKEW")
+	hmacClockSkew    = hmacClockSkewDefault
+
+	attributionSchemaPath = os.Getenv("ATTRIBUTION_SCHEMA")
+	attributionSchema     = attributioncode.DefaultSchema()
+
+	signerAllowlistEnv    = os.Getenv("SIGNER_ALLOWLIST")
+	signerRootsPath       = os.Getenv("SIGNER_ROOTS")
+	verifyAuthenticodeEnv = os.Getenv("VERIFY_AUTHENTICODE")
+
+	partnerProfilesPath = os.Getenv("PARTNER_PROFILES")
+	partnerProfiles     = attributioncode.DefaultPartnerProfiles()
+
+	replayMaxUsesEnv       = os.Getenv("REPLAY_MAX_USES")
+	replaySourceMaxUsesEnv = os.Getenv("REPLAY_SOURCE_MAX_USES")
+	replayTTLEnv           = os.Getenv("REPLAY_TTL")
+	replayMaxKeysEnv       = os.Getenv("REPLAY_MAX_KEYS")
+	replayActionEnv        = os.Getenv("REPLAY_ACTION")
+	replayGuard            *attributioncode.ReplayGuard
+
 	returnMode = os.Getenv("RETURN_MODE")
 
 	storageBackend = os.Getenv("STORAGE_BACKEND")
@@ -141,6 +171,143 @@ func init() {
 		}
 		hmacTimeout = d
 	}
+
+	if hmacKeysEnv != "" {
+		keys, err := attributioncode.ParseHMACKeys([]byte(hmacKeysEnv))
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not parse HMAC_KEYS")
+		}
+		hmacKeys = keys
+	}
+
+	if ed25519KeysEnv != "" {
+		keys, err := attributioncode.ParseEd25519Keys([]byte(ed25519KeysEnv))
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not parse ED25519_KEYS")
+		}
+		ed25519Keys = keys
+	}
+
+	if pingdomEd25519KeyEnv != "" {
+		pingdomSigner = parsePingdomSigner()
+	}
+
+	if attributionSchemaPath != "" {
+		schema, err := attributioncode.LoadSchema(attributionSchemaPath)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not load ATTRIBUTION_SCHEMA")
+		}
+		attributionSchema = schema
+	}
+
+	if signerAllowlistEnv != "" {
+		rules, err := stubhandlers.ParseSignerAllowlist([]byte(signerAllowlistEnv))
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not parse SIGNER_ALLOWLIST")
+		}
+		stubhandlers.SignerAllowlist = rules
+	}
+
+	if signerRootsPath != "" {
+		pem, err := ioutil.ReadFile(signerRootsPath)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not read SIGNER_ROOTS")
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			logrus.Fatal("SIGNER_ROOTS does not contain any PEM certificate")
+		}
+		stubhandlers.SignerRoots = roots
+	}
+
+	if verify, err := strconv.ParseBool(verifyAuthenticodeEnv); err == nil {
+		stubhandlers.VerifyAuthenticode = verify
+	}
+
+	if partnerProfilesPath != "" {
+		profiles, err := attributioncode.LoadPartnerProfiles(partnerProfilesPath)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not load PARTNER_PROFILES")
+		}
+		partnerProfiles = profiles
+	}
+
+	if hmacClockSkewEnv != "" {
+		d, err := time.ParseDuration(hmacClockSkewEnv)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not parse HMAC_CLOCK_SKEW")
+		}
+		hmacClockSkew = d
+	}
+
+	if replayMaxUsesEnv != "" {
+		replayGuard = parseReplayGuard()
+	}
+}
+
+func parseReplayGuard() *attributioncode.ReplayGuard {
+	guard := &attributioncode.ReplayGuard{
+		TTL:    hmacTimeout + hmacClockSkew,
+		Action: attributioncode.ReplayUnattributed,
+	}
+
+	maxUses, err := strconv.Atoi(replayMaxUsesEnv)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse REPLAY_MAX_USES")
+	}
+	guard.MaxUses = maxUses
+
+	if replaySourceMaxUsesEnv != "" {
+		if err := json.Unmarshal([]byte(replaySourceMaxUsesEnv), &guard.SourceMaxUses); err != nil {
+			logrus.WithError(err).Fatal("Could not parse REPLAY_SOURCE_MAX_USES")
+		}
+	}
+
+	if replayTTLEnv != "" {
+		d, err := time.ParseDuration(replayTTLEnv)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not parse REPLAY_TTL")
+		}
+		guard.TTL = d
+	}
+
+	maxKeys := replayMaxKeysDefault
+	if replayMaxKeysEnv != "" {
+		if maxKeys, err = strconv.Atoi(replayMaxKeysEnv); err != nil {
+			logrus.WithError(err).Fatal("Could not parse REPLAY_MAX_KEYS")
+		}
+	}
+	guard.Store = attributioncode.NewMemoryReplayStore(maxKeys)
+
+	switch action := attributioncode.ReplayAction(replayActionEnv); action {
+	case "":
+	case attributioncode.ReplayReject, attributioncode.ReplayUnattributed:
+		guard.Action = action
+	default:
+		logrus.WithField("action", action).Fatal("Invalid REPLAY_ACTION value")
+	}
+
+	return guard
+}
+
+// parsePingdomSigner returns a signer for PINGDOM_ED25519_KEY, which is given
+// the ID of the matching key of ED25519_KEYS.
+func parsePingdomSigner() attributioncode.Signer {
+	seed, err := base64.StdEncoding.DecodeString(pingdomEd25519KeyEnv)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		logrus.Fatalf("PINGDOM_ED25519_KEY must be a base64 encoded %d byte seed", ed25519.SeedSize)
+	}
+
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	for _, key := range ed25519Keys {
+		if publicKey.Equal(key.PublicKey) {
+			return &attributioncode.Ed25519Signer{ID: key.ID, PrivateKey: privateKey}
+		}
+	}
+
+	logrus.Fatal("PINGDOM_ED25519_KEY does not match any key of ED25519_KEYS")
+	return nil
 }
 
 func okHandler(w http.ResponseWriter, req *http.Request) {
@@ -159,27 +326,30 @@ func versionHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write(versionFile)
 }
 
-func pingdomHandler(w http.ResponseWriter, req *http.Request) {
-	attrQuery := url.Values{}
-	attrQuery.Set("source", "mozilla.com")
-	attrQuery.Set("medium", "pingdom")
-	attrQuery.Set("campaign", "pingdom")
-	attrQuery.Set("content", "pingdom")
-	attrQuery.Set("experiment", "pingdom")
-	attrQuery.Set("variation", "pingdom")
-	b64AttrQuery := base64.URLEncoding.WithPadding('.').EncodeToString([]byte(attrQuery.Encode()))
-
-	query := url.Values{}
-	query.Set("product", "test-stub")
-	query.Set("os", "win")
-	query.Set("lang", "en-US")
-	query.Set("attribution_code", b64AttrQuery)
-	if hmacKey != "" {
-		hasher := hmac.New(sha256.New, []byte(hmacKey))
-		hasher.Write([]byte(b64AttrQuery))
-		query.Set("attribution_sig", fmt.Sprintf("%x", hasher.Sum(nil)))
-	}
-	http.Redirect(w, req, baseURL+"?"+query.Encode(), http.StatusFound)
+func pingdomHandler(validator *attributioncode.Validator) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		attrQuery := url.Values{}
+		attrQuery.Set("source", "mozilla.com")
+		attrQuery.Set("medium", "pingdom")
+		attrQuery.Set("campaign", "pingdom")
+		attrQuery.Set("content", "pingdom")
+		attrQuery.Set("experiment", "pingdom")
+		attrQuery.Set("variation", "pingdom")
+
+		now := time.Now()
+		signer := pingdomSigner
+		if signer == nil {
+			if key := validator.ActiveHMACKey(now); key != nil {
+				signer = &attributioncode.HMACSigner{ID: key.ID, Secret: key.Secret}
+			}
+		}
+
+		query := attributioncode.Sign(attrQuery, signer, now).Query()
+		query.Set("product", "test-stub")
+		query.Set("os", "win")
+		query.Set("lang", "en-US")
+		http.Redirect(w, req, baseURL+"?"+query.Encode(), http.StatusFound)
+	}
 }
 
 func main() {
@@ -208,9 +378,20 @@ func main() {
 		stubHandler = stubhandlers.NewDirectHandler(bouncerBaseURL)
 	}
 
+	validator := attributioncode.NewValidator(hmacKey, hmacTimeout)
+	validator.ClockSkew = hmacClockSkew
+	validator.HMACKeys = append(validator.HMACKeys, hmacKeys...)
+	validator.Ed25519Keys = ed25519Keys
+	if err := validator.CheckKeyIDs(); err != nil {
+		logrus.WithError(err).Fatal("Invalid HMAC_KEY, HMAC_KEYS or ED25519_KEYS")
+	}
+	validator.Schema = attributionSchema
+	validator.PartnerProfiles = partnerProfiles
+	validator.ReplayGuard = replayGuard
+
 	stubService := stubhandlers.NewStubService(
 		stubHandler,
-		attributioncode.NewValidator(hmacKey, hmacTimeout),
+		validator,
 		bouncerBaseURL,
 	)
 
@@ -227,7 +408,7 @@ func main() {
 	mux.HandleFunc("/__lbheartbeat__", okHandler)
 	mux.HandleFunc("/__heartbeat__", okHandler)
 	mux.HandleFunc("/__version__", versionHandler)
-	mux.HandleFunc("/__pingdom__", pingdomHandler)
+	mux.HandleFunc("/__pingdom__", pingdomHandler(validator))
 
 	logrus.Fatal(http.ListenAndServe(addr, mux))
 }
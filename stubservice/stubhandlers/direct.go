@@ -27,16 +27,15 @@ func NewDirectHandler(bouncerBaseURL string) StubHandler {
 // ServeStub serves stub bytes directly through handler
 func (s *directHandler) ServeStub(w http.ResponseWriter, req *http.Request, code *attributioncode.Code) error {
 	query := req.URL.Query()
-	product := query.Get("product")
+	product := stubProduct(code, query.Get("product"))
 	lang := query.Get("lang")
 	os := query.Get("os")
-	attributionCode := code.URLEncode()
 
-	stub, err := sfFetchStub(s.sfGroup, bouncerURL(product, lang, os, s.BouncerBaseURL))
+	stub, err := sfFetchStub(s.sfGroup, bouncerURL(product, lang, os, s.BouncerBaseURL), os)
 	if err != nil {
 		return errors.Wrap(err, "fetchStub")
 	}
-	stub, err = modifyStub(stub, attributionCode, os)
+	stub, _, err = modifyStub(stub, code, os)
 	if err != nil {
 		return err
 	}
@@ -44,7 +43,7 @@ func (s *directHandler) ServeStub(w http.ResponseWriter, req *http.Request, code
 	// Cache response for one week
 	w.Header().Set("Cache-Control", "max-age=604800")
 	w.Header().Set("Content-Type", stub.contentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(stub.body)))
-	w.Write(stub.body)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", stub.size()))
+	stub.reader().WriteTo(w)
 	return nil
 }
@@ -1,7 +1,6 @@
 package stubhandlers
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"net/http"
@@ -17,10 +16,6 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// This prefix is prepended to the product value when we construct a storage key
-// and the attribution code contains data for RTAMO.
-const rtamoProductPrefix = "rtamo-"
-
 // redirectHandler serves redirects to modified stub binaries
 type redirectHandler struct {
 	CDNPrefix string
@@ -51,10 +46,9 @@ func NewRedirectHandler(storage backends.Storage, cdnPrefix, keyPrefix string, b
 // ServeStub redirects to modified stub
 func (s *redirectHandler) ServeStub(w http.ResponseWriter, req *http.Request, code *attributioncode.Code) error {
 	query := req.URL.Query()
-	product := query.Get("product")
+	product := stubProduct(code, query.Get("product"))
 	lang := query.Get("lang")
 	os := query.Get("os")
-	attributionCode := code.URLEncode()
 
 	bURL := bouncerURL(product, lang, os, s.BouncerBaseURL)
 
@@ -68,23 +62,18 @@ func (s *redirectHandler) ServeStub(w http.ResponseWriter, req *http.Request, co
 		return errors.Wrap(err, "QueryUnescape")
 	}
 
-	if code.FromRTAMO() {
-		product = rtamoProductPrefix + product
+	// The storage key prefix keeps partner downloads separate.
+	if partner := code.Partner(); partner != nil && partner.StorageKeyPrefix != "" {
+		product = partner.StorageKeyPrefix + product
 		logrus.WithFields(logrus.Fields{
-			"prefix":  rtamoProductPrefix,
+			"partner": partner.Name,
+			"prefix":  partner.StorageKeyPrefix,
 			"product": product,
-		}).Info("Updated product value in storage key for RTAMO")
+		}).Info("Updated product value in storage key for partner")
 	}
 
-	key := (s.KeyPrefix + "builds/" +
-		storagePathEscape(product) + "/" +
-		storagePathEscape(lang) + "/" +
-		storagePathEscape(os) + "/" +
-		uniqueKey(cdnURL, attributionCode) + "/" +
-		filename)
-
 	sfRes, err := s.sfGroup.Do(bURL, func() (interface{}, error) {
-		stub, err := fetchStub(bURL)
+		stub, err := fetchStub(bURL, os)
 		if err != nil {
 			return nil, err
 		}
@@ -97,12 +86,19 @@ func (s *redirectHandler) ServeStub(w http.ResponseWriter, req *http.Request, co
 
 	stub := sfRes.(*stub)
 
-	stub, err = modifyStub(stub, attributionCode, os)
+	stub, payload, err := modifyStub(stub, code, os)
 	if err != nil {
 		return err
 	}
 
-	if err := s.Storage.Put(key, stub.contentType, bytes.NewReader(stub.body)); err != nil {
+	key := (s.KeyPrefix + "builds/" +
+		storagePathEscape(product) + "/" +
+		storagePathEscape(lang) + "/" +
+		storagePathEscape(os) + "/" +
+		uniqueKey(cdnURL, payload.Code) + "/" +
+		filename)
+
+	if err := s.Storage.Put(key, stub.contentType, stub.readSeeker()); err != nil {
 		return errors.Wrapf(err, "Put key: %s", key)
 	}
 
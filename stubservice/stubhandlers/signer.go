@@ -0,0 +1,134 @@
+package stubhandlers
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/stubattribution/stubmodify/stubmodify"
+	"github.com/pkg/errors"
+)
+
+// SignerRule matches the certificate which signed a Windows build. Every
+// field which is set must match.
+type SignerRule struct {
+	// Subject is the subject of the certificate, formatted by
+	// pkix.Name.String, e.g. "CN=Mozilla Corporation,O=Mozilla Corporation,L=Mountain View,ST=California,C=US".
+	Subject string `json:"subject"`
+
+	// SPKISHA256 is the hex encoded SHA-256 hash of the DER encoded
+	// SubjectPublicKeyInfo of the certificate.
+	SPKISHA256 string `json:"spki_sha256"`
+}
+
+// SignerAllowlist lists the certificates allowed to sign the Windows builds
+// fetched from bouncer. Builds are not checked when it is empty.
+var SignerAllowlist []*SignerRule
+
+// SignerRoots are the roots trusted for the certificate chains of the signers
+// of Windows builds. The system roots are used when it is nil.
+var SignerRoots *x509.CertPool
+
+// ParseSignerAllowlist parses a JSON list of signer rules, e.g.:
+//
+//	[{"subject": "CN=Mozilla Corporation,O=Mozilla Corporation,L=Mountain View,ST=California,C=US"}]
+func ParseSignerAllowlist(data []byte) ([]*SignerRule, error) {
+	var rules []*SignerRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+
+	for i, rule := range rules {
+		if rule.Subject == "" && rule.SPKISHA256 == "" {
+			return nil, errors.Errorf("rule %d has neither subject nor spki_sha256", i)
+		}
+		if rule.SPKISHA256 != "" {
+			if sum, err := hex.DecodeString(rule.SPKISHA256); err != nil || len(sum) != sha256.Size {
+				return nil, errors.Errorf("rule %d has an invalid spki_sha256: %s", i, rule.SPKISHA256)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// untrustedStubError is a fetchStubError for Windows builds which are not
+// signed by a certificate in SignerAllowlist.
+type untrustedStubError struct {
+	*fetchStubError
+	Subject string
+}
+
+// isWindows returns true when os is a bouncer identifier for a Windows
+// build, e.g. "win", "win64" or "win64-aarch64".
+func isWindows(os string) bool {
+	return strings.HasPrefix(os, "win")
+}
+
+// checkSigner returns an error when an Authenticode signature of the Windows
+// build in body is not valid, or its signer is not in SignerAllowlist. Every
+// signature returned by stubmodify.Signatures is checked, nested ones included,
+// so that a build cannot carry a signature which is not allowed next to one
+// which is. The signature, the digest of body and the certificate chain of the
+// signer, up to SignerRoots, are verified before the rules are matched. The
+// chain is checked at the time of the timestamp of the signature, or at now
+// when it is not timestamped. The subject of the signer of the primary
+// signature, or of the first rejected one, is returned when it is known.
+func checkSigner(body []byte, now time.Time) (string, error) {
+	signatures, err := stubmodify.Signatures(body)
+	if err != nil {
+		return "", errors.Wrap(err, "Signatures")
+	}
+	if len(signatures) == 0 {
+		return "", errors.New("build has no Authenticode signature")
+	}
+
+	primary := ""
+	for i, signature := range signatures {
+		subject, err := checkSignature(body, signature.SignedData, now)
+		if err != nil {
+			return subject, errors.Wrapf(err, "signature %d", i)
+		}
+		if i == 0 {
+			primary = subject
+		}
+	}
+	return primary, nil
+}
+
+// checkSignature verifies a single Authenticode signature of body and matches
+// its signer against SignerAllowlist.
+func checkSignature(body []byte, signedData *stubmodify.SignedData, now time.Time) (string, error) {
+	subject := ""
+	if len(signedData.SignerInfos) > 0 {
+		if leaf, err := signedData.SignerCertificate(signedData.SignerInfos[0]); err == nil {
+			subject = leaf.Subject.String()
+		}
+	}
+
+	verified, err := stubmodify.VerifySignature(body, signedData, stubmodify.VerifyOptions{
+		Roots:       SignerRoots,
+		CurrentTime: now,
+	})
+	if err != nil {
+		return subject, errors.Wrap(err, "VerifySignature")
+	}
+	leaf := verified.Signer
+
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	spkiHash := hex.EncodeToString(spki[:])
+	for _, rule := range SignerAllowlist {
+		if rule.Subject != "" && rule.Subject != subject {
+			continue
+		}
+		if rule.SPKISHA256 != "" && !strings.EqualFold(rule.SPKISHA256, spkiHash) {
+			continue
+		}
+		return subject, nil
+	}
+
+	return subject, errors.Errorf("signer is not allowed: %s", subject)
+}
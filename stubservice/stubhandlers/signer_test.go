@@ -0,0 +1,157 @@
+package stubhandlers
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/stubattribution/attributioncode"
+	"github.com/mozilla-services/stubattribution/internal/testpki"
+	"github.com/mozilla-services/stubattribution/stubmodify/stubmodify"
+	"github.com/mozilla-services/stubattribution/stubservice/backends"
+)
+
+func TestCheckSigner(t *testing.T) {
+	now := time.Now()
+	pki := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+	pe := pki.SignPE(t, stubmodify.AuthenticodeDigest, nil)
+	spki := sha256.Sum256(pki.Leaf.Cert.RawSubjectPublicKeyInfo)
+	spkiHash := hex.EncodeToString(spki[:])
+
+	expired := testpki.NewPKI(t, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	notYetValid := testpki.NewPKI(t, now.Add(time.Hour), now.Add(2*time.Hour))
+	untrusted := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+
+	// A signature made with another key, carrying the certificates of pki.
+	forged := (&testpki.Signer{Cert: pki.Leaf.Cert, Key: untrusted.Leaf.Key}).SignPE(t, stubmodify.AuthenticodeDigest, pki.Certificates(), nil)
+
+	// Builds carrying a second signature, nested in the primary one or in a
+	// second certificate table entry.
+	other := testpki.NewPKI(t, now.Add(-time.Hour), now.Add(time.Hour))
+	digest, err := stubmodify.AuthenticodeDigest(testpki.PE(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested := func(p *testpki.PKI) []byte {
+		return pki.SignPE(t, stubmodify.AuthenticodeDigest, testpki.Nested(p.Authenticode(t, digest, nil)))
+	}
+	secondEntry := func(p *testpki.PKI) []byte {
+		return testpki.PE(append(testpki.Entry(pki.Authenticode(t, digest, nil)), testpki.Entry(p.Authenticode(t, digest, nil))...))
+	}
+
+	modified := append([]byte(nil), pe...)
+	modified[0x100] ^= 0xff
+
+	SignerRoots = x509.NewCertPool()
+	for _, p := range []*testpki.PKI{pki, expired, notYetValid, other} {
+		SignerRoots.AddCert(p.Root.Cert)
+	}
+	defer func() { SignerAllowlist, SignerRoots = nil, nil }()
+
+	for _, test := range []struct {
+		name    string
+		rules   []*SignerRule
+		pe      []byte
+		allowed bool
+	}{
+		{"subject", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, pe, true},
+		{"spki", []*SignerRule{{SPKISHA256: spkiHash}}, pe, true},
+		{"subject and spki", []*SignerRule{{Subject: "CN=Test Signer,O=Test", SPKISHA256: spkiHash}}, pe, true},
+		{"second rule", []*SignerRule{{Subject: "CN=Other"}, {SPKISHA256: spkiHash}}, pe, true},
+		{"wrong subject", []*SignerRule{{Subject: "CN=Other"}}, pe, false},
+		{"wrong spki", []*SignerRule{{Subject: "CN=Test Signer,O=Test", SPKISHA256: hex.EncodeToString(make([]byte, 32))}}, pe, false},
+		{"expired", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, expired.SignPE(t, stubmodify.AuthenticodeDigest, nil), false},
+		{"not yet valid", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, notYetValid.SignPE(t, stubmodify.AuthenticodeDigest, nil), false},
+		{"untrusted root", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, untrusted.SignPE(t, stubmodify.AuthenticodeDigest, nil), false},
+		{"forged signature", []*SignerRule{{SPKISHA256: spkiHash}}, forged, false},
+		{"modified build", []*SignerRule{{SPKISHA256: spkiHash}}, modified, false},
+		{"nested signature", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, nested(other), true},
+		{"nested signer not allowed", []*SignerRule{{SPKISHA256: spkiHash}}, nested(other), false},
+		{"nested untrusted root", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, nested(untrusted), false},
+		{"nested expired", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, nested(expired), false},
+		{"second entry", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, secondEntry(other), true},
+		{"second entry not allowed", []*SignerRule{{SPKISHA256: spkiHash}}, secondEntry(other), false},
+		{"second entry untrusted root", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, secondEntry(untrusted), false},
+		{"unsigned", []*SignerRule{{Subject: "CN=Test Signer,O=Test"}}, pe[:testpki.PEHeaderSize], false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			SignerAllowlist = test.rules
+			_, err := checkSigner(test.pe, now)
+			if test.allowed && err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			if !test.allowed && err == nil {
+				t.Error("Expected the signer to be rejected")
+			}
+		})
+	}
+
+	t.Run("fetchStub", func(t *testing.T) {
+		SignerAllowlist = []*SignerRule{{Subject: "CN=Other"}}
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(pe)
+		}))
+		defer s.Close()
+
+		_, err := fetchStub(s.URL+"/untrusted", "win")
+		untrusted, ok := err.(*untrustedStubError)
+		if !ok {
+			t.Fatalf("Expected an untrustedStubError, got: %v", err)
+		}
+		if untrusted.Subject != "CN=Test Signer,O=Test" {
+			t.Errorf("Unexpected subject: %s", untrusted.Subject)
+		}
+
+		SignerAllowlist = []*SignerRule{{SPKISHA256: spkiHash}}
+		if _, err := fetchStub(s.URL+"/trusted", "win"); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	})
+	t.Run("non-PE Windows build", func(t *testing.T) {
+		SignerAllowlist = []*SignerRule{{SPKISHA256: spkiHash}}
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/":
+				http.Redirect(w, req, server.URL+"/pub/firefox/releases/51.0.1/win32/en-US/Firefox Setup 51.0.1.exe", 302)
+			default:
+				w.Write([]byte("<html>Under maintenance</html>"))
+			}
+		}))
+		defer server.Close()
+
+		bouncerBaseURL := server.URL + "/"
+		for _, handler := range []struct {
+			name    string
+			handler StubHandler
+		}{
+			{"redirect", NewRedirectHandler(backends.NewMapStorage(), server.URL+"/cdn/", "", bouncerBaseURL)},
+			{"direct", NewDirectHandler(bouncerBaseURL)},
+		} {
+			svc := NewStubService(handler.handler, &attributioncode.Validator{}, bouncerBaseURL)
+
+			sentMetrics := recordMetrics(t)
+			base64Code := base64.URLEncoding.WithPadding('.').EncodeToString([]byte("campaign=test&source=mozilla.com"))
+			recorder := httptest.NewRecorder()
+			svc.ServeHTTP(recorder, httptest.NewRequest("GET", "http://test/?product=firefox-stub&os=win&lang=en-US&attribution_code="+url.QueryEscape(base64Code), nil))
+
+			location := recorder.Result().Header.Get("Location")
+			if recorder.Code != 302 || location != bouncerBaseURL+"?lang=en-US&os=win&product=firefox-stub" {
+				t.Errorf("%s: service did not return bouncer redirect status: %d loc: %s", handler.name, recorder.Code, location)
+			}
+			lines := sentMetrics()
+			if !hasMetric(lines, "fetch_stub.untrusted") {
+				t.Errorf("%s: fetch_stub.untrusted was not sent: %v", handler.name, lines)
+			}
+			if !hasMetric(lines, "request.error:1|c|#error_type:untrustedstub") {
+				t.Errorf("%s: request.error was not sent as untrustedstub: %v", handler.name, lines)
+			}
+		}
+	})
+}
@@ -1,6 +1,14 @@
 package stubhandlers
 
-import "time"
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/mozilla-services/stubattribution/dmglib"
+	"github.com/mozilla-services/stubattribution/dmgmodify/dmgmodify"
+	"github.com/mozilla-services/stubattribution/stubmodify/stubmodify"
+)
 
 var globalStubCache = newStubCache(
 	1024*1024*1000, // 1G
@@ -8,18 +16,49 @@ var globalStubCache = newStubCache(
 )
 
 type stub struct {
-	body        []byte
+	body []byte
+	// patches are applied to body when the stub is served, so that body can
+	// be shared with the stub cache.
+	patches     []stubmodify.Patch
 	contentType string
 	filename    string
+	// sha256 is the hex encoded SHA-256 hash of body, computed once when the
+	// stub is fetched.
+	sha256 string
+
+	// peTemplate and dmgTemplate are the attribution templates of body,
+	// computed when the stub is added to the stub cache.
+	peTemplate  *stubmodify.Template
+	dmgTemplate *dmgmodify.Template
 }
 
-func (s *stub) copy() *stub {
-	b := make([]byte, len(s.body))
-	copy(b, s.body)
-	return &stub{
-		contentType: s.contentType,
-		body:        b,
+// prepareTemplates computes the attribution template of the body for os, so
+// that modifyStub does not parse it again for every request. Errors are
+// ignored: modifyStub returns them when it tries to compute the template
+// itself.
+func (s *stub) prepareTemplates(os string) {
+	if os == "osx" {
+		if dmg, err := dmglib.ParseDMG(bytes.NewReader(s.body)); err == nil {
+			s.dmgTemplate, _ = dmgmodify.NewTemplate(dmg)
+		}
+		return
 	}
+	s.peTemplate, _ = stubmodify.NewTemplate(s.body)
+}
+
+// reader returns a view of the body with the patches applied.
+func (s *stub) reader() *stubmodify.PatchedFile {
+	return stubmodify.NewPatchedFile(s.body, s.patches)
+}
+
+// size returns the size of the served stub.
+func (s *stub) size() int64 {
+	return int64(len(s.body))
+}
+
+// readSeeker returns a io.ReadSeeker over the served stub.
+func (s *stub) readSeeker() io.ReadSeeker {
+	return io.NewSectionReader(s.reader(), 0, s.size())
 }
 
 type stubCache struct {
@@ -38,10 +77,11 @@ func (s *stubCache) Add(key string, st *stub) {
 	s.cache.Add(key, st, size)
 }
 
-// Get returns a copy, if it exists so the original data is never corrupted
-func (s *stubCache) Get(key string) *stub {
+// GetShared returns the cached stub, if it exists, without copying it. The
+// stub must not be modified.
+func (s *stubCache) GetShared(key string) *stub {
 	if val, hit := s.cache.Get(key); hit {
-		return val.(*stub).copy()
+		return val.(*stub)
 	}
 	return nil
 }
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/mozilla-services/stubattribution/attributioncode"
 	"github.com/mozilla-services/stubattribution/stubservice/backends"
@@ -34,7 +35,7 @@ func TestUniqueKey(t *testing.T) {
 	f := func(url, code string) bool {
 		key := uniqueKey(url, code)
 		if len(key) != 64 {
-			fmt.Errorf("key not 64 char url: %s, code %s: len: %d", url, code, len(key))
+			t.Errorf("key not 64 char url: %s, code %s: len: %d", url, code, len(key))
 			return false
 		}
 		return true
@@ -49,7 +50,7 @@ func TestStoragePathEscape(t *testing.T) {
 	f := func(in string) bool {
 		key := storagePathEscape(in)
 		if regexp.MustCompile("^[a-z]*$").MatchString(key) {
-			fmt.Errorf("key not escaped key: %s, in: %s", key, in)
+			t.Errorf("key not escaped key: %s, in: %s", key, in)
 			return false
 		}
 		return true
@@ -376,6 +377,87 @@ func TestRedirectFull(t *testing.T) {
 	}
 }
 
+func TestRedirectPartnerProfile(t *testing.T) {
+	testFileBytes, err := os.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatal("could not read test-stub.exe", err)
+	}
+
+	storage := backends.NewMapStorage()
+
+	var server *httptest.Server
+	var requestedProduct string
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			requestedProduct = req.URL.Query().Get("product")
+			http.Redirect(w, req, server.URL+"/pub/firefox/Firefox Setup.exe", 302)
+		case "/pub/firefox/Firefox Setup.exe":
+			w.Write(testFileBytes)
+		}
+	}))
+	defer server.Close()
+
+	svc := NewStubService(
+		NewRedirectHandler(storage, server.URL+"/cdn/", "", server.URL),
+		&attributioncode.Validator{
+			PartnerProfiles: []*attributioncode.PartnerProfile{{
+				Name:             "partner",
+				ContentPrefix:    "ptr:",
+				AllowedReferers:  []string{"https://partner.example"},
+				StorageKeyPrefix: "partner-",
+				Product:          "firefox-partner-stub",
+			}},
+		},
+		server.URL,
+	)
+
+	for _, params := range []struct {
+		Content          string
+		Referer          string
+		ExpectedProduct  string
+		ExpectedLocation string
+	}{
+		{
+			Content:          "ptr:abc",
+			Referer:          "https://partner.example/download",
+			ExpectedProduct:  "firefox-partner-stub",
+			ExpectedLocation: server.URL + "/cdn/builds/partner-firefox-partner-stub/en-US/win/",
+		},
+		{
+			// RTAMO is not configured, so this is a regular download.
+			Content:          "rta:abc",
+			ExpectedProduct:  "firefox-stub",
+			ExpectedLocation: server.URL + "/cdn/builds/firefox-stub/en-US/win/",
+		},
+		{
+			// The referer is not allowed for this partner.
+			Content:          "ptr:abc",
+			Referer:          "https://www.mozilla.org/",
+			ExpectedLocation: server.URL + "?lang=en-US&os=win&product=firefox-stub",
+		},
+	} {
+		requestedProduct = ""
+		base64Code := base64.URLEncoding.WithPadding('.').EncodeToString([]byte("source=partner&content=" + params.Content))
+		req := httptest.NewRequest(
+			"GET",
+			`http://test/?product=firefox-stub&os=win&lang=en-US&attribution_code=`+url.QueryEscape(base64Code),
+			nil,
+		)
+		req.Header.Set("Referer", params.Referer)
+		recorder := httptest.NewRecorder()
+		svc.ServeHTTP(recorder, req)
+
+		location := recorder.Result().Header.Get("Location")
+		if !strings.HasPrefix(location, params.ExpectedLocation) {
+			t.Errorf("content: %s, unexpected location: %s", params.Content, location)
+		}
+		if requestedProduct != params.ExpectedProduct {
+			t.Errorf("content: %s, expected product: %s, got: %s", params.Content, params.ExpectedProduct, requestedProduct)
+		}
+	}
+}
+
 func TestDirectFull(t *testing.T) {
 	testFileBytes, err := os.ReadFile("../../testdata/test-stub.exe")
 	if err != nil {
@@ -557,6 +639,66 @@ func TestStubServiceErrorCases(t *testing.T) {
 		}
 	})
 
+	t.Run("debug error headers", func(t *testing.T) {
+		level := logrus.GetLevel()
+		defer logrus.SetLevel(level)
+
+		logrus.SetLevel(logrus.InfoLevel)
+		recorder := fetchURL(`http://test/?product=firefox-stub&os=win&lang=en-US`)
+		if reason := recorder.Result().Header.Get("X-Attribution-Error"); reason != "" {
+			t.Errorf("unexpected X-Attribution-Error header outside of debug mode: %s", reason)
+		}
+
+		logrus.SetLevel(logrus.DebugLevel)
+		recorder = fetchURL(`http://test/?product=firefox-stub&os=win&lang=en-US&attribution_code=invalidcode`)
+		header := recorder.Result().Header
+		if reason := header.Get("X-Attribution-Error"); reason != "bad_base64" {
+			t.Errorf("expected X-Attribution-Error: bad_base64, got: %s", reason)
+		}
+		if field := header.Get("X-Attribution-Error-Field"); field != "attribution_code" {
+			t.Errorf("expected X-Attribution-Error-Field: attribution_code, got: %s", field)
+		}
+	})
+
+	t.Run("replayed attribution_code", func(t *testing.T) {
+		validator := attributioncode.NewValidator("testkey", 0)
+		svc := NewStubService(NewDirectHandler(bouncerBaseURL), validator, bouncerBaseURL)
+
+		vals := url.Values{}
+		vals.Set("source", "mozilla.com")
+		vals.Set("campaign", "test")
+		query := attributioncode.Sign(vals, &attributioncode.HMACSigner{Secret: "testkey"}, time.Now()).Query()
+		query.Set("product", "firefox-stub")
+		query.Set("os", "win")
+		query.Set("lang", "en-US")
+
+		sentMetrics := recordMetrics(t)
+		for _, action := range []attributioncode.ReplayAction{attributioncode.ReplayReject, attributioncode.ReplayUnattributed} {
+			validator.ReplayGuard = &attributioncode.ReplayGuard{
+				Store:   attributioncode.NewMemoryReplayStore(10),
+				TTL:     time.Minute,
+				MaxUses: 0,
+				Action:  action,
+			}
+
+			recorder := httptest.NewRecorder()
+			svc.ServeHTTP(recorder, httptest.NewRequest("GET", "http://test/?"+query.Encode(), nil))
+
+			location := recorder.Result().Header.Get("Location")
+			if recorder.Code != 302 || location != "https://download.mozilla.org/?lang=en-US&os=win&product=firefox-stub" {
+				t.Errorf("action: %s, service did not return bouncer redirect status: %d loc: %s", action, recorder.Code, location)
+			}
+
+			lines := sentMetrics()
+			if !hasMetric(lines, "replay.hit:1|c|#source:mozilla.com,action:"+string(action)) {
+				t.Errorf("action: %s, replay.hit was not sent: %v", action, lines)
+			}
+			if rejected := hasMetric(lines, "request.error:1|c|#error_type:replay"); rejected != (action == attributioncode.ReplayReject) {
+				t.Errorf("action: %s, unexpected request.error: %v", action, lines)
+			}
+		}
+	})
+
 	t.Run("unsupported OS", func(t *testing.T) {
 		base64Code := base64.URLEncoding.WithPadding('.').EncodeToString([]byte("campaign=test"))
 
@@ -6,6 +6,7 @@ import (
 	"github.com/mozilla-services/gostatsd/statsd"
 	"github.com/mozilla-services/stubattribution/attributioncode"
 	"github.com/mozilla-services/stubattribution/stubservice/metrics"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -37,13 +38,83 @@ func (s *stubService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	attributionCode := query.Get("attribution_code")
-	code, err := s.AttributionCodeValidator.Validate(attributionCode, query.Get("attribution_sig"), req.Header.Get("Referer"))
+	code, err := s.AttributionCodeValidator.Validate(
+		attributionCode,
+		query.Get("attribution_sig"),
+		query.Get("attribution_kid"),
+		req.Header.Get("Referer"),
+	)
+	var replayErr *attributioncode.ReplayError
+	if errors.As(err, &replayErr) {
+		// Replays are counted separately from validation errors.
+		metrics.Statsd.Clone(statsd.Tags(
+			"source", replayErr.Source,
+			"action", string(replayErr.Action),
+		)).Increment("replay.hit")
+		logEntry := logrus.WithError(err).WithFields(logrus.Fields{
+			"source": replayErr.Source,
+			"action": replayErr.Action,
+		})
+
+		// Rejected codes are handled like invalid ones: the download is
+		// served by bouncer, without attribution, in both cases.
+		if replayErr.Action == attributioncode.ReplayReject {
+			logEntry.Error("Rejected replayed attribution code")
+			defer metrics.Statsd.Clone(statsd.Tags("error_type", "replay")).Increment("request.error")
+		} else {
+			logEntry.Info("Replayed attribution code")
+		}
+		redirectBouncer()
+		return
+	}
 	if err != nil {
-		defer metrics.Statsd.Clone(statsd.Tags("error_type", "validation")).Increment("request.error")
+		logEntry := logrus.WithError(err).WithField("b64code", attributionCode)
+
+		errorType := "validation"
+		if err, ok := err.(*attributioncode.ValidationError); ok {
+			logEntry = logEntry.WithFields(logrus.Fields{
+				"reason": err.Reason,
+				"field":  err.Field,
+			})
+			switch err.Reason {
+			case attributioncode.ReasonExpired:
+				errorType = "expired"
+			case attributioncode.ReasonInvalidValue:
+				errorType = "invalid_value"
+			}
+			if err, ok := err.Err.(*attributioncode.InvalidValueError); ok {
+				reportViolation(attributioncode.Violation{
+					Field:  err.Field,
+					Rule:   err.Rule,
+					Action: attributioncode.ActionReject,
+				})
+			}
+			metrics.Statsd.Clone(statsd.Tags("reason", string(err.Reason))).Increment("validation.error")
+
+			if logrus.IsLevelEnabled(logrus.DebugLevel) {
+				w.Header().Set("X-Attribution-Error", string(err.Reason))
+				w.Header().Set("X-Attribution-Error-Field", err.Field)
+			}
+		}
+		logEntry.Error("Invalid attribution code")
+
+		defer metrics.Statsd.Clone(statsd.Tags("error_type", errorType)).Increment("request.error")
 		redirectBouncer()
 		return
 	}
 
+	for _, violation := range code.Violations() {
+		reportViolation(violation)
+	}
+
+	if partner := code.Partner(); partner != nil {
+		metrics.Statsd.Clone(statsd.Tags("partner", partner.Name)).Increment("request.partner")
+	}
+
+	if keyID := code.KeyID(); keyID != "" {
+		metrics.Statsd.Clone(statsd.Tags("key_id", keyID)).Increment("request.signed")
+	}
+
 	logrus.WithFields(
 		logrus.Fields{
 			"log_type": "download_started",
@@ -79,14 +150,24 @@ func (s *stubService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			},
 		)
 
+		// Handlers may wrap the errors, e.g. with the name of the failing
+		// step, so they are matched with errors.As.
 		errorType := "stub"
-		switch err := err.(type) {
-		case *modifyStubError:
+		var (
+			modifyErr    *modifyStubError
+			untrustedErr *untrustedStubError
+			fetchErr     *fetchStubError
+		)
+		switch {
+		case errors.As(err, &modifyErr):
 			errorType = "modifystub"
-			logEntry = logEntry.WithField("code", err.Code)
-		case *fetchStubError:
+			logEntry = logEntry.WithField("code", modifyErr.Code)
+		case errors.As(err, &untrustedErr):
+			errorType = "untrustedstub"
+			logEntry = logEntry.WithField("signer", untrustedErr.Subject).WithField("fetch_stub_url", untrustedErr.URL)
+		case errors.As(err, &fetchErr):
 			errorType = "fetchstub"
-			logEntry = logEntry.WithField("status_code", err.StatusCode).WithField("fetch_stub_url", err.URL)
+			logEntry = logEntry.WithField("status_code", fetchErr.StatusCode).WithField("fetch_stub_url", fetchErr.URL)
 		}
 
 		defer metrics.Statsd.Clone(statsd.Tags("error_type", errorType)).Increment("request.error")
@@ -120,6 +201,21 @@ func (s *stubService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	).Info("Download Finished")
 }
 
+// reportViolation records a value which broke a rule of the attribution schema.
+func reportViolation(violation attributioncode.Violation) {
+	metrics.Statsd.Clone(statsd.Tags(
+		"field", violation.Field,
+		"rule", violation.Rule,
+		"action", string(violation.Action),
+	)).Increment("validation.field")
+
+	logrus.WithFields(logrus.Fields{
+		"field":  violation.Field,
+		"rule":   violation.Rule,
+		"action": violation.Action,
+	}).Info("Attribution value broke a schema rule")
+}
+
 func trimToLen(s string, l int) string {
 	if l < 0 || len(s) <= l {
 		return s
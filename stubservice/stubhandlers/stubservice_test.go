@@ -1,10 +1,61 @@
 package stubhandlers
 
 import (
+	"net"
+	"strings"
 	"testing"
 	"testing/quick"
+	"time"
+
+	"github.com/mozilla-services/gostatsd/statsd"
+	"github.com/mozilla-services/stubattribution/stubservice/metrics"
 )
 
+// recordMetrics sends the metrics to a local listener until the end of the
+// test. It returns a function which returns the metrics sent since it was last
+// called, e.g. "replay.hit:1|c|#source:a,action:reject".
+func recordMetrics(t *testing.T) func() []string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := statsd.New(statsd.Address(conn.LocalAddr().String()), statsd.TagsFormat(statsd.Datadog), statsd.FlushPeriod(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := metrics.Statsd
+	metrics.Statsd = client
+	t.Cleanup(func() {
+		metrics.Statsd = original
+		client.Close()
+		conn.Close()
+	})
+
+	return func() []string {
+		client.Flush()
+		var lines []string
+		buf := make([]byte, 65536)
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return lines
+			}
+			lines = append(lines, strings.Split(strings.TrimSpace(string(buf[:n])), "\n")...)
+		}
+	}
+}
+
+// hasMetric returns true when one of lines starts with prefix.
+func hasMetric(lines []string, prefix string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func TestTrimToLen(t *testing.T) {
 	f := func(s string, l int) bool {
 		// make sure l is positive
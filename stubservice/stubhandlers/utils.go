@@ -11,9 +11,11 @@ import (
 	"time"
 
 	"github.com/golang/groupcache/singleflight"
+	"github.com/mozilla-services/gostatsd/statsd"
+	"github.com/mozilla-services/stubattribution/attributioncode"
 	"github.com/mozilla-services/stubattribution/dmglib"
 	"github.com/mozilla-services/stubattribution/dmgmodify/dmgmodify"
-	"github.com/mozilla-services/stubattribution/stubmodify"
+	"github.com/mozilla-services/stubattribution/stubmodify/stubmodify"
 	"github.com/mozilla-services/stubattribution/stubservice/metrics"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -31,6 +33,14 @@ func bouncerURL(product, lang, os string, baseURL string) string {
 	return baseURL + "?" + v.Encode()
 }
 
+// stubProduct returns the product requested from bouncer for code.
+func stubProduct(code *attributioncode.Code, product string) string {
+	if partner := code.Partner(); partner != nil && partner.Product != "" {
+		return partner.Product
+	}
+	return product
+}
+
 type modifiedStub struct {
 	Data []byte
 	Resp *http.Response
@@ -42,9 +52,11 @@ type fetchStubError struct {
 	StatusCode int
 }
 
-// uses global stub cache
-func fetchStub(url string) (*stub, error) {
-	if s := globalStubCache.Get(url); s != nil {
+// uses global stub cache. The returned stub is shared with the cache and
+// must not be modified. os is the operating system requested from bouncer:
+// the signer of Windows builds is checked when SignerAllowlist is set.
+func fetchStub(url string, os string) (*stub, error) {
+	if s := globalStubCache.GetShared(url); s != nil {
 		metrics.Statsd.Increment("fetch_stub.cache_hit")
 		return s, nil
 	}
@@ -67,12 +79,24 @@ func fetchStub(url string) (*stub, error) {
 		return nil, &fetchStubError{errors.Wrap(err, "ReadAll"), url, resp.StatusCode}
 	}
 
+	if len(SignerAllowlist) > 0 && isWindows(os) {
+		if subject, err := checkSigner(data, time.Now()); err != nil {
+			metrics.Statsd.Increment("fetch_stub.untrusted")
+			return nil, &untrustedStubError{
+				&fetchStubError{errors.Wrap(err, "checkSigner"), url, resp.StatusCode},
+				subject,
+			}
+		}
+	}
+
 	res := &stub{
 		body:        data,
 		contentType: resp.Header.Get("Content-Type"),
 		filename:    path.Base(resp.Request.URL.Path),
+		sha256:      fmt.Sprintf("%X", sha256.Sum256(data)),
 	}
-	globalStubCache.Add(url, res.copy())
+	res.prepareTemplates(os)
+	globalStubCache.Add(url, res)
 
 	logrus.WithFields(logrus.Fields{
 		"bouncer_url": url,
@@ -83,9 +107,9 @@ func fetchStub(url string) (*stub, error) {
 }
 
 // sfFetchStub runs fetchStub in a singleflight group
-func sfFetchStub(sfGroup *singleflight.Group, url string) (*stub, error) {
+func sfFetchStub(sfGroup *singleflight.Group, url string, os string) (*stub, error) {
 	res, err := sfGroup.Do(url, func() (interface{}, error) {
-		return fetchStub(url)
+		return fetchStub(url, os)
 	})
 	if res == nil {
 		return nil, err
@@ -98,44 +122,103 @@ type modifyStubError struct {
 	Code string
 }
 
-func modifyStub(st *stub, attributionCode string, os string) (res *stub, err error) {
+// codeEncoder encodes an attribution code to fit in an installer.
+// *attributioncode.Code implements it.
+type codeEncoder interface {
+	Encode(opts attributioncode.EncodeOptions) (*attributioncode.Payload, error)
+}
+
+// peAttributionBudget is the maximum number of bytes available for an
+// attribution code in a Windows stub installer.
+const peAttributionBudget = stubmodify.MaxLength - len(stubmodify.MozTag)
+
+// VerifyAuthenticode enables checking that modified Windows stub installers
+// have the same Authenticode digest as the original ones.
+var VerifyAuthenticode = false
+
+func modifyStub(st *stub, code codeEncoder, os string) (res *stub, payload *attributioncode.Payload, err error) {
 	metrics.Statsd.Increment("modify_stub")
 
-	body := st.body
-	if attributionCode != "" {
+	res = &stub{
+		body:        st.body,
+		contentType: st.contentType,
+	}
+	payload = new(attributioncode.Payload)
+	if code != nil {
 		switch os {
 		case "osx":
-			// Mac DMG attribution
-			dmgbody, err := dmglib.ParseDMG(bytes.NewReader(body))
+			// Mac DMG attribution. The body is shared with the stub cache:
+			// the attribution code is patched in when the stub is served.
+			template := st.dmgTemplate
+			if template == nil {
+				dmgbody, err := dmglib.ParseDMG(bytes.NewReader(st.body))
+				if err != nil {
+					// Error parsing the DMG
+					return nil, nil, &modifyStubError{err, ""}
+				}
+				if template, err = dmgmodify.NewTemplate(dmgbody); err != nil {
+					return nil, nil, &modifyStubError{err, ""}
+				}
+			}
+			if payload, err = code.Encode(attributioncode.EncodeOptions{MaxLength: template.Capacity()}); err != nil {
+				return nil, nil, &modifyStubError{err, ""}
+			}
+			patches, err := template.Patches([]byte(payload.Code))
 			if err != nil {
-				// Error parsing the DMG
-				return nil, &modifyStubError{err, attributionCode}
+				return nil, nil, &modifyStubError{err, payload.Code}
 			}
-			// Update the body in-place
-			if err = dmgmodify.WriteAttributionCode(dmgbody, []byte(attributionCode)); err != nil {
-				return nil, &modifyStubError{err, attributionCode}
+			for _, patch := range patches {
+				res.patches = append(res.patches, stubmodify.Patch(patch))
 			}
-			body = dmgbody.Data
 		default:
 			// Windows exe attribution is the default since only macOS and Windows builds are attributable,
 			// and macOS only has one "os" identifier.
 			//
 			// Note also that the bouncer service determines which build should be attributed.
-			if body, err = stubmodify.WriteAttributionCode(st.body, []byte(attributionCode)); err != nil {
-				return nil, &modifyStubError{err, attributionCode}
+			//
+			// The body is shared with the stub cache: the attribution code is
+			// patched in when the stub is served.
+			template := st.peTemplate
+			if template == nil {
+				if template, err = stubmodify.NewTemplate(st.body); err != nil {
+					return nil, nil, &modifyStubError{err, ""}
+				}
+			}
+			budget := template.Capacity()
+			if budget > peAttributionBudget {
+				budget = peAttributionBudget
+			}
+			if payload, err = code.Encode(attributioncode.EncodeOptions{MaxLength: budget}); err != nil {
+				return nil, nil, &modifyStubError{err, ""}
+			}
+			if res.patches, err = template.Patches([]byte(payload.Code)); err != nil {
+				return nil, nil, &modifyStubError{err, payload.Code}
+			}
+			if VerifyAuthenticode {
+				if err = stubmodify.VerifyPatches(st.body, res.patches); err != nil {
+					return nil, nil, &modifyStubError{err, payload.Code}
+				}
 			}
 		}
 	}
 
-	logrus.WithFields(logrus.Fields{
+	for _, field := range payload.Dropped {
+		metrics.Statsd.Clone(statsd.Tags("field", field, "os", os)).Increment("modify_stub.dropped_field")
+	}
+
+	logEntry := logrus.WithFields(logrus.Fields{
 		"original_filename":    st.filename,
-		"original_stub_sha256": fmt.Sprintf("%X", sha256.Sum256(st.body)),
-		"modified_stub_sha256": fmt.Sprintf("%X", sha256.Sum256(body)),
-		"attribution_code":     attributionCode,
-	}).Info("Modified stub")
+		"original_stub_sha256": st.sha256,
+		"attribution_code":     payload.Code,
+		"dropped_fields":       payload.Dropped,
+	})
+	// Hashing the modified stub reads all of it, for every request.
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		modifiedHash := sha256.New()
+		res.reader().WriteTo(modifiedHash)
+		logEntry = logEntry.WithField("modified_stub_sha256", fmt.Sprintf("%X", modifiedHash.Sum(nil)))
+	}
+	logEntry.Info("Modified stub")
 
-	return &stub{
-		body:        body,
-		contentType: st.contentType,
-	}, nil
+	return res, payload, nil
 }
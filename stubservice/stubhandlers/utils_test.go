@@ -2,17 +2,33 @@ package stubhandlers
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/mozilla-services/stubattribution/attributioncode"
 	"github.com/mozilla-services/stubattribution/dmglib"
+	"github.com/mozilla-services/stubattribution/dmgmodify/dmgmodify"
+	"github.com/mozilla-services/stubattribution/stubmodify/stubmodify"
 )
 
 const attributionChars = "abcdefghijklmnopqrstuvwxyz1234567890"
 
+// rawCode is a codeEncoder which ignores the budget so that the stub writers
+// get the code unchanged.
+type rawCode string
+
+func (c rawCode) Encode(attributioncode.EncodeOptions) (*attributioncode.Payload, error) {
+	return &attributioncode.Payload{Code: string(c)}, nil
+}
+
 func TestFetchStub(t *testing.T) {
 	t.Run("fetchStub", func(t *testing.T) {
 		// Sample JSON response
@@ -22,18 +38,21 @@ func TestFetchStub(t *testing.T) {
 			w.Write(sampleBody)
 		}))
 		defer s.Close()
-		got, err := fetchStub(s.URL)
+		got, err := fetchStub(s.URL, "win")
 		if err != nil {
 			t.Errorf("Unexpected error: %s", err)
 		}
 		if !bytes.Equal(got.body, sampleBody) {
 			t.Errorf("Expected %s, got: %s", sampleBody, got.body)
 		}
+		if sum := fmt.Sprintf("%X", sha256.Sum256(sampleBody)); got.sha256 != sum {
+			t.Errorf("Expected sha256 %s, got: %s", sum, got.sha256)
+		}
 	})
 
 	t.Run("fetchStub - invalid URL", func(t *testing.T) {
 		errMessage := `Get: Get "bogus://url": unsupported protocol scheme "bogus"`
-		_, err := fetchStub("bogus://url")
+		_, err := fetchStub("bogus://url", "win")
 		if err == nil {
 			t.Error("Expected an error with bogus URL")
 		}
@@ -47,7 +66,7 @@ func TestFetchStub(t *testing.T) {
 			w.WriteHeader(http.StatusBadRequest)
 		}))
 		defer s.Close()
-		_, err := fetchStub(s.URL)
+		_, err := fetchStub(s.URL, "win")
 		if err == nil {
 			t.Error("Expected an error with invalid status code")
 		}
@@ -75,25 +94,116 @@ func TestModifyStubEXE(t *testing.T) {
 		st := &stub{
 			body: fileBytes,
 		}
-		_, err = modifyStub(st, "hello=attribution&os=win", "win")
+		_, _, err = modifyStub(st, rawCode("hello=attribution&os=win"), "win")
 		if err != nil {
 			t.Errorf("Unexpected error: %s", err)
 		}
 	})
 
+	t.Run("modifyStub - EXE verify Authenticode", func(t *testing.T) {
+		VerifyAuthenticode = true
+		defer func() { VerifyAuthenticode = false }()
+
+		st := &stub{
+			body: fileBytes,
+		}
+		_, _, err = modifyStub(st, rawCode("hello=attribution&os=win"), "win")
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	})
+
+	t.Run("modifyStub - EXE shares the original body", func(t *testing.T) {
+		original := append([]byte(nil), fileBytes...)
+		st := &stub{
+			body: fileBytes,
+		}
+		res, _, err := modifyStub(st, rawCode("hello=attribution&os=win"), "win")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !bytes.Equal(fileBytes, original) {
+			t.Error("modifyStub modified the original body")
+		}
+
+		expected, err := stubmodify.WriteAttributionCode(fileBytes, []byte("hello=attribution&os=win"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		served := new(bytes.Buffer)
+		if _, err := res.reader().WriteTo(served); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !bytes.Equal(served.Bytes(), expected) || res.size() != int64(len(expected)) {
+			t.Error("served stub does not match WriteAttributionCode")
+		}
+	})
+
+	t.Run("modifyStub - EXE with a template", func(t *testing.T) {
+		st := &stub{
+			body: fileBytes,
+		}
+		st.prepareTemplates("win")
+		if st.peTemplate == nil || st.dmgTemplate != nil {
+			t.Fatal("Expected a PE template")
+		}
+
+		res, _, err := modifyStub(st, rawCode("hello=attribution&os=win"), "win")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		expected, err := stubmodify.WriteAttributionCode(fileBytes, []byte("hello=attribution&os=win"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		served := new(bytes.Buffer)
+		if _, err := res.reader().WriteTo(served); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !bytes.Equal(served.Bytes(), expected) {
+			t.Error("served stub does not match WriteAttributionCode")
+		}
+	})
+
 	t.Run("modifyStub - EXE fail", func(t *testing.T) {
 		st := &stub{
 			body: fileBytes,
 		}
 		attribution := makeRandomString(100000)
 
-		_, err = modifyStub(st, "ginormous="+attribution, "win")
+		_, _, err = modifyStub(st, rawCode("ginormous="+attribution), "win")
 		if err == nil {
 			t.Error("Expected an error writing a huge attribution code")
 		}
 	})
 }
 
+func TestModifyStubDropsFields(t *testing.T) {
+	fileBytes, err := os.ReadFile("../../testdata/test-stub.exe")
+	if err != nil {
+		t.Fatalf("Error reading test EXE: %s", err)
+	}
+
+	// Every "(" is escaped twice, so the encoded code is much longer than the
+	// validated one.
+	vals := "campaign=test&experiment=" + strings.Repeat("(", 250) + "&variation=" + strings.Repeat("(", 100)
+	code, err := (&attributioncode.Validator{}).Validate(base64.URLEncoding.WithPadding('.').EncodeToString([]byte(vals)), "", "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	_, payload, err := modifyStub(&stub{body: fileBytes}, code, "win")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(payload.Code) > peAttributionBudget {
+		t.Errorf("Expected the code to fit in %d bytes, got: %d", peAttributionBudget, len(payload.Code))
+	}
+	if !reflect.DeepEqual(payload.Dropped, []string{"variation", "experiment"}) {
+		t.Errorf("Expected variation and experiment to be dropped, got: %v", payload.Dropped)
+	}
+}
+
 func TestModifyStubDMG(t *testing.T) {
 	file, err := dmglib.OpenFile("../../testdata/attributable.dmg")
 	if err != nil {
@@ -110,17 +220,47 @@ func TestModifyStubDMG(t *testing.T) {
 			body: dmg.Data,
 		}
 
-		_, err = modifyStub(st, "hello=attribution&os=osx", "osx")
+		_, _, err = modifyStub(st, rawCode("hello=attribution&os=osx"), "osx")
 		if err != nil {
 			t.Errorf("Unexpected error: %s", err)
 		}
 	})
 
+	t.Run("modifyStub - DMG with a template", func(t *testing.T) {
+		st := &stub{
+			body: dmg.Data,
+		}
+		st.prepareTemplates("osx")
+		if st.dmgTemplate == nil || st.peTemplate != nil {
+			t.Fatal("Expected a DMG template")
+		}
+
+		res, _, err := modifyStub(st, rawCode("hello=attribution&os=osx"), "osx")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		expected, err := dmglib.ParseDMG(bytes.NewReader(dmg.Data))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := dmgmodify.WriteAttributionCode(expected, []byte("hello=attribution&os=osx")); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		served := new(bytes.Buffer)
+		if _, err := res.reader().WriteTo(served); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !bytes.Equal(served.Bytes(), expected.Data) {
+			t.Error("served stub does not match WriteAttributionCode")
+		}
+	})
+
 	t.Run("modifyStub - DMG parse failure", func(t *testing.T) {
 		st := &stub{
 			body: []byte("This is not a dmg!"),
 		}
-		_, err := modifyStub(st, "hello=errors", "osx")
+		_, _, err := modifyStub(st, rawCode("hello=errors"), "osx")
 
 		if err == nil {
 			t.Error("Expected an error failing to parse")
@@ -133,7 +273,7 @@ func TestModifyStubDMG(t *testing.T) {
 		}
 		attribution := makeRandomString(100000)
 
-		_, err = modifyStub(st, "ginormous="+attribution, "osx")
+		_, _, err = modifyStub(st, rawCode("ginormous="+attribution), "osx")
 		if err == nil {
 			t.Error("Expected an error writing a huge attribution code")
 		}
@@ -144,7 +284,7 @@ func TestModifyStubFailOS(t *testing.T) {
 	st := &stub{
 		body: []byte("test"),
 	}
-	_, err := modifyStub(st, "hello=errors", "ardweeno")
+	_, _, err := modifyStub(st, rawCode("hello=errors"), "ardweeno")
 
 	if err == nil {
 		t.Error("Expected an error for unsupported OS")
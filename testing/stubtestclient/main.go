@@ -1,8 +1,7 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/ed25519"
 	"encoding/base64"
 	"flag"
 	"fmt"
@@ -10,6 +9,8 @@ import (
 	"math/rand"
 	"net/url"
 	"time"
+
+	"github.com/mozilla-services/stubattribution/attributioncode"
 )
 
 var (
@@ -30,7 +31,9 @@ var (
 	os      string
 	product string
 
-	hmacKey string
+	hmacKey    string
+	keyID      string
+	ed25519Key string
 
 	numUrls int
 )
@@ -68,11 +71,13 @@ func init() {
 	flag.StringVar(&product, "product", "test-stub", "")
 
 	flag.StringVar(&hmacKey, "hmackey", "testkey", "test hmac key")
+	flag.StringVar(&keyID, "kid", "", "id of the signing key, sent as attribution_kid if set")
+	flag.StringVar(&ed25519Key, "ed25519key", "", "base64 encoded ed25519 seed, used instead of the hmac key if set")
 
 	flag.IntVar(&numUrls, "numurls", 1, "adds a random string to campaign, generates number of urls specified")
 }
 
-func genCode() string {
+func genCode(signer attributioncode.Signer) *attributioncode.SignedCode {
 	query := url.Values{}
 	query.Set("campaign", campaign)
 	query.Set("content", content)
@@ -83,23 +88,24 @@ func genCode() string {
 	query.Set("client_id", clientID)
 	query.Set("client_id_ga4", clientIDGA4)
 	query.Set("session_id", sessionID)
-	query.Set("timestamp", fmt.Sprintf("%d", time.Now().UTC().Unix()))
 
-	b64Query := base64.URLEncoding.WithPadding('.').EncodeToString([]byte(query.Encode()))
-	return b64Query
+	return attributioncode.Sign(query, signer, time.Now())
 }
 
-func hmacSig(code string) string {
-	mac := hmac.New(sha256.New, []byte(hmacKey))
-	mac.Write([]byte(code))
-	return fmt.Sprintf("%x", mac.Sum(nil))
-}
+func newSigner() attributioncode.Signer {
+	if ed25519Key == "" {
+		return &attributioncode.HMACSigner{ID: keyID, Secret: hmacKey}
+	}
 
-func genURL(code, sig string) string {
-	query := url.Values{}
-	query.Set("attribution_code", code)
-	query.Set("attribution_sig", sig)
+	seed, err := base64.StdEncoding.DecodeString(ed25519Key)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		log.Fatalf("ed25519key must be a base64 encoded %d byte seed", ed25519.SeedSize)
+	}
+	return &attributioncode.Ed25519Signer{ID: keyID, PrivateKey: ed25519.NewKeyFromSeed(seed)}
+}
 
+func genURL(code *attributioncode.SignedCode) string {
+	query := code.Query()
 	query.Set("lang", lang)
 	query.Set("os", os)
 	query.Set("product", product)
@@ -115,13 +121,12 @@ func genURL(code, sig string) string {
 func main() {
 	flag.Parse()
 
+	signer := newSigner()
 	originalCampaign := campaign
 	for i := 0; i < numUrls; i++ {
 		if i > 0 {
 			campaign = originalCampaign + randomString(12)
 		}
-		code := genCode()
-		sig := hmacSig(url.QueryEscape(code))
-		fmt.Println(genURL(code, sig))
+		fmt.Println(genURL(genCode(signer)))
 	}
 }